@@ -1,14 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
-	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	kcode "github.com/malminhas/kcode/pkg/kcode"
 	//kcode "../../pkg/kcode"
 	docopt "github.com/docopt/docopt-go"
+	log "github.com/sirupsen/logrus"
 )
 
 // Build instructions:
@@ -32,13 +38,43 @@ func dumpParts(parts []string) {
 	}
 }
 
+// cache holds parsed programs and validate, lint, metrics and kits results between runs when --cache is given.  A nil cache caches nothing.
+var cache *kcode.Cache
+
+// stdinName is the <file> that reads a .kcode creation from stdin
+const stdinName = "-"
+
+// isDirectory reports whether the <file> passed in is a directory or archive rather than a single creation
+func isDirectory(fname string) bool {
+	return fname != stdinName && kcode.IsDirectory(fname)
+}
+
+// readInput reads a .kcode file, or stdin when the file is "-"
+func readInput(fname string) []byte {
+	if fname == stdinName {
+		data, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			panic(err)
+		}
+		return data
+	}
+	return kcode.ReadFile(fname)
+}
+
+// eachKcodeFile calls fn for every .kcode file in a directory or archive, see kcode.EachKcodeFile.
+// Like kcode it panics on hard errors such as an unreadable archive.
+func eachKcodeFile(dir string, fn func(fname string, data []byte)) {
+	if err := kcode.EachKcodeFile(dir, fn); err != nil {
+		panic(err)
+	}
+}
+
 func processDirectory(dir string, flags kcode.KCodeFlags, verbose bool) {
-	files := kcode.ListFilesInDirectory(dir)
-	for _, f := range files {
-		fname := dir + "/" + f.Name()
-		spells, blocks, parts, scene := kcode.ProcessKcodeFile(fname, flags, verbose)
+	eachKcodeFile(dir, func(fname string, data []byte) {
+		spells, blocks, parts, scene := kcode.ProcessKcodeFileString(data, flags, verbose)
 		if flags.Spells {
 			dumpSpells(spells)
+			dumpSpellIssues(spells)
 		}
 		if flags.Blocks {
 			dumpBlocks(blocks)
@@ -49,47 +85,523 @@ func processDirectory(dir string, flags kcode.KCodeFlags, verbose bool) {
 		if flags.Scene {
 			fmt.Printf("%s", scene)
 		}
+	})
+}
+
+func dumpSceneIssues(fname string, data []byte) {
+	issues, err := kcode.ValidateScene(data)
+	if err != nil {
+		fmt.Printf("Could not check scene of '%s': %s\n", fname, err)
+		return
+	}
+	for _, issue := range issues {
+		fmt.Printf("scene: %s\n", issue)
 	}
 }
 
-func validateDirectory(dir string, verbose bool) {
-	files := kcode.ListFilesInDirectory(dir)
-	for _, f := range files {
-		fname := dir + "/" + f.Name()
-		if filepath.Ext(fname) == ".kcode" {
-			expectedSpells, foundSpells, expectedBlocks, foundBlocks, expectedParts, foundParts, expectedScene, foundScene, valid := kcode.ValidateFile(fname, verbose)
-			if valid {
-				fmt.Printf("SUCCEEDED in validating '%s'.\nExpected and found %d spells and %d blocks\n", fname, foundSpells, foundBlocks)
-			} else {
-				fmt.Printf("FAILED to validate '%s'.\nExpected %d spells and found %d.\nExpected %d blocks and found %d\n",
-					fname, expectedSpells, foundSpells, expectedBlocks, foundBlocks)
-				fmt.Printf("Expected %d parts and found %d.\nExpected %d len scene and found %d\n",
-					expectedParts, foundParts, expectedScene, foundScene)
+// dumpSpellIssues prints the spells that are not in the spell catalogue
+func dumpSpellIssues(spells []string) {
+	for _, issue := range kcode.CheckSpells(spells) {
+		fmt.Printf("spell: %s\n", issue)
+	}
+}
+
+func dumpReports(reports []*kcode.ValidationReport, asJSON bool) {
+	if asJSON {
+		data, _ := json.MarshalIndent(reports, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+	for _, report := range reports {
+		fmt.Print(report)
+	}
+}
+
+func writeJUnit(filename string, reports []*kcode.ValidationReport) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return kcode.WriteJUnit(f, "kcode validate", reports)
+}
+
+func writeSARIF(filename string, files []kcode.FileIssues) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return kcode.WriteSARIF(f, files)
+}
+
+func lintFile(fname string, data []byte) kcode.FileIssues {
+	issues, err := cache.Lint(data)
+	if err != nil {
+		issues = []kcode.Issue{{Kind: kcode.KindMalformed, Message: err.Error()}}
+	}
+	return kcode.FileIssues{File: fname, Issues: issues}
+}
+
+func lintDirectory(dir string) []kcode.FileIssues {
+	files := make([]kcode.FileIssues, 0)
+	eachKcodeFile(dir, func(fname string, data []byte) {
+		files = append(files, lintFile(fname, data))
+	})
+	return files
+}
+
+// queryFile prints the file, block id and path of each block in a creation matching the selector
+// and returns the number of matches
+func queryFile(fname string, data []byte, selector *kcode.Selector) int {
+	prog, err := cache.Program(data)
+	if err != nil {
+		fmt.Printf("Could not parse '%s': %s\n", fname, err)
+		return 0
+	}
+	matches := selector.Match(prog)
+	for _, match := range matches {
+		fmt.Printf("%s\t%s\t%s\n", fname, match.Block.Id, match.Path)
+	}
+	return len(matches)
+}
+
+// updateIndex loads the index, brings it up to date with the directory or archive and saves it
+func updateIndex(filename string, dir string) (*kcode.Index, kcode.IndexStats, error) {
+	ix, err := kcode.LoadIndex(filename)
+	if err != nil {
+		return nil, kcode.IndexStats{}, err
+	}
+	stats, err := ix.Update(dir)
+	if err != nil {
+		return nil, stats, err
+	}
+	return ix, stats, ix.Save(filename)
+}
+
+func dumpOccurrences(occurrences []kcode.Occurrence) {
+	for _, o := range occurrences {
+		if len(o.BlockIds) > 0 {
+			fmt.Printf("%s: %s\n", o.File, strings.Join(o.BlockIds, ", "))
+		} else {
+			fmt.Printf("%s\n", o.File)
+		}
+	}
+}
+
+// dumpFingerprints prints the fingerprint of each file sorted by fingerprint so that
+// equivalent creations are listed together, followed by a count of the duplicates
+func dumpFingerprints(fingerprints map[string]string) {
+	files := make([]string, 0, len(fingerprints))
+	for f := range fingerprints {
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if fingerprints[files[i]] != fingerprints[files[j]] {
+			return fingerprints[files[i]] < fingerprints[files[j]]
+		}
+		return files[i] < files[j]
+	})
+	duplicates := 0
+	for i, f := range files {
+		if i > 0 && fingerprints[f] == fingerprints[files[i-1]] {
+			duplicates++
+		}
+		fmt.Printf("%s  %s\n", fingerprints[f], f)
+	}
+	if len(files) > 1 {
+		fmt.Printf("%d files, %d duplicates\n", len(files), duplicates)
+	}
+}
+
+// variablesFile prints each variable in a creation with the blocks reading and writing it
+// followed by any variable issues, and returns the number of issues
+func variablesFile(fname string, data []byte) int {
+	prog, err := cache.Program(data)
+	if err != nil {
+		fmt.Printf("Could not parse '%s': %s\n", fname, err)
+		return 0
+	}
+	for _, u := range kcode.AnalyzeVariables(prog) {
+		declared := ""
+		if !u.Declared {
+			declared = " (undeclared)"
+		}
+		fmt.Printf("%s: variable %s%s: reads [%s] writes [%s]\n", fname, u.Variable.Name, declared,
+			strings.Join(u.Reads, ", "), strings.Join(u.Writes, ", "))
+	}
+	issues := kcode.CheckVariables(prog)
+	dumpLint([]kcode.FileIssues{{File: fname, Issues: issues}})
+	return len(issues)
+}
+
+// commentsFile prints the comments on the blocks of a creation
+func commentsFile(fname string, data []byte) {
+	comments, err := kcode.ExtractComments(data)
+	if err != nil {
+		fmt.Printf("Could not parse '%s': %s\n", fname, err)
+		return
+	}
+	for _, c := range comments {
+		disabled := ""
+		if c.Disabled {
+			disabled = " (disabled)"
+		}
+		fmt.Printf("%s: %s id=%s%s: %s\n", fname, c.BlockType, c.BlockId, disabled, c.Text)
+	}
+}
+
+// handlersFile prints each event handler of a creation followed by its actions indented by nesting
+func handlersFile(fname string, data []byte) {
+	handlers, err := kcode.ExtractHandlers(data)
+	if err != nil {
+		fmt.Printf("Could not parse '%s': %s\n", fname, err)
+		return
+	}
+	for _, h := range handlers {
+		fmt.Printf("%s: %s (id=%s)\n", fname, h.Name(), h.BlockId)
+		for _, a := range h.Actions {
+			fmt.Printf("  %s→ %s\n", strings.Repeat("  ", a.Depth), a)
+		}
+	}
+}
+
+// traceFile prints the steps each event handler of a creation takes in the order they happen
+func traceFile(fname string, data []byte) {
+	traces, err := kcode.ExtractExecutionOrder(data)
+	if err != nil {
+		fmt.Printf("Could not parse '%s': %s\n", fname, err)
+		return
+	}
+	for _, t := range traces {
+		fmt.Printf("%s: %s (id=%s)\n", fname, t.Name(), t.BlockId)
+		for _, s := range t.Steps {
+			verb := "run"
+			if s.Value {
+				verb = "eval"
+			}
+			fmt.Printf("  %3d. %s%s %s\n", s.Seq, strings.Repeat("  ", s.Depth), verb, s)
+		}
+	}
+}
+
+// kitsFile prints the kits a creation is for followed by any mixing of kits that do not
+// work together, and returns the number of issues
+func kitsFile(fname string, data []byte, verbose bool) int {
+	report, err := cache.Kits(data)
+	if err != nil {
+		fmt.Printf("Could not parse '%s': %s\n", fname, err)
+		return 0
+	}
+	fmt.Printf("%s: %s\n", fname, report)
+	if verbose {
+		for _, u := range report.Uses {
+			fmt.Printf("  %s: %s at %s\n", kcode.KitNames([]string{u.Kit}), u.What, u.Path)
+		}
+	}
+	dumpLint([]kcode.FileIssues{{File: fname, Issues: report.Issues}})
+	return len(report.Issues)
+}
+
+// fileMetrics are the metrics of one file as printed by metrics --json
+type fileMetrics struct {
+	File string `json:"file"`
+	kcode.Metrics
+}
+
+// metricsFile returns the metrics of a creation, printing them unless they are wanted as JSON
+func metricsFile(fname string, data []byte, asJSON bool) fileMetrics {
+	m, err := cache.Metrics(data)
+	if err != nil {
+		fmt.Printf("Could not parse '%s': %s\n", fname, err)
+		return fileMetrics{File: fname, Metrics: kcode.Metrics{Timings: []kcode.HandlerTiming{}}}
+	}
+	if !asJSON {
+		fmt.Printf("%s: %d blocks, %d handlers, %d procedures, %d variables\n", fname, m.Blocks, m.Handlers, m.Procedures, m.Variables)
+		for _, t := range m.Timings {
+			slow := ""
+			if t.Slow {
+				slow = " (slow)"
 			}
+			fmt.Printf("  %s%s\n", t, slow)
+		}
+	}
+	return fileMetrics{File: fname, Metrics: m}
+}
+
+// simplifyFile simplifies a creation and prints the changes made.  With dryRun it prints
+// them as a diff of the kcode XML, otherwise it writes the simplified creation to output,
+// which is the file itself when empty.  It returns false if the file could not be simplified.
+func simplifyFile(fname string, data []byte, dryRun bool, output string) bool {
+	simplified, changes, err := kcode.SimplifyString(data)
+	if err != nil {
+		fmt.Printf("Could not parse '%s': %s\n", fname, err)
+		return false
+	}
+	for _, c := range changes {
+		fmt.Printf("%s: %s\n", fname, c)
+	}
+	if dryRun {
+		before, _ := kcode.ExtractProgram(data)
+		after, _ := kcode.ExtractProgram(simplified)
+		var to []byte
+		from, err := kcode.MarshalProgramIndent(before)
+		if err == nil {
+			to, err = kcode.MarshalProgramIndent(after)
+		}
+		if err != nil {
+			fmt.Printf("Could not write out '%s': %s\n", fname, err)
+			return false
+		}
+		fmt.Print(kcode.UnifiedDiff(fname, fname+" (simplified)", from, to))
+		return true
+	}
+	if len(changes) == 0 && len(output) == 0 {
+		return true
+	}
+	if len(output) == 0 {
+		output = fname
+	}
+	if output == stdinName {
+		fmt.Println("Use --output to say where to write a creation read from stdin")
+		return false
+	}
+	if err := ioutil.WriteFile(output, simplified, 0644); err != nil {
+		fmt.Printf("Could not write '%s': %s\n", output, err)
+		return false
+	}
+	fmt.Printf("%s: wrote %s\n", fname, output)
+	return true
+}
+
+// lightsFile renders what the lights of a creation show over its first seconds and writes it to
+// output as an animated GIF, or as a PNG sprite sheet with sheet.  When output is empty it goes
+// next to the file with a .gif or .png extension.  It returns false if nothing could be written.
+func lightsFile(fname string, data []byte, output string, sheet bool, seconds float64, scale int) bool {
+	anim, err := kcode.ExtractLights(data, seconds)
+	if err != nil {
+		fmt.Printf("Could not render the lights of '%s': %s\n", fname, err)
+		return false
+	}
+	if len(output) == 0 {
+		if fname == stdinName {
+			fmt.Println("Use --output to say where to write the lights of a creation read from stdin")
+			return false
+		}
+		extension := ".gif"
+		if sheet {
+			extension = ".png"
+		}
+		output = strings.TrimSuffix(fname, ".kcode") + extension
+	}
+	var buf bytes.Buffer
+	if sheet {
+		err = anim.WriteSpriteSheet(&buf, scale)
+	} else {
+		err = anim.WriteGIF(&buf, scale)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(output, buf.Bytes(), 0644)
+	}
+	if err != nil {
+		fmt.Printf("Could not write '%s': %s\n", output, err)
+		return false
+	}
+	fmt.Printf("%s: wrote %d frames lasting %ss to %s\n", fname, len(anim.Frames), strconv.FormatFloat(seconds, 'f', -1, 64), output)
+	return true
+}
+
+// fileFields are the typed field records of one file as printed by fields --json
+type fileFields struct {
+	File   string              `json:"file"`
+	Fields []kcode.FieldRecord `json:"fields"`
+}
+
+// fieldsFile returns the typed value of every field in a creation, printing them unless they are wanted as JSON
+func fieldsFile(fname string, data []byte, asJSON bool) fileFields {
+	records, err := kcode.ExtractFields(data)
+	if err != nil {
+		fmt.Printf("Could not parse '%s': %s\n", fname, err)
+		return fileFields{File: fname, Fields: []kcode.FieldRecord{}}
+	}
+	if !asJSON {
+		for _, r := range records {
+			fmt.Printf("%s\t%s\t%s\t%s\t%s\t%v\n", fname, r.BlockId, r.BlockType, r.Field, r.Kind, r.Value)
 		}
 	}
+	return fileFields{File: fname, Fields: records}
+}
+
+func dumpLint(files []kcode.FileIssues) {
+	for _, file := range files {
+		for _, issue := range file.Issues {
+			fmt.Printf("%s: %s: %s\n", file.File, kcode.RuleFor(issue.Kind).Level, issue)
+		}
+	}
+}
+
+func validateDirectory(dir string, verbose bool) []*kcode.ValidationReport {
+	reports := make([]*kcode.ValidationReport, 0)
+	eachKcodeFile(dir, func(fname string, data []byte) {
+		report := cache.Validate(data, verbose)
+		report.File = fname
+		reports = append(reports, report)
+	})
+	return reports
 }
 
 // ---------- opts handling  ----------
 
-func procOpts(opts *docopt.Opts) {
+// Exit codes
+const (
+	exitValid   = 0 // everything validated (or the command succeeded)
+	exitInvalid = 1 // at least one file failed validation
+	exitError   = 2 // the command could not run e.g. missing file or bad option
+)
+
+// procOpts runs the command and returns the process exit code
+func procOpts(opts *docopt.Opts) (code int) {
+	// kcode panics on hard errors such as unreadable files
+	defer func() {
+		if r := recover(); r != nil {
+			if entry, ok := r.(*log.Entry); ok {
+				fmt.Printf("ERROR: %s\n", entry.Message)
+			} else {
+				fmt.Printf("ERROR: %v\n", r)
+			}
+			code = exitError
+		}
+	}()
 	//opts, _ := docopt.ParseDoc(usage)
 	//fmt.Println(typeof(opts))
 	//fmt.Println(opts)
 	var conf struct {
-		Blocks   bool   `docopt:"blocks"`
-		Spells   bool   `docopt:"spells"`
-		Parts    bool   `docopt:"parts"`
-		Scene    bool   `docopt:"scene"`
-		Validate bool   `docopt:"validate"`
-		File     string `docopt:"<file>"`
-		Verbose  bool   `docopt:"--verbose"`
+		Blocks      bool   `docopt:"blocks"`
+		Spells      bool   `docopt:"spells"`
+		Parts       bool   `docopt:"parts"`
+		Scene       bool   `docopt:"scene"`
+		Validate    bool   `docopt:"validate"`
+		Lint        bool   `docopt:"lint"`
+		Query       bool   `docopt:"query"`
+		Variables   bool   `docopt:"variables"`
+		Comments    bool   `docopt:"comments"`
+		CallGraph   bool   `docopt:"callgraph"`
+		Fields      bool   `docopt:"fields"`
+		Handlers    bool   `docopt:"handlers"`
+		Trace       bool   `docopt:"trace"`
+		Simplify    bool   `docopt:"simplify"`
+		Metrics     bool   `docopt:"metrics"`
+		Kits        bool   `docopt:"kits"`
+		Lights      bool   `docopt:"lights"`
+		Sheet       bool   `docopt:"--sheet"`
+		Duration    string `docopt:"--duration"`
+		Scale       string `docopt:"--scale"`
+		DryRun      bool   `docopt:"--dry-run"`
+		Output      string `docopt:"--output"`
+		Selector    string `docopt:"<selector>"`
+		Fingerprint bool   `docopt:"fingerprint"`
+		Index       bool   `docopt:"index"`
+		Uses        bool   `docopt:"uses"`
+		Kind        string `docopt:"<kind>"`
+		Name        string `docopt:"<name>"`
+		IndexFile   string `docopt:"--index"`
+		CacheDir    string `docopt:"--cache"`
+		File        string `docopt:"<file>"`
+		Scenes      string `docopt:"--scenes"`
+		SpellFile   string `docopt:"--spells"`
+		Defs        string `docopt:"--blocks"`
+		KitFile     string `docopt:"--kits"`
+		Costs       string `docopt:"--costs"`
+		MaxDuration string `docopt:"--max-duration"`
+		JSON        bool   `docopt:"--json"`
+		JUnit       string `docopt:"--junit"`
+		SARIF       string `docopt:"--sarif"`
+		Verbose     bool   `docopt:"--verbose"`
 	}
 	opts.Bind(&conf)
 
 	fname := conf.File
 	verbose := conf.Verbose
 
+	if len(conf.Scenes) > 0 {
+		catalogue, err := kcode.LoadSceneCatalogue(conf.Scenes)
+		if err != nil {
+			fmt.Printf("Could not load scene catalogue '%s': %s\n", conf.Scenes, err)
+			return exitError
+		}
+		kcode.SetSceneCatalogue(catalogue)
+	}
+	if len(conf.SpellFile) > 0 {
+		catalogue, err := kcode.LoadSpellCatalogue(conf.SpellFile)
+		if err != nil {
+			fmt.Printf("Could not load spell catalogue '%s': %s\n", conf.SpellFile, err)
+			return exitError
+		}
+		kcode.SetSpellCatalogue(catalogue)
+	}
+	if len(conf.Defs) > 0 {
+		registry := kcode.DefaultBlockRegistry()
+		if err := registry.AddDefinitions(kcode.ReadFile(conf.Defs)); err != nil {
+			fmt.Printf("Could not load block definitions '%s': %s\n", conf.Defs, err)
+			return exitError
+		}
+		kcode.SetBlockRegistry(registry)
+	}
+
+	if len(conf.KitFile) > 0 {
+		catalogue, err := kcode.LoadKitCatalogue(conf.KitFile)
+		if err != nil {
+			fmt.Printf("Could not load kit catalogue '%s': %s\n", conf.KitFile, err)
+			return exitError
+		}
+		kcode.SetKitCatalogue(catalogue)
+	}
+	if len(conf.Costs) > 0 || len(conf.MaxDuration) > 0 {
+		table := kcode.DefaultCostTable()
+		if len(conf.Costs) > 0 {
+			var err error
+			if table, err = kcode.LoadCostTable(conf.Costs); err != nil {
+				fmt.Printf("Could not load cost table '%s': %s\n", conf.Costs, err)
+				return exitError
+			}
+		}
+		if len(conf.MaxDuration) > 0 {
+			seconds, err := strconv.ParseFloat(conf.MaxDuration, 64)
+			if err != nil || seconds < 0 {
+				fmt.Printf("Could not use --max-duration '%s': not a number of seconds\n", conf.MaxDuration)
+				return exitError
+			}
+			table.MaxHandlerSeconds = seconds
+		}
+		kcode.SetCostTable(table)
+	}
+
+	if len(conf.CacheDir) > 0 {
+		var err error
+		if cache, err = kcode.OpenCache(conf.CacheDir); err != nil {
+			fmt.Printf("Could not open cache '%s': %s\n", conf.CacheDir, err)
+			return exitError
+		}
+	}
+
+	if len(fname) > 0 && conf.CallGraph {
+		// DOT goes to stdout on its own so that it can be piped straight into Graphviz
+		kcode.InitLogging(verbose)
+		if isDirectory(fname) {
+			fmt.Printf("Can only draw the call graph of a single .kcode file, not '%s'\n", fname)
+			return exitError
+		}
+		prog, err := cache.Program(readInput(fname))
+		if err != nil {
+			fmt.Printf("Could not parse '%s': %s\n", fname, err)
+			return exitError
+		}
+		if err := kcode.BuildCallGraph(prog).WriteDOT(os.Stdout); err != nil {
+			fmt.Printf("Could not write call graph: %s\n", err)
+			return exitError
+		}
+		return exitValid
+	}
 	if len(fname) > 0 {
 		kcode.InitLogging(verbose)
 		start := time.Now()
@@ -97,62 +609,304 @@ func procOpts(opts *docopt.Opts) {
 			// Note there is no ternary operator in Go:
 			// https://stackoverflow.com/questions/19979178/what-is-the-idiomatic-go-equivalent-of-cs-ternary-operator
 			flags := kcode.KCodeFlags{Spells: false, Blocks: true, Parts: false, Scene: false}
-			if kcode.IsDirectory(fname) { // The file passed in is a directory
+			if isDirectory(fname) { // The file passed in is a directory
 				fmt.Println(fmt.Sprintf("Extracting 'blocks' from all .kcode files in target directory '%s'...", fname))
 				processDirectory(fname, flags, verbose)
 			} else {
 				fmt.Println(fmt.Sprintf("Extracting 'blocks' in target .kcode file '%s'...", fname))
-				_, blocks, _, _ := kcode.ProcessKcodeFile(fname, flags, verbose)
+				_, blocks, _, _ := kcode.ProcessKcodeFileString(readInput(fname), flags, verbose)
 				dumpBlocks(blocks)
 			}
 		} else if conf.Spells {
 			flags := kcode.KCodeFlags{Spells: true, Blocks: false, Parts: false, Scene: false}
-			if kcode.IsDirectory(fname) { // The file passed in is a directory
+			if isDirectory(fname) { // The file passed in is a directory
 				fmt.Println(fmt.Sprintf("Seeking 'spells' in target directory '%s'...", fname))
 				processDirectory(fname, flags, verbose)
 			} else {
 				fmt.Println(fmt.Sprintf("Seeking 'spells' in .kcode file '%s'...", fname))
-				spells, _, _, _ := kcode.ProcessKcodeFile(fname, flags, verbose)
+				spells, _, _, _ := kcode.ProcessKcodeFileString(readInput(fname), flags, verbose)
 				dumpSpells(spells)
+				dumpSpellIssues(spells)
 			}
 		} else if conf.Parts {
 			flags := kcode.KCodeFlags{Spells: false, Blocks: false, Parts: true, Scene: false}
-			if kcode.IsDirectory(fname) { // The file passed in is a directory
+			if isDirectory(fname) { // The file passed in is a directory
 				fmt.Println(fmt.Sprintf("Seeking 'parts' in target directory '%s'...", fname))
 				processDirectory(fname, flags, verbose)
 			} else {
 				fmt.Println(fmt.Sprintf("Seeking 'parts' in .kcode file '%s'...", fname))
-				_, _, parts, _ := kcode.ProcessKcodeFile(fname, flags, verbose)
+				_, _, parts, _ := kcode.ProcessKcodeFileString(readInput(fname), flags, verbose)
 				dumpParts(parts)
 			}
 		} else if conf.Scene {
 			flags := kcode.KCodeFlags{Spells: false, Blocks: false, Parts: false, Scene: true}
-			if kcode.IsDirectory(fname) { // The file passed in is a directory
+			if isDirectory(fname) { // The file passed in is a directory
 				fmt.Println(fmt.Sprintf("Seeking 'scene' in target directory '%s'...", fname))
 				processDirectory(fname, flags, verbose)
 			} else {
 				fmt.Println(fmt.Sprintf("Seeking 'scene' in .kcode file '%s'...", fname))
-				_, _, _, scene := kcode.ProcessKcodeFile(fname, flags, verbose)
+				data := readInput(fname)
+				_, _, _, scene := kcode.ProcessKcodeFileString(data, flags, verbose)
 				fmt.Printf("%s\n", scene)
+				dumpSceneIssues(fname, data)
 			}
 		} else if conf.Validate {
-			if kcode.IsDirectory(fname) { // The file passed in is a directory
-				fmt.Println(fmt.Sprintf("Validating .kcode files in target directory '%s'...", fname))
-				validateDirectory(fname, verbose)
-			} else {
-				fmt.Println(fmt.Sprintf("Validating .kcode file '%s'...", fname))
-				expectedSpells, foundSpells, expectedBlocks, foundBlocks,
-					expectedParts, foundParts, expectedScene, foundScene, valid := kcode.ValidateFile(fname, verbose)
-				if valid {
-					fmt.Printf("SUCCEEDED in validating '%s'.\nExpected %d spells and found %d\n", fname, expectedSpells, foundSpells)
-					fmt.Printf("Expected %d blocks and found %d\n", expectedBlocks, foundBlocks)
-					fmt.Printf("Expected %d parts and found %d\nExpected scence len %d and found len %d\n",
-						expectedParts, foundParts, expectedScene, foundScene)
-				} else {
-					fmt.Printf("FAILED to validate '%s'.\nExpected %d spells and found %d.\nExpected %d blocks and found %d\n",
-						fname, expectedSpells, foundSpells, expectedBlocks, foundBlocks)
-					fmt.Printf("Expected %d parts and found %d.\nExpected scence len %d and found len %d\n",
-						expectedParts, foundParts, expectedScene, foundScene)
+			var reports []*kcode.ValidationReport
+			if isDirectory(fname) { // The file passed in is a directory
+				if !conf.JSON {
+					fmt.Println(fmt.Sprintf("Validating .kcode files in target directory '%s'...", fname))
+				}
+				reports = validateDirectory(fname, verbose)
+			} else {
+				if !conf.JSON {
+					fmt.Println(fmt.Sprintf("Validating .kcode file '%s'...", fname))
+				}
+				report := cache.Validate(readInput(fname), verbose)
+				report.File = fname
+				reports = []*kcode.ValidationReport{report}
+			}
+			dumpReports(reports, conf.JSON)
+			if len(conf.JUnit) > 0 {
+				if err := writeJUnit(conf.JUnit, reports); err != nil {
+					fmt.Printf("Could not write JUnit report '%s': %s\n", conf.JUnit, err)
+					return exitError
+				}
+			}
+			if len(conf.SARIF) > 0 {
+				files := make([]kcode.FileIssues, 0, len(reports))
+				for _, report := range reports {
+					files = append(files, report.FileIssues())
+				}
+				if err := writeSARIF(conf.SARIF, files); err != nil {
+					fmt.Printf("Could not write SARIF log '%s': %s\n", conf.SARIF, err)
+					return exitError
+				}
+			}
+			for _, report := range reports {
+				if !report.Valid {
+					code = exitInvalid
+				}
+			}
+			if conf.JSON {
+				return code
+			}
+		} else if conf.Lint {
+			var files []kcode.FileIssues
+			if isDirectory(fname) { // The file passed in is a directory
+				fmt.Println(fmt.Sprintf("Linting .kcode files in target directory '%s'...", fname))
+				files = lintDirectory(fname)
+			} else {
+				fmt.Println(fmt.Sprintf("Linting .kcode file '%s'...", fname))
+				files = []kcode.FileIssues{lintFile(fname, readInput(fname))}
+			}
+			dumpLint(files)
+			if len(conf.SARIF) > 0 {
+				if err := writeSARIF(conf.SARIF, files); err != nil {
+					fmt.Printf("Could not write SARIF log '%s': %s\n", conf.SARIF, err)
+					return exitError
+				}
+			}
+			for _, file := range files {
+				if len(file.Issues) > 0 {
+					code = exitInvalid
+				}
+			}
+		} else if conf.Query {
+			selector, err := kcode.ParseSelector(conf.Selector)
+			if err != nil {
+				fmt.Println(err)
+				return exitError
+			}
+			matches := 0
+			if isDirectory(fname) { // The file passed in is a directory
+				fmt.Println(fmt.Sprintf("Querying .kcode files in target directory '%s'...", fname))
+				eachKcodeFile(fname, func(f string, data []byte) {
+					matches += queryFile(f, data, selector)
+				})
+			} else {
+				fmt.Println(fmt.Sprintf("Querying .kcode file '%s'...", fname))
+				matches = queryFile(fname, readInput(fname), selector)
+			}
+			if matches == 0 {
+				code = exitInvalid
+			}
+		} else if conf.Variables {
+			issues := 0
+			if isDirectory(fname) { // The file passed in is a directory
+				fmt.Println(fmt.Sprintf("Seeking 'variables' in target directory '%s'...", fname))
+				eachKcodeFile(fname, func(f string, data []byte) {
+					issues += variablesFile(f, data)
+				})
+			} else {
+				fmt.Println(fmt.Sprintf("Seeking 'variables' in .kcode file '%s'...", fname))
+				issues = variablesFile(fname, readInput(fname))
+			}
+			if issues > 0 {
+				code = exitInvalid
+			}
+		} else if conf.Handlers {
+			if isDirectory(fname) { // The file passed in is a directory
+				fmt.Println(fmt.Sprintf("Seeking 'handlers' in target directory '%s'...", fname))
+				eachKcodeFile(fname, handlersFile)
+			} else {
+				fmt.Println(fmt.Sprintf("Seeking 'handlers' in .kcode file '%s'...", fname))
+				handlersFile(fname, readInput(fname))
+			}
+		} else if conf.Simplify {
+			ok := true
+			if isDirectory(fname) { // The file passed in is a directory
+				if len(conf.Output) > 0 {
+					fmt.Println("--output can only be used with a single file")
+					return exitError
+				}
+				fmt.Println(fmt.Sprintf("Seeking 'simplify' in target directory '%s'...", fname))
+				eachKcodeFile(fname, func(f string, data []byte) {
+					ok = simplifyFile(f, data, conf.DryRun, "") && ok
+				})
+			} else {
+				fmt.Println(fmt.Sprintf("Seeking 'simplify' in .kcode file '%s'...", fname))
+				ok = simplifyFile(fname, readInput(fname), conf.DryRun, conf.Output)
+			}
+			if !ok {
+				code = exitError
+			}
+		} else if conf.Trace {
+			if isDirectory(fname) { // The file passed in is a directory
+				fmt.Println(fmt.Sprintf("Seeking 'trace' in target directory '%s'...", fname))
+				eachKcodeFile(fname, traceFile)
+			} else {
+				fmt.Println(fmt.Sprintf("Seeking 'trace' in .kcode file '%s'...", fname))
+				traceFile(fname, readInput(fname))
+			}
+		} else if conf.Kits {
+			issues := 0
+			if isDirectory(fname) { // The file passed in is a directory
+				fmt.Println(fmt.Sprintf("Seeking 'kits' in target directory '%s'...", fname))
+				eachKcodeFile(fname, func(f string, data []byte) {
+					issues += kitsFile(f, data, verbose)
+				})
+			} else {
+				fmt.Println(fmt.Sprintf("Seeking 'kits' in .kcode file '%s'...", fname))
+				issues = kitsFile(fname, readInput(fname), verbose)
+			}
+			if issues > 0 {
+				code = exitInvalid
+			}
+		} else if conf.Lights {
+			if isDirectory(fname) {
+				fmt.Printf("Can only render the lights of a single .kcode file, not '%s'\n", fname)
+				return exitError
+			}
+			seconds, err := strconv.ParseFloat(conf.Duration, 64)
+			if err != nil || seconds <= 0 {
+				fmt.Printf("Could not use --duration '%s': not a number of seconds\n", conf.Duration)
+				return exitError
+			}
+			scale, err := strconv.Atoi(conf.Scale)
+			if err != nil || scale < 1 {
+				fmt.Printf("Could not use --scale '%s': not a number of pixels\n", conf.Scale)
+				return exitError
+			}
+			fmt.Println(fmt.Sprintf("Rendering lights of .kcode file '%s'...", fname))
+			if !lightsFile(fname, readInput(fname), conf.Output, conf.Sheet, seconds, scale) {
+				code = exitError
+			}
+		} else if conf.Metrics {
+			files := make([]fileMetrics, 0)
+			if isDirectory(fname) { // The file passed in is a directory
+				if !conf.JSON {
+					fmt.Println(fmt.Sprintf("Seeking 'metrics' in target directory '%s'...", fname))
+				}
+				eachKcodeFile(fname, func(f string, data []byte) {
+					files = append(files, metricsFile(f, data, conf.JSON))
+				})
+			} else {
+				if !conf.JSON {
+					fmt.Println(fmt.Sprintf("Seeking 'metrics' in .kcode file '%s'...", fname))
+				}
+				files = append(files, metricsFile(fname, readInput(fname), conf.JSON))
+			}
+			for _, f := range files {
+				if f.Slow > 0 {
+					code = exitInvalid
+				}
+			}
+			if conf.JSON {
+				encoded, _ := json.MarshalIndent(files, "", "  ")
+				fmt.Println(string(encoded))
+				return code
+			}
+		} else if conf.Fields {
+			files := make([]fileFields, 0)
+			if isDirectory(fname) { // The file passed in is a directory
+				if !conf.JSON {
+					fmt.Println(fmt.Sprintf("Seeking 'fields' in target directory '%s'...", fname))
+				}
+				eachKcodeFile(fname, func(f string, data []byte) {
+					files = append(files, fieldsFile(f, data, conf.JSON))
+				})
+			} else {
+				if !conf.JSON {
+					fmt.Println(fmt.Sprintf("Seeking 'fields' in .kcode file '%s'...", fname))
+				}
+				files = append(files, fieldsFile(fname, readInput(fname), conf.JSON))
+			}
+			if conf.JSON {
+				encoded, _ := json.MarshalIndent(files, "", "  ")
+				fmt.Println(string(encoded))
+				return code
+			}
+		} else if conf.Comments {
+			if isDirectory(fname) { // The file passed in is a directory
+				fmt.Println(fmt.Sprintf("Seeking 'comments' in target directory '%s'...", fname))
+				eachKcodeFile(fname, commentsFile)
+			} else {
+				fmt.Println(fmt.Sprintf("Seeking 'comments' in .kcode file '%s'...", fname))
+				commentsFile(fname, readInput(fname))
+			}
+		} else if conf.Fingerprint {
+			fingerprints := make(map[string]string)
+			fingerprint := func(f string, data []byte) {
+				prog, err := cache.Program(data)
+				if err != nil {
+					fmt.Printf("Could not parse '%s': %s\n", f, err)
+					return
+				}
+				fingerprints[f] = kcode.Fingerprint(prog)
+			}
+			if isDirectory(fname) { // The file passed in is a directory
+				fmt.Println(fmt.Sprintf("Fingerprinting .kcode files in target directory '%s'...", fname))
+				eachKcodeFile(fname, fingerprint)
+			} else {
+				fmt.Println(fmt.Sprintf("Fingerprinting .kcode file '%s'...", fname))
+				fingerprint(fname, readInput(fname))
+			}
+			dumpFingerprints(fingerprints)
+		} else if conf.Index || conf.Uses {
+			if !isDirectory(fname) {
+				fmt.Printf("Can only index a directory or archive, not '%s'\n", fname)
+				return exitError
+			}
+			if conf.Uses {
+				if err := kcode.CheckIndexKind(conf.Kind); err != nil {
+					fmt.Println(err)
+					return exitError
+				}
+			}
+			ix, stats, err := updateIndex(conf.IndexFile, fname)
+			if err != nil {
+				fmt.Printf("Could not update index '%s': %s\n", conf.IndexFile, err)
+				return exitError
+			}
+			if conf.Index {
+				fmt.Printf("Indexed '%s' in '%s': %d added, %d updated, %d removed, %d unchanged\n",
+					fname, conf.IndexFile, stats.Added, stats.Updated, stats.Removed, stats.Unchanged)
+			} else {
+				fmt.Println(fmt.Sprintf("Seeking %s '%s' in target directory '%s'...", conf.Kind, conf.Name, fname))
+				occurrences := ix.Lookup(conf.Kind, conf.Name)
+				dumpOccurrences(occurrences)
+				if len(occurrences) == 0 {
+					code = exitInvalid
 				}
 			}
 		} else {
@@ -163,34 +917,132 @@ func procOpts(opts *docopt.Opts) {
 		fmt.Printf("========== FINISHED ===========\nElapsed time = %s", elapsed)
 	} else {
 		fmt.Println("No file passed in")
+		return exitError
 	}
+	return code
 }
 
 // ---------- main  ----------
 
-func main() {
-	usage := `KCode parser
+// usage is the docopt description of the command line
+const usage = `KCode parser
 ------------
 Usage:
   kcodecli blocks <file> [--verbose]
-  kcodecli spells <file> [--verbose]
+  kcodecli spells <file> [--spells=<catalogue>] [--verbose]
   kcodecli parts <file> [--verbose] 
-  kcodecli scene <file> [--verbose] 
-  kcodecli validate <file> [--verbose]
+  kcodecli scene <file> [--scenes=<catalogue>] [--verbose]
+  kcodecli validate <file> [--scenes=<catalogue>] [--spells=<catalogue>] [--blocks=<defs>] [--kits=<catalogue>] [--json] [--junit=<report>] [--sarif=<log>] [--cache=<dir>] [--verbose]
+  kcodecli lint <file> [--scenes=<catalogue>] [--spells=<catalogue>] [--blocks=<defs>] [--kits=<catalogue>] [--costs=<table>] [--max-duration=<seconds>] [--sarif=<log>] [--cache=<dir>] [--verbose]
+  kcodecli query <selector> <file> [--cache=<dir>] [--verbose]
+  kcodecli variables <file> [--cache=<dir>] [--verbose]
+  kcodecli comments <file> [--verbose]
+  kcodecli callgraph <file> [--cache=<dir>] [--verbose]
+  kcodecli fields <file> [--json] [--verbose]
+  kcodecli handlers <file> [--verbose]
+  kcodecli trace <file> [--verbose]
+  kcodecli simplify <file> [--dry-run] [--output=<path>] [--verbose]
+  kcodecli metrics <file> [--costs=<table>] [--max-duration=<seconds>] [--json] [--cache=<dir>] [--verbose]
+  kcodecli kits <file> [--kits=<catalogue>] [--cache=<dir>] [--verbose]
+  kcodecli lights <file> [--output=<path>] [--sheet] [--duration=<seconds>] [--scale=<pixels>] [--verbose]
+  kcodecli fingerprint <file> [--cache=<dir>] [--verbose]
+  kcodecli index <file> [--index=<path>] [--verbose]
+  kcodecli uses <kind> <name> <file> [--index=<path>] [--verbose]
   kcodecli --help | --version
 
+Arguments:
+  <file>    A .kcode file, a directory of them or a .zip or .tar.gz archive of them.
+            Use - to read a single .kcode file from stdin.
+  <selector>  Blocks to find e.g. 'events_onGesture[TYPE=engorgio] objects_scale'.
+            See pkg/kcode/query.go for the syntax.
+  <kind>    What uses looks for: block, spell, part or scene.
+
 Options:
   --help    	Show this screen.
   --version     Show version.
+  --scenes=<catalogue>  Scene catalogue JSON file to use instead of the built in one.
+  --spells=<catalogue>  Spell catalogue JSON file to use instead of the built in one.
+  --blocks=<defs>       Blockly JSON block definitions to add to the built in block registry.
+  --kits=<catalogue>    Kit catalogue JSON file to use instead of the built in one.
+  --costs=<table>       Cost table JSON file to use instead of the built in one.
+  --max-duration=<seconds>  Flag handlers that take longer than this, 0 for none, instead of the limit in the cost table.
+  --json                Print the validation report, fields or metrics as JSON.
+  --junit=<report>      Also write the validation results to a JUnit XML file.
+  --sarif=<log>         Also write the findings to a SARIF 2.1.0 log file.
+  --cache=<dir>         Cache results in a directory so unchanged files are not parsed again.
+  --dry-run             Show what simplify would change as a diff without writing anything.
+  --output=<path>       Where simplify writes a single simplified file instead of over the original,
+                        or where lights writes its animation instead of next to the file.
+  --sheet               Write the lights as a PNG sprite sheet with the frames from left to right instead of a GIF.
+  --duration=<seconds>  How many seconds of lights to render [default: 10].
+  --scale=<pixels>      Size in pixels of each light in the rendered image [default: 10].
+  --index=<path>        Index file that index and uses keep up to date [default: .kcodeindex.json].
+
+Exit codes:
+  0  All files are valid.
+  1  At least one file failed validation, has lint or variable findings, slow handlers or mixed kits, or a query or uses found nothing.
+  2  Error e.g. file not found.
 
 Examples:
   1. Find spells in 'mycreation.kcode':
   kcodecli spells mycreation.kcode
   2. Find spells in 'spelldir' directory:
   kcodecli spells -d spelldir
+  3. Validate the creations in a zip or tar.gz export without extracting it:
+  kcodecli validate exports.zip
+  4. Find blocks in one creation inside an archive:
+  kcodecli blocks exports.tar.gz/challenges/001_colovaria.kcode
+  5. Find spells in a creation piped to stdin:
+  curl -s https://example.com/mycreation.kcode | kcodecli spells -
+  6. Find the challenges that use the wand_vibrate block:
+  kcodecli uses block wand_vibrate challenges
+  7. List the variables in a creation with the blocks that read and write them:
+  kcodecli variables challenges/059_flowers.kcode
+  8. Read the comments students left on their blocks:
+  kcodecli comments submissions.zip
+  9. Draw the call graph from the event handlers to the procedures of a creation:
+  kcodecli callgraph mycreation.kcode | dot -Tpng -o callgraph.png
+  10. List the colours, numbers, objects and other values chosen in a creation:
+  kcodecli fields challenges/001_colovaria.kcode
+  11. List what each spell in a creation does:
+  kcodecli handlers challenges/022_pumpkins.kcode
+  12. Step through each spell in a creation in the order the blocks run:
+  kcodecli trace challenges/022_pumpkins.kcode
+  13. See what simplifying the tutorial starter files would change:
+  kcodecli simplify starters --dry-run
+  14. See how long the effect of each spell in a creation lasts:
+  kcodecli metrics challenges/005_fireworks.kcode
+  15. Find out which kit each creation in a gallery export is for:
+  kcodecli kits gallery.zip
+  16. Preview the first 5 seconds of a Pixel Kit creation as a sprite sheet:
+  kcodecli lights rainbow.kcode --sheet --duration=5
 `
-	// Process error handling
-	version := "1.0"
-	opts, _ := docopt.ParseArgs(usage, os.Args[1:], version)
-	procOpts(&opts)
+
+const version = "1.0"
+
+// parseArgs parses the command line.  done is true when there is nothing to run, either
+// because --help or --version was given or because the command line is not valid, and
+// code is then the exit code.  docopt on its own exits with 1 on a bad command line,
+// which would look like a file that failed validation.
+func parseArgs(argv []string) (opts docopt.Opts, code int, done bool) {
+	parser := &docopt.Parser{HelpHandler: func(err error, usage string) {
+		done = true
+		if err != nil {
+			fmt.Fprintln(os.Stderr, usage)
+			code = exitError
+		} else {
+			fmt.Println(usage)
+			code = exitValid
+		}
+	}}
+	opts, _ = parser.ParseArgs(usage, argv, version)
+	return opts, code, done
+}
+
+func main() {
+	opts, code, done := parseArgs(os.Args[1:])
+	if done {
+		os.Exit(code)
+	}
+	os.Exit(procOpts(&opts))
 }
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseArgs(t *testing.T) {
+	opts, _, done := parseArgs([]string{"validate", "x.kcode", "--json"})
+	assert.False(t, done)
+	assert.Equal(t, true, opts["validate"])
+	assert.Equal(t, "x.kcode", opts["<file>"])
+	// A typo is not a file that failed validation
+	_, code, done := parseArgs([]string{"validate", "x.kcode", "--bogus"})
+	assert.True(t, done)
+	assert.Equal(t, exitError, code)
+	_, code, done = parseArgs([]string{"nonsense"})
+	assert.True(t, done)
+	assert.Equal(t, exitError, code)
+	_, code, done = parseArgs([]string{"--version"})
+	assert.True(t, done)
+	assert.Equal(t, exitValid, code)
+	_, code, done = parseArgs([]string{"--help"})
+	assert.True(t, done)
+	assert.Equal(t, exitValid, code)
+}
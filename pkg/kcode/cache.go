@@ -0,0 +1,235 @@
+package kcode
+
+// cache.go
+// --------
+// Description:
+// On-disk cache of parse and analysis results keyed by the SHA-256 of the file contents.
+// Running validate or lint again over files that have not changed reads the results
+// back rather than parsing anything.  Entries live under a directory named after
+// cacheVersion, which is bumped whenever the parser or the analyses change what they
+// return, and OpenCache removes the directories of other versions.  A test hashes what
+// gets cached for the challenges and fails when that changes without a new cacheVersion.
+// Lint, validation, metrics and kit results also depend on the scene, spell and kit
+// catalogues, block registry and cost table in use, so these are part of the key for
+// them.  Their hash is worked out once and again only after one of them is replaced or
+// AddDefinitions adds to a registry.  A catalogue or cost table changed in place by
+// setting its fields must be passed to its Set function again.
+// A nil *Cache is valid and caches nothing.
+//
+// API:
+// OpenCache(dir string) (*Cache, error)
+// (c *Cache) Program(data []byte) (*Program, error)
+// (c *Cache) Validate(data []byte, verbose bool) *ValidationReport
+// (c *Cache) Lint(data []byte) ([]Issue, error)
+// (c *Cache) Metrics(data []byte) (Metrics, error)
+// (c *Cache) Kits(data []byte) (KitReport, error)
+// (c *Cache) Get(kind string, data []byte, v interface{}) bool
+// (c *Cache) Put(kind string, data []byte, v interface{}) error
+// (c *Cache) Clear() error
+//
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// cacheVersion is bumped whenever a change to kcode changes what gets cached, see TestCachedOutputs
+const cacheVersion = 10
+
+// currentConfigHash is the configHash of the catalogues in use, empty until it is worked out
+var currentConfigHash string
+
+// Cache is a directory of cached results
+type Cache struct {
+	dir    string
+	Hits   int
+	Misses int
+}
+
+// OpenCache opens the cache in a directory, creating it if needed
+func OpenCache(dir string) (*Cache, error) {
+	c := &Cache{dir: dir}
+	if err := os.MkdirAll(c.versionDir(), 0755); err != nil {
+		return nil, err
+	}
+	// Drop entries written by other versions
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), "v") && filepath.Join(dir, entry.Name()) != c.versionDir() {
+			if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return c, nil
+}
+
+// Program parses the kcode of a .kcode file into a Program, see ExtractProgram
+func (c *Cache) Program(data []byte) (*Program, error) {
+	var prog Program
+	if c.Get("program", data, &prog) {
+		return &prog, nil
+	}
+	p, err := ExtractProgram(data)
+	if err != nil {
+		return nil, err
+	}
+	c.Put("program", data, p)
+	return p, nil
+}
+
+// Validate validates .kcode data, see ValidateString.  The File of the report is left for the caller to set.
+func (c *Cache) Validate(data []byte, verbose bool) *ValidationReport {
+	var report ValidationReport
+	kind := "validate-" + configHash()
+	if c.Get(kind, data, &report) {
+		return &report
+	}
+	r := ValidateString(data, verbose)
+	c.Put(kind, data, r)
+	return r
+}
+
+// Lint lints .kcode data, see LintString.  Errors are not cached.
+func (c *Cache) Lint(data []byte) ([]Issue, error) {
+	var issues []Issue
+	kind := "lint-" + configHash()
+	if c.Get(kind, data, &issues) {
+		return issues, nil
+	}
+	issues, err := LintString(data)
+	if err != nil {
+		return nil, err
+	}
+	c.Put(kind, data, issues)
+	return issues, nil
+}
+
+// Metrics works out the metrics of .kcode data, see ExtractMetrics.  Errors are not cached.
+func (c *Cache) Metrics(data []byte) (Metrics, error) {
+	var m Metrics
+	kind := "metrics-" + configHash()
+	if c.Get(kind, data, &m) {
+		return m, nil
+	}
+	m, err := ExtractMetrics(data)
+	if err != nil {
+		return m, err
+	}
+	c.Put(kind, data, m)
+	return m, nil
+}
+
+// Kits works out the kits used by .kcode data, see ExtractKits.  Errors are not cached.
+func (c *Cache) Kits(data []byte) (KitReport, error) {
+	var report KitReport
+	kind := "kits-" + configHash()
+	if c.Get(kind, data, &report) {
+		return report, nil
+	}
+	report, err := ExtractKits(data)
+	if err != nil {
+		return report, err
+	}
+	c.Put(kind, data, report)
+	return report, nil
+}
+
+// Get reads the cached result of kind for data into v and reports whether there was one
+func (c *Cache) Get(kind string, data []byte, v interface{}) bool {
+	if c == nil {
+		return false
+	}
+	cached, err := ioutil.ReadFile(c.path(kind, data))
+	if err == nil && json.Unmarshal(cached, v) == nil {
+		c.Hits++
+		return true
+	}
+	c.Misses++
+	return false
+}
+
+// Put caches v as the result of kind for data
+func (c *Cache) Put(kind string, data []byte, v interface{}) error {
+	if c == nil {
+		return nil
+	}
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	filename := c.path(kind, data)
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	// Write then rename so that concurrent runs never read half an entry
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), "tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(encoded); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// Clear removes every entry from the cache
+func (c *Cache) Clear() error {
+	if c == nil {
+		return nil
+	}
+	if err := os.RemoveAll(c.versionDir()); err != nil {
+		return err
+	}
+	return os.MkdirAll(c.versionDir(), 0755)
+}
+
+func (c *Cache) versionDir() string {
+	return filepath.Join(c.dir, fmt.Sprintf("v%d", cacheVersion))
+}
+
+// path is where the result of kind for data is kept, spread over subdirectories by hash
+func (c *Cache) path(kind string, data []byte) string {
+	hash := hashContents(data)
+	return filepath.Join(c.versionDir(), kind, hash[:2], hash+".json")
+}
+
+// configHash identifies the scene, spell and kit catalogues, block registry and cost table in use
+func configHash() string {
+	if len(currentConfigHash) > 0 {
+		return currentConfigHash
+	}
+	h := sha256.New()
+	scenes, _ := json.Marshal(sceneCatalogue)
+	h.Write(scenes)
+	spells, _ := json.Marshal(spellCatalogue)
+	h.Write(spells)
+	blocks, _ := json.Marshal(blockRegistry.types)
+	h.Write(blocks)
+	costs, _ := json.Marshal(costTable)
+	h.Write(costs)
+	kits, _ := json.Marshal(kitCatalogue)
+	h.Write(kits)
+	currentConfigHash = hex.EncodeToString(h.Sum(nil))[:16]
+	return currentConfigHash
+}
+
+// resetConfigHash makes configHash work the hash out again after the catalogues in use change
+func resetConfigHash() {
+	currentConfigHash = ""
+}
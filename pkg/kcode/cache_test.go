@@ -0,0 +1,183 @@
+package kcode
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCache(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	c, err := OpenCache(t.TempDir())
+	assert.Nil(t, err)
+	data := ReadFile("challenges/1022_pumpkins.kcode")
+
+	report := c.Validate(data, false)
+	cached := c.Validate(data, false)
+	assert.Equal(t, 1, c.Hits)
+	assert.Equal(t, report, cached)
+
+	issues, err := c.Lint(data)
+	assert.Nil(t, err)
+	cachedIssues, err := c.Lint(data)
+	assert.Nil(t, err)
+	assert.Equal(t, issues, cachedIssues)
+	assert.Equal(t, 2, c.Hits)
+
+	prog, err := c.Program(data)
+	assert.Nil(t, err)
+	cachedProg, err := c.Program(data)
+	assert.Nil(t, err)
+	assert.Equal(t, prog.Blocks, cachedProg.Blocks)
+	assert.True(t, cachedProg.Blocks[0].Input("CALLBACK").Block.Input("VALUE").Target().Shadow)
+	assert.Equal(t, 3, c.Hits)
+
+	// Results depend on the scene catalogue in use
+	catalogue, err := ParseSceneCatalogue([]byte(`{"bounds": {"width": 960, "height": 540}, "scenes": []}`))
+	assert.Nil(t, err)
+	SetSceneCatalogue(catalogue)
+	defer SetSceneCatalogue(nil)
+	issues, err = c.Lint(data)
+	assert.Nil(t, err)
+	assert.Equal(t, "unknown-scene", issues[0].Kind)
+	assert.Equal(t, 3, c.Hits)
+
+	m, err := c.Metrics(data)
+	assert.Nil(t, err)
+	cachedMetrics, err := c.Metrics(data)
+	assert.Nil(t, err)
+	assert.Equal(t, m, cachedMetrics)
+	kits, err := c.Kits(data)
+	assert.Nil(t, err)
+	cachedKits, err := c.Kits(data)
+	assert.Nil(t, err)
+	assert.Equal(t, kits, cachedKits)
+	assert.Equal(t, 5, c.Hits)
+	_, err = c.Kits([]byte(`not json`))
+	assert.NotNil(t, err)
+
+	assert.Nil(t, c.Clear())
+	c.Program(data)
+	assert.Equal(t, 5, c.Hits)
+}
+
+func TestCacheConfigHash(t *testing.T) {
+	hash := configHash()
+	assert.Equal(t, hash, currentConfigHash)
+	table := DefaultCostTable()
+	table.MaxHandlerSeconds = 1
+	SetCostTable(table)
+	defer SetCostTable(nil)
+	assert.NotEqual(t, hash, configHash())
+	SetCostTable(nil)
+	assert.Equal(t, hash, configHash())
+}
+
+func TestCachedPrograms(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	c, err := OpenCache(t.TempDir())
+	assert.Nil(t, err)
+	// Programs read back from the cache give the same results as freshly parsed ones
+	for _, f := range ListFilesInDirectory("challenges") {
+		data := ReadFile("challenges/" + f.Name())
+		prog, err := c.Program(data)
+		assert.Nil(t, err, f.Name())
+		cached, err := c.Program(data)
+		assert.Nil(t, err, f.Name())
+		assert.Equal(t, Fingerprint(prog), Fingerprint(cached), f.Name())
+		assert.Equal(t, AnalyzeVariables(prog), AnalyzeVariables(cached), f.Name())
+		assert.Equal(t, ComputeMetrics(prog), ComputeMetrics(cached), f.Name())
+	}
+}
+
+func TestCacheVersion(t *testing.T) {
+	dir := t.TempDir()
+	old := filepath.Join(dir, "v0", "program")
+	assert.Nil(t, os.MkdirAll(old, 0755))
+	_, err := OpenCache(dir)
+	assert.Nil(t, err)
+	_, err = os.Stat(old)
+	assert.True(t, os.IsNotExist(err))
+
+	var c *Cache
+	assert.False(t, c.Get("program", []byte("{}"), &Program{}))
+	assert.Nil(t, c.Put("program", []byte("{}"), &Program{}))
+}
+
+// cachedOutputsXML has what no challenge has: loops that never wait, busy handlers,
+// disabled procedures and calculations that fold or cannot be worked out
+const cachedOutputsXML = `<xml><block type="events_onAppStart" id="a"><statement name="CALLBACK">
+	<block type="procedures_callnoreturn" id="f"><mutation name="off"></mutation>
+	<next><block type="loops_forever" id="b"><statement name="DO"><block type="in_x_time" id="c"><field name="UNIT">seconds</field>
+	<value name="DELAY"><block type="math_number" id="d"><field name="NUM">1</field></block></value>
+	<statement name="DO"><block type="wait" id="e"><field name="UNIT">seconds</field>
+	<value name="DELAY"><block type="math_number" id="q"><field name="NUM">1</field></block></value></block></statement></block></statement>
+	</block></next></block></statement></block>
+	<block type="events_whileFlick" id="g"><field name="TYPE">up</field><statement name="CALLBACK">
+	<block type="every_x_seconds" id="h"><field name="UNIT">seconds</field>
+	<value name="INTERVAL"><block type="math_number" id="r"><field name="NUM">1</field></block></value></block></statement></block>
+	<block type="procedures_defnoreturn" id="i" disabled="true"><field name="NAME">off</field></block>
+	<block type="math_arithmetic" id="j"><field name="OP">DIVIDE</field>
+	<value name="A"><block type="math_number" id="k"><field name="NUM">1</field></block></value>
+	<value name="B"><block type="math_single" id="l"><field name="OP">ROOT</field>
+	<value name="NUM"><block type="math_number" id="m"><field name="NUM">-1</field></block></value></block></value></block>
+	<block type="math_arithmetic" id="n"><field name="OP">ADD</field>
+	<value name="A"><block type="math_number" id="o"><field name="NUM">1e999</field></block></value>
+	<value name="B"><block type="math_number" id="p"><field name="NUM">2</field></block></value></block></xml>`
+
+// cachedOutputs is cacheVersion along with the hash of what gets cached for the
+// challenges, the creations in the tests and a few broken files.  When TestCachedOutputs fails because the hash
+// changed, bump cacheVersion and update both.
+var cachedOutputs = struct {
+	Version int
+	Hash    string
+}{10, "2cf186b5e4a0bfa5ca83099aef0dacf2e62496e601f2d311bb220a9864de6281"}
+
+func TestCachedOutputs(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	inputs := [][]byte{[]byte(`not json`), []byte(`{}`), []byte(`{"source": "<xml><block"}`),
+		[]byte(`{"source": "<xml><block type=\"wand_vibrate\" id=\"a\"></block></xml>", "parts": [{"id": 3}]}`)}
+	for _, xml := range []string{cachedOutputsXML, variablesXML, proceduresXML, commentsXML, walkXML} {
+		data, _ := json.Marshal(map[string]interface{}{"source": xml, "parts": []string{}, "scene": "owlery"})
+		inputs = append(inputs, data)
+	}
+	for _, f := range ListFilesInDirectory("challenges") {
+		inputs = append(inputs, ReadFile("challenges/"+f.Name()))
+	}
+	h := sha256.New()
+	write := func(v interface{}, err error) {
+		encoded, _ := json.Marshal(v)
+		h.Write(encoded)
+		if err != nil {
+			h.Write([]byte(err.Error()))
+		}
+	}
+	for _, data := range inputs {
+		write(ExtractProgram(data))
+		write(ValidateString(data, false), nil)
+		write(LintString(data))
+		write(ExtractMetrics(data))
+		write(ExtractKits(data))
+	}
+	hash := hex.EncodeToString(h.Sum(nil))
+	assert.Equal(t, cachedOutputs, struct {
+		Version int
+		Hash    string
+	}{cacheVersion, hash}, "cached results changed so bump cacheVersion and update cachedOutputs")
+}
+
+func TestCacheAddDefinitions(t *testing.T) {
+	registry := DefaultBlockRegistry()
+	SetBlockRegistry(registry)
+	defer SetBlockRegistry(nil)
+	hash := configHash()
+	assert.Nil(t, registry.AddDefinitions([]byte(`[{"type": "my_block"}]`)))
+	assert.NotEqual(t, hash, configHash())
+}
@@ -0,0 +1,59 @@
+package kcode
+
+// comments.go
+// -----------
+// Description:
+// Comments that users attach to blocks, e.g. the notes students leave to explain their
+// creations.  Each comment is returned along with the block it is attached to.
+//
+// API:
+// Comments(prog *Program) []BlockComment
+// ExtractComments(jsdata []byte) ([]BlockComment, error)
+//
+
+import (
+	"strings"
+)
+
+// BlockComment is the comment on a block along with where the block is
+type BlockComment struct {
+	BlockId   string `json:"blockId"`
+	BlockType string `json:"blockType"`
+	Path      string `json:"path"`
+	Text      string `json:"text"`
+	Disabled  bool   `json:"disabled,omitempty"`
+}
+
+// Comments returns the comments in a program in document order.  Comments on disabled
+// blocks are included and flagged since they are still there for the reader.
+func Comments(prog *Program) []BlockComment {
+	comments := make([]BlockComment, 0)
+	disabled := make(map[*Block]bool)
+	Walk(prog, VisitorFunc(func(v Visit) bool {
+		off := v.Block.Disabled
+		for _, parent := range v.Parents {
+			off = off || disabled[parent]
+		}
+		disabled[v.Block] = off
+		if v.Block.Comment != nil {
+			comments = append(comments, BlockComment{
+				BlockId:   v.Block.Id,
+				BlockType: v.Block.Type,
+				Path:      v.Path,
+				Text:      strings.TrimSpace(v.Block.Comment.Text),
+				Disabled:  off,
+			})
+		}
+		return true
+	}))
+	return comments
+}
+
+// ExtractComments extracts the block comments from .kcode JSON
+func ExtractComments(jsdata []byte) ([]BlockComment, error) {
+	prog, err := ExtractProgram(jsdata)
+	if err != nil {
+		return nil, err
+	}
+	return Comments(prog), nil
+}
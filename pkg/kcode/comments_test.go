@@ -0,0 +1,107 @@
+package kcode
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+const commentsXML = `<xml><variables><variable type="" id="v1">count</variable></variables>
+	<block type="events_onAppStart" id="a" collapsed="true" deletable="false">
+	<comment pinned="true" h="80" w="160">Sets up the count</comment>
+	<statement name="CALLBACK">
+	<block type="controls_if" id="b" disabled="true">
+	<mutation elseif="1" else="1"></mutation>
+	<comment>  not finished yet  </comment>
+	<value name="IF0"><block type="variables_get" id="c"><field name="VAR" id="v1">count</field></block></value>
+	</block>
+	</statement>
+	</block></xml>`
+
+func TestComments(t *testing.T) {
+	prog, err := ParseProgram([]byte(commentsXML))
+	assert.Nil(t, err)
+	comments := Comments(prog)
+	assert.Equal(t, 2, len(comments))
+	assert.Equal(t, BlockComment{BlockId: "a", BlockType: "events_onAppStart", Path: "/block[1]", Text: "Sets up the count"}, comments[0])
+	assert.Equal(t, "not finished yet", comments[1].Text)
+	assert.True(t, comments[1].Disabled)
+	assert.True(t, prog.Blocks[0].Comment.Pinned)
+}
+
+func TestExtractComments(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	source, _ := json.Marshal(commentsXML)
+	jsdata := []byte(`{"source": ` + string(source) + `, "parts": [], "scene": "owlery"}`)
+	comments, err := ExtractComments(jsdata)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(comments))
+	// The parser is not thrown by comments and mutations
+	report := ValidateString(jsdata, false)
+	assert.True(t, report.Valid, report.String())
+	assert.Empty(t, report.Discrepancies)
+	_, err = ExtractComments([]byte(`not json`))
+	assert.NotNil(t, err)
+	comments, err = ExtractComments(ReadFile("challenges/001_colovaria.kcode"))
+	assert.Nil(t, err)
+	assert.Empty(t, comments)
+}
+
+func TestBlockAttributes(t *testing.T) {
+	prog, err := ParseProgram([]byte(commentsXML))
+	assert.Nil(t, err)
+	start := prog.Blocks[0]
+	assert.True(t, start.Collapsed)
+	assert.False(t, start.IsDeletable())
+	assert.False(t, start.Disabled)
+	ifBlock := start.Input("CALLBACK").Block
+	assert.True(t, ifBlock.Disabled)
+	assert.True(t, ifBlock.IsDeletable())
+	elseif, ok := ifBlock.Mutation.Attr("elseif")
+	assert.True(t, ok)
+	assert.Equal(t, "1", elseif)
+	_, ok = ifBlock.Mutation.Attr("missing")
+	assert.False(t, ok)
+	_, ok = start.Mutation.Attr("elseif")
+	assert.False(t, ok)
+
+	// The read of count is in a disabled block so count is unused
+	assert.Empty(t, AnalyzeVariables(prog)[0].Reads)
+	visited := make([]string, 0)
+	Walk(prog, SkipDisabled(VisitorFunc(func(v Visit) bool {
+		visited = append(visited, v.Block.Id)
+		return true
+	})))
+	assert.Equal(t, []string{"a"}, visited)
+
+	// The attributes survive a round trip
+	data, err := json.Marshal(prog)
+	assert.Nil(t, err)
+	var copied Program
+	assert.Nil(t, json.Unmarshal(data, &copied))
+	assert.Equal(t, Fingerprint(prog), Fingerprint(&copied))
+}
+
+func TestNormalizeAttributes(t *testing.T) {
+	prog, err := ParseProgram([]byte(commentsXML))
+	assert.Nil(t, err)
+	// Comments, collapsing and deletability are cosmetic
+	cosmetic := strings.NewReplacer(`collapsed="true" deletable="false"`, "", "Sets up the count", "Different note", `elseif="1" else="1"`, `else="1" elseif="1"`)
+	prog2, err := ParseProgram([]byte(cosmetic.Replace(commentsXML)))
+	assert.Nil(t, err)
+	assert.Equal(t, Fingerprint(prog), Fingerprint(prog2))
+	norm := Normalize(prog)
+	assert.Nil(t, norm.Blocks[0].Comment)
+	assert.True(t, norm.Blocks[0].IsDeletable())
+	// Enabling a block or changing its shape is not
+	prog3, err := ParseProgram([]byte(strings.Replace(commentsXML, ` disabled="true"`, "", 1)))
+	assert.Nil(t, err)
+	assert.NotEqual(t, Fingerprint(prog), Fingerprint(prog3))
+	prog4, err := ParseProgram([]byte(strings.Replace(commentsXML, `elseif="1"`, `elseif="2"`, 1)))
+	assert.Nil(t, err)
+	assert.NotEqual(t, Fingerprint(prog), Fingerprint(prog4))
+}
@@ -0,0 +1,152 @@
+package kcode
+
+// diff.go
+// -------
+// Description:
+// Line based unified diff, as printed by diff -u, for showing what a rewrite such as
+// Simplify would change.  Lines are matched using their longest common subsequence and
+// changes are shown with 3 lines of context.
+//
+// API:
+// UnifiedDiff(fromFile string, toFile string, from []byte, to []byte) string
+//
+
+import (
+	"fmt"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines shown around each change
+const diffContext = 3
+
+// diffLine is a line of a diff: ' ' when it is in both, '-' when it is only in from and '+' when it is only in to
+type diffLine struct {
+	op   byte
+	text string
+}
+
+// UnifiedDiff returns the unified diff between two texts or "" if they are the same
+func UnifiedDiff(fromFile string, toFile string, from []byte, to []byte) string {
+	lines := diffLines(splitLines(from), splitLines(to))
+	var sb strings.Builder
+	for start := 0; start < len(lines); {
+		// Find the next change and the run of changes with no more than 2*diffContext unchanged lines between them
+		first := start
+		for first < len(lines) && lines[first].op == ' ' {
+			first++
+		}
+		if first == len(lines) {
+			break
+		}
+		last := first
+		for i := first; i < len(lines) && i-last <= 2*diffContext; i++ {
+			if lines[i].op != ' ' {
+				last = i
+			}
+		}
+		lo, hi := first-diffContext, last+diffContext+1
+		if lo < start {
+			lo = start
+		}
+		if hi > len(lines) {
+			hi = len(lines)
+		}
+		if sb.Len() == 0 {
+			fmt.Fprintf(&sb, "--- %s\n+++ %s\n", fromFile, toFile)
+		}
+		writeHunk(&sb, lines, lo, hi)
+		start = hi
+	}
+	return sb.String()
+}
+
+func splitLines(text []byte) []string {
+	if len(text) == 0 {
+		return []string{}
+	}
+	return strings.Split(strings.TrimSuffix(string(text), "\n"), "\n")
+}
+
+// diffLines lines up two lists of lines using their longest common subsequence
+func diffLines(a []string, b []string) []diffLine {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	lines := make([]diffLine, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			lines = append(lines, diffLine{' ', a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			lines = append(lines, diffLine{'-', a[i]})
+			i++
+		default:
+			lines = append(lines, diffLine{'+', b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		lines = append(lines, diffLine{'-', a[i]})
+	}
+	for ; j < len(b); j++ {
+		lines = append(lines, diffLine{'+', b[j]})
+	}
+	return lines
+}
+
+// writeHunk writes lines[lo:hi] with a header giving where they are in each text
+func writeHunk(sb *strings.Builder, lines []diffLine, lo int, hi int) {
+	fromLine, toLine := 1, 1
+	for _, l := range lines[:lo] {
+		if l.op != '+' {
+			fromLine++
+		}
+		if l.op != '-' {
+			toLine++
+		}
+	}
+	fromCount, toCount := 0, 0
+	for _, l := range lines[lo:hi] {
+		if l.op != '+' {
+			fromCount++
+		}
+		if l.op != '-' {
+			toCount++
+		}
+	}
+	// An empty range starts on the line before it, as in diff -u
+	if fromCount == 0 {
+		fromLine--
+	}
+	if toCount == 0 {
+		toLine--
+	}
+	fmt.Fprintf(sb, "@@ -%s +%s @@\n", hunkRange(fromLine, fromCount), hunkRange(toLine, toCount))
+	for _, l := range lines[lo:hi] {
+		fmt.Fprintf(sb, "%c%s\n", l.op, l.text)
+	}
+}
+
+func hunkRange(start int, count int) string {
+	if count == 1 {
+		return fmt.Sprintf("%d", start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
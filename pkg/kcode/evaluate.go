@@ -0,0 +1,517 @@
+package kcode
+
+// evaluate.go
+// -----------
+// Description:
+// Evaluation of pure value blocks: number, boolean, text and colour literals, math
+// (math_arithmetic, math_single, math_constrain, math_lerp), comparison and logic
+// (logic_compare, logic_operation, logic_negate), text_join and the colour blocks
+// create_color and color_lerp.  Variables are looked up in an Env so a simulation can
+// supply their current values, and a nil Env treats every variable as unknown.  Blocks
+// that read sensors or pick random values such as wand_x and math_random are never
+// constant.  Calculations giving NaN or an infinite number, such as the square root of
+// -1, are errors like division by 0 since no number block can hold the result.  Fold
+// reduces the constant sub-expressions of a block to literal blocks.
+// Percentages such as the PERCENT of math_lerp run from 0 to 100, as do the components
+// of create_color, the hue being a percentage of the way round the colour wheel.
+//
+// API:
+// Evaluate(b *Block, env Env) (Constant, error)
+// Fold(b *Block, env Env) *Block
+// CheckExpressions(prog *Program) []Issue
+// (c Constant) Number() (float64, error)
+// (c Constant) Bool() (bool, error)
+// (c Constant) String() string
+// (c Constant) Block(id string) *Block
+//
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var (
+	errNotConstant    = errors.New("value is not constant")
+	errEmptyInput     = errors.New("value input is empty")
+	errTypeMismatch   = errors.New("value has the wrong type")
+	errDivisionByZero = errors.New("division by zero")
+	errUnknownOp      = errors.New("unknown operator")
+	errNotFinite      = errors.New("result is not a finite number")
+)
+
+// Constant is the result of evaluating a value block.  Kind is FieldNumber, FieldBoolean,
+// FieldColour or FieldText and Value is a float64, a bool or a string accordingly, with
+// colours as upper case #RRGGBB.
+type Constant struct {
+	Kind  string      `json:"kind"`
+	Value interface{} `json:"value"`
+}
+
+// Env holds the values of variables by name
+type Env map[string]Constant
+
+// Evaluate works out the value of a value block.  It returns an error wrapping
+// errNotConstant if the value depends on something only known when the creation runs.
+func Evaluate(b *Block, env Env) (Constant, error) {
+	if b == nil {
+		return Constant{}, errEmptyInput
+	}
+	blockType := b.Type
+	if i := strings.Index(blockType, "#"); i >= 0 {
+		blockType = blockType[i+1:]
+	}
+	switch blockType {
+	case "math_number", "angle", "logic_boolean", "text", "colour_picker":
+		return evaluateLiteral(b)
+	case "variables_get":
+		name, _ := b.Field("VAR")
+		if c, ok := env[name]; ok {
+			return c, nil
+		}
+		return Constant{}, fmt.Errorf("%w: variable '%s'", errNotConstant, name)
+	case "math_arithmetic":
+		return evaluateArithmetic(b, env)
+	case "math_single":
+		return evaluateSingle(b, env)
+	case "math_constrain":
+		n, err := evaluateNumbers(b, env, "VALUE", "LOW", "HIGH")
+		if err != nil {
+			return Constant{}, err
+		}
+		return numberConstant(math.Min(math.Max(n[0], n[1]), n[2])), nil
+	case "math_lerp":
+		n, err := evaluateNumbers(b, env, "FROM", "TO", "PERCENT")
+		if err != nil {
+			return Constant{}, err
+		}
+		return finiteConstant(lerp(n[0], n[1], n[2]))
+	case "logic_compare":
+		return evaluateCompare(b, env)
+	case "logic_operation":
+		return evaluateOperation(b, env)
+	case "logic_negate":
+		v, err := evaluateBool(b, env, "BOOL")
+		if err != nil {
+			return Constant{}, err
+		}
+		return Constant{Kind: FieldBoolean, Value: !v}, nil
+	case "text_join":
+		return evaluateJoin(b, env)
+	case "create_color":
+		return evaluateCreateColour(b, env)
+	case "color_lerp":
+		return evaluateColourLerp(b, env)
+	}
+	return Constant{}, fmt.Errorf("%w: %s", errNotConstant, b.Type)
+}
+
+// Fold returns a copy of a value block with every constant sub-expression replaced by a
+// literal block keeping the id of the block it replaces.  The block itself is replaced if
+// it is constant.  Blocks that are already literals are left as they are.
+func Fold(b *Block, env Env) *Block {
+	if b == nil {
+		return nil
+	}
+	if c, err := Evaluate(b, env); err == nil {
+		if isLiteral(b) {
+			return b
+		}
+		literal := c.Block(b.Id)
+		literal.Shadow = b.Shadow
+		return literal
+	}
+	folded := *b
+	folded.Values = make([]Input, len(b.Values))
+	for i, in := range b.Values {
+		folded.Values[i] = Input{Name: in.Name, Block: Fold(in.Block, env), Shadow: in.Shadow}
+	}
+	return &folded
+}
+
+// CheckExpressions reports constant values that cannot be what the child meant: a scale
+// factor of 0 and division by 0
+func CheckExpressions(prog *Program) []Issue {
+	issues := make([]Issue, 0)
+	eachEnabledBlockPath(prog, func(b *Block, path string) {
+		switch b.Type {
+		case "objects_scale":
+			if n, err := evaluateNumber(b, nil, "VALUE"); err == nil && n == 0 {
+				issues = append(issues, Issue{Kind: "zero-scale", BlockId: b.Id, BlockType: b.Type, Path: path,
+					Message: "scale factor evaluates to 0"})
+			}
+		case "math_arithmetic":
+			op, _ := b.Field("OP")
+			if n, err := evaluateNumber(b, nil, "B"); err == nil && n == 0 && strings.TrimSpace(op) == "DIVIDE" {
+				issues = append(issues, Issue{Kind: "division-by-zero", BlockId: b.Id, BlockType: b.Type, Path: path,
+					Message: "divisor evaluates to 0"})
+			}
+		}
+	})
+	return issues
+}
+
+// Number returns the constant as a number.  Text is converted if it holds a number.
+func (c Constant) Number() (float64, error) {
+	switch v := c.Value.(type) {
+	case float64:
+		return v, nil
+	case string:
+		if c.Kind == FieldText {
+			if n, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+				return n, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("%w: %s is not a number", errTypeMismatch, c)
+}
+
+// Bool returns the constant as a boolean
+func (c Constant) Bool() (bool, error) {
+	if v, ok := c.Value.(bool); ok {
+		return v, nil
+	}
+	return false, fmt.Errorf("%w: %s is not a boolean", errTypeMismatch, c)
+}
+
+// String renders the constant the way text_join would e.g. 1.5, true or #FF0000
+func (c Constant) String() string {
+	switch v := c.Value.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case string:
+		return v
+	}
+	return ""
+}
+
+// Block returns a literal block holding the constant: math_number, logic_boolean, colour_picker or text
+func (c Constant) Block(id string) *Block {
+	switch c.Kind {
+	case FieldNumber:
+		return &Block{Type: "math_number", Id: id, Fields: []Field{{Name: "NUM", Value: c.String()}}}
+	case FieldBoolean:
+		return &Block{Type: "logic_boolean", Id: id, Fields: []Field{{Name: "BOOL", Value: strings.ToUpper(c.String())}}}
+	case FieldColour:
+		return &Block{Type: "colour_picker", Id: id, Fields: []Field{{Name: "COLOUR", Value: c.String()}}}
+	}
+	return &Block{Type: "text", Id: id, Fields: []Field{{Name: "TEXT", Value: c.String()}}}
+}
+
+func numberConstant(n float64) Constant {
+	return Constant{Kind: FieldNumber, Value: n}
+}
+
+// finiteConstant is numberConstant for the result of a calculation, which is an error
+// if it is NaN or infinite, e.g. the square root of -1, as no block can hold it
+func finiteConstant(n float64) (Constant, error) {
+	if math.IsNaN(n) || math.IsInf(n, 0) {
+		return Constant{}, errNotFinite
+	}
+	return numberConstant(n), nil
+}
+
+func isLiteral(b *Block) bool {
+	switch b.Type {
+	case "math_number", "angle", "logic_boolean", "text", "colour_picker":
+		return true
+	}
+	return false
+}
+
+// evaluateLiteral parses the single field of a literal block according to its kind
+func evaluateLiteral(b *Block) (Constant, error) {
+	if len(b.Fields) != 1 {
+		return Constant{}, fmt.Errorf("%w: %s has no value", errTypeMismatch, b.Type)
+	}
+	if b.Type == "text" {
+		// Spaces matter in text that is joined
+		return Constant{Kind: FieldText, Value: b.Fields[0].Value}, nil
+	}
+	kind, value := parseField(b.Type, b.Fields[0])
+	if kind == FieldNumber {
+		// ParseFloat accepts NaN, Inf and numbers too big for a float64
+		return finiteConstant(value.(float64))
+	}
+	if kind != FieldText {
+		return Constant{Kind: kind, Value: value}, nil
+	}
+	return Constant{}, fmt.Errorf("%w: %s is not a valid %s", errTypeMismatch, b.Fields[0].Value, b.Type)
+}
+
+// evaluateInput evaluates the block in the named value input, or its shadow if it has no block
+func evaluateInput(b *Block, env Env, name string) (Constant, error) {
+	target := b.Input(name).Target()
+	if target == nil {
+		return Constant{}, fmt.Errorf("%w: %s of %s", errEmptyInput, name, b.Type)
+	}
+	return Evaluate(target, env)
+}
+
+func evaluateNumber(b *Block, env Env, name string) (float64, error) {
+	c, err := evaluateInput(b, env, name)
+	if err != nil {
+		return 0, err
+	}
+	return c.Number()
+}
+
+func evaluateNumbers(b *Block, env Env, names ...string) ([]float64, error) {
+	numbers := make([]float64, 0, len(names))
+	for _, name := range names {
+		n, err := evaluateNumber(b, env, name)
+		if err != nil {
+			return nil, err
+		}
+		numbers = append(numbers, n)
+	}
+	return numbers, nil
+}
+
+func evaluateBool(b *Block, env Env, name string) (bool, error) {
+	c, err := evaluateInput(b, env, name)
+	if err != nil {
+		return false, err
+	}
+	return c.Bool()
+}
+
+func evaluateArithmetic(b *Block, env Env) (Constant, error) {
+	n, err := evaluateNumbers(b, env, "A", "B")
+	if err != nil {
+		return Constant{}, err
+	}
+	op, _ := b.Field("OP")
+	switch strings.TrimSpace(op) {
+	case "ADD":
+		return finiteConstant(n[0] + n[1])
+	case "MINUS":
+		return finiteConstant(n[0] - n[1])
+	case "MULTIPLY":
+		return finiteConstant(n[0] * n[1])
+	case "DIVIDE":
+		if n[1] == 0 {
+			return Constant{}, errDivisionByZero
+		}
+		return finiteConstant(n[0] / n[1])
+	case "POWER":
+		return finiteConstant(math.Pow(n[0], n[1]))
+	}
+	return Constant{}, fmt.Errorf("%w: %s of %s", errUnknownOp, op, b.Type)
+}
+
+func evaluateSingle(b *Block, env Env) (Constant, error) {
+	n, err := evaluateNumber(b, env, "NUM")
+	if err != nil {
+		return Constant{}, err
+	}
+	op, _ := b.Field("OP")
+	switch strings.TrimSpace(op) {
+	case "ROOT":
+		return finiteConstant(math.Sqrt(n))
+	case "ABS":
+		return finiteConstant(math.Abs(n))
+	case "NEG":
+		return finiteConstant(-n)
+	case "LN":
+		return finiteConstant(math.Log(n))
+	case "LOG10":
+		return finiteConstant(math.Log10(n))
+	case "EXP":
+		return finiteConstant(math.Exp(n))
+	case "POW10":
+		return finiteConstant(math.Pow(10, n))
+	}
+	return Constant{}, fmt.Errorf("%w: %s of %s", errUnknownOp, op, b.Type)
+}
+
+// evaluateCompare compares numbers numerically.  Other values can only be tested for equality.
+func evaluateCompare(b *Block, env Env) (Constant, error) {
+	x, err := evaluateInput(b, env, "A")
+	if err != nil {
+		return Constant{}, err
+	}
+	y, err := evaluateInput(b, env, "B")
+	if err != nil {
+		return Constant{}, err
+	}
+	op, _ := b.Field("OP")
+	op = strings.TrimSpace(op)
+	if op == "EQ" || op == "NEQ" {
+		equal := x.Kind == y.Kind && x.Value == y.Value
+		if nx, err := x.Number(); err == nil {
+			if ny, err := y.Number(); err == nil {
+				equal = nx == ny
+			}
+		}
+		return Constant{Kind: FieldBoolean, Value: equal == (op == "EQ")}, nil
+	}
+	nx, err := x.Number()
+	if err != nil {
+		return Constant{}, err
+	}
+	ny, err := y.Number()
+	if err != nil {
+		return Constant{}, err
+	}
+	var result bool
+	switch op {
+	case "LT":
+		result = nx < ny
+	case "LTE":
+		result = nx <= ny
+	case "GT":
+		result = nx > ny
+	case "GTE":
+		result = nx >= ny
+	default:
+		return Constant{}, fmt.Errorf("%w: %s of %s", errUnknownOp, op, b.Type)
+	}
+	return Constant{Kind: FieldBoolean, Value: result}, nil
+}
+
+// evaluateOperation short circuits so false AND anything is false and true OR anything is true
+func evaluateOperation(b *Block, env Env) (Constant, error) {
+	op, _ := b.Field("OP")
+	op = strings.TrimSpace(op)
+	if op != "AND" && op != "OR" {
+		return Constant{}, fmt.Errorf("%w: %s of %s", errUnknownOp, op, b.Type)
+	}
+	x, err := evaluateBool(b, env, "A")
+	if err != nil {
+		return Constant{}, err
+	}
+	if x == (op == "OR") {
+		return Constant{Kind: FieldBoolean, Value: x}, nil
+	}
+	y, err := evaluateBool(b, env, "B")
+	if err != nil {
+		return Constant{}, err
+	}
+	return Constant{Kind: FieldBoolean, Value: y}, nil
+}
+
+// evaluateJoin joins the ADD0, ADD1... inputs of text_join as text.  Empty inputs are skipped.
+func evaluateJoin(b *Block, env Env) (Constant, error) {
+	var sb strings.Builder
+	for i := range b.Values {
+		target := b.Values[i].Target()
+		if !strings.HasPrefix(b.Values[i].Name, "ADD") || target == nil {
+			continue
+		}
+		c, err := Evaluate(target, env)
+		if err != nil {
+			return Constant{}, err
+		}
+		sb.WriteString(c.String())
+	}
+	return Constant{Kind: FieldText, Value: sb.String()}, nil
+}
+
+// evaluateCreateColour makes a colour from its TYPE, rgb or hsv, and components 1, 2 and 3.
+// Missing components are 0 for rgb, and full saturation and brightness for hsv.
+func evaluateCreateColour(b *Block, env Env) (Constant, error) {
+	colourType, _ := b.Field("TYPE")
+	colourType = strings.TrimSpace(colourType)
+	components := []float64{0, 0, 0}
+	if colourType == "hsv" {
+		components = []float64{0, 100, 100}
+	} else if colourType != "rgb" {
+		return Constant{}, fmt.Errorf("%w: %s of %s", errUnknownOp, colourType, b.Type)
+	}
+	for i, name := range []string{"1", "2", "3"} {
+		if b.Input(name).Target() == nil {
+			continue
+		}
+		n, err := evaluateNumber(b, env, name)
+		if err != nil {
+			return Constant{}, err
+		}
+		components[i] = math.Min(math.Max(n, 0), 100) / 100
+	}
+	r, g, bl := components[0], components[1], components[2]
+	if colourType == "hsv" {
+		r, g, bl = hsvToRGB(components[0], components[1], components[2])
+	}
+	return colourConstant(r, g, bl), nil
+}
+
+// evaluateColourLerp mixes the FROM and TO colours channel by channel
+func evaluateColourLerp(b *Block, env Env) (Constant, error) {
+	from, err := evaluateColour(b, env, "FROM")
+	if err != nil {
+		return Constant{}, err
+	}
+	to, err := evaluateColour(b, env, "TO")
+	if err != nil {
+		return Constant{}, err
+	}
+	percent, err := evaluateNumber(b, env, "PERCENT")
+	if err != nil {
+		return Constant{}, err
+	}
+	percent = math.Min(math.Max(percent, 0), 100)
+	mixed := make([]float64, 3)
+	for i := range mixed {
+		mixed[i] = lerp(from[i], to[i], percent)
+	}
+	return colourConstant(mixed[0], mixed[1], mixed[2]), nil
+}
+
+// evaluateColour returns the red, green and blue of a colour input from 0 to 1
+func evaluateColour(b *Block, env Env, name string) ([]float64, error) {
+	c, err := evaluateInput(b, env, name)
+	if err != nil {
+		return nil, err
+	}
+	if c.Kind != FieldColour {
+		return nil, fmt.Errorf("%w: %s is not a colour", errTypeMismatch, c)
+	}
+	rgb := make([]float64, 3)
+	for i := range rgb {
+		n, _ := strconv.ParseUint(c.String()[1+2*i:3+2*i], 16, 8)
+		rgb[i] = float64(n) / 255
+	}
+	return rgb, nil
+}
+
+// lerp goes percent of the way from one number to another
+func lerp(from float64, to float64, percent float64) float64 {
+	return from + (to-from)*percent/100
+}
+
+// colourConstant makes a colour from red, green and blue from 0 to 1
+func colourConstant(r float64, g float64, b float64) Constant {
+	channel := func(v float64) int {
+		return int(math.Round(math.Min(math.Max(v, 0), 1) * 255))
+	}
+	return Constant{Kind: FieldColour, Value: fmt.Sprintf("#%02X%02X%02X", channel(r), channel(g), channel(b))}
+}
+
+// hsvToRGB converts hue, saturation and value from 0 to 1 into red, green and blue from 0 to 1
+func hsvToRGB(h float64, s float64, v float64) (float64, float64, float64) {
+	h = math.Mod(h*6, 6)
+	c := v * s
+	x := c * (1 - math.Abs(math.Mod(h, 2)-1))
+	m := v - c
+	var r, g, b float64
+	switch {
+	case h < 1:
+		r, g, b = c, x, 0
+	case h < 2:
+		r, g, b = x, c, 0
+	case h < 3:
+		r, g, b = 0, c, x
+	case h < 4:
+		r, g, b = 0, x, c
+	case h < 5:
+		r, g, b = x, 0, c
+	default:
+		r, g, b = c, 0, x
+	}
+	return r + m, g + m, b + m
+}
@@ -0,0 +1,186 @@
+package kcode
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// valueBlock parses the XML of a single value block
+func valueBlock(t *testing.T, xml string) *Block {
+	prog, err := ParseProgram([]byte("<xml>" + xml + "</xml>"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(prog.Blocks))
+	return prog.Blocks[0]
+}
+
+func number(n string) string {
+	return fmt.Sprintf(`<block type="math_number"><field name="NUM">%s</field></block>`, n)
+}
+
+func arithmetic(op string, a string, b string) string {
+	return fmt.Sprintf(`<block type="math_arithmetic" id="%s"><field name="OP">%s</field><value name="A">%s</value><value name="B">%s</value></block>`, op, op, a, b)
+}
+
+func TestEvaluate(t *testing.T) {
+	tests := []struct {
+		xml      string
+		expected Constant
+	}{
+		{number("15"), Constant{FieldNumber, 15.0}},
+		{`<block type="angle"><field name="VALUE">90</field></block>`, Constant{FieldNumber, 90.0}},
+		{`<block type="logic_boolean"><field name="BOOL">TRUE</field></block>`, Constant{FieldBoolean, true}},
+		{`<block type="text"><field name="TEXT">hello</field></block>`, Constant{FieldText, "hello"}},
+		{`<block type="colour_picker"><field name="COLOUR">#f00</field></block>`, Constant{FieldColour, "#FF0000"}},
+		{arithmetic("ADD", number("1"), number("2")), Constant{FieldNumber, 3.0}},
+		{arithmetic("MULTIPLY", arithmetic("MINUS", number("5"), number("3")), number("4")), Constant{FieldNumber, 8.0}},
+		{arithmetic("DIVIDE", number("1"), number("4")), Constant{FieldNumber, 0.25}},
+		{arithmetic("POWER", number("2"), number("10")), Constant{FieldNumber, 1024.0}},
+		{`<block type="math_single"><field name="OP">NEG</field><value name="NUM">` + number("3") + `</value></block>`, Constant{FieldNumber, -3.0}},
+		{`<block type="math_single"><field name="OP">ROOT</field><value name="NUM">` + number("9") + `</value></block>`, Constant{FieldNumber, 3.0}},
+		{`<block type="math_constrain"><value name="VALUE">` + number("150") + `</value><value name="LOW">` + number("0") +
+			`</value><value name="HIGH">` + number("100") + `</value></block>`, Constant{FieldNumber, 100.0}},
+		{`<block type="math_lerp"><value name="FROM">` + number("10") + `</value><value name="TO">` + number("20") +
+			`</value><value name="PERCENT">` + number("50") + `</value></block>`, Constant{FieldNumber, 15.0}},
+		{`<block type="logic_compare"><field name="OP">GT</field><value name="A">` + number("3") + `</value><value name="B">` + number("2") + `</value></block>`,
+			Constant{FieldBoolean, true}},
+		{`<block type="logic_compare"><field name="OP">EQ</field><value name="A">` + number("3") +
+			`</value><value name="B"><block type="text"><field name="TEXT">3</field></block></value></block>`, Constant{FieldBoolean, true}},
+		{`<block type="logic_compare"><field name="OP">NEQ</field><value name="A"><block type="text"><field name="TEXT">a</field></block></value>` +
+			`<value name="B"><block type="text"><field name="TEXT">b</field></block></value></block>`, Constant{FieldBoolean, true}},
+		// false AND anything is false even when the other side is not constant
+		{`<block type="logic_operation"><field name="OP">AND</field><value name="A"><block type="logic_boolean"><field name="BOOL">FALSE</field></block></value>` +
+			`<value name="B"><block type="wand_speed"></block></value></block>`, Constant{FieldBoolean, false}},
+		{`<block type="logic_negate"><value name="BOOL"><block type="logic_boolean"><field name="BOOL">FALSE</field></block></value></block>`, Constant{FieldBoolean, true}},
+		{`<block type="text_join"><mutation items="3"></mutation><value name="ADD0"><block type="text"><field name="TEXT">score </field></block></value>` +
+			`<value name="ADD1">` + arithmetic("ADD", number("1.5"), number("1")) + `</value><value name="ADD2"></value></block>`, Constant{FieldText, "score 2.5"}},
+		{`<block type="create_color"><field name="TYPE">rgb</field><value name="1">` + number("100") + `</value><value name="2">` + number("50") + `</value></block>`,
+			Constant{FieldColour, "#FF8000"}},
+		{`<block type="create_color"><mutation color_type="hsv"></mutation><field name="TYPE">hsv</field><value name="1">` + number("50") + `</value></block>`,
+			Constant{FieldColour, "#00FFFF"}},
+		{`<block type="color_lerp"><value name="FROM"><shadow type="colour_picker"><field name="COLOUR">#000000</field></shadow></value>` +
+			`<value name="TO"><shadow type="colour_picker"><field name="COLOUR">#ffffff</field></shadow></value>` +
+			`<value name="PERCENT"><shadow type="math_number"><field name="NUM">50</field></shadow></value></block>`, Constant{FieldColour, "#808080"}},
+		// A block in an input hides its shadow
+		{`<block type="math_arithmetic"><field name="OP">ADD</field><value name="A"><shadow type="math_number"><field name="NUM">1</field></shadow>` +
+			number("10") + `</value><value name="B"><shadow type="math_number"><field name="NUM">2</field></shadow></value></block>`, Constant{FieldNumber, 12.0}},
+	}
+	for _, test := range tests {
+		c, err := Evaluate(valueBlock(t, test.xml), nil)
+		assert.Nil(t, err, test.xml)
+		assert.Equal(t, test.expected, c, test.xml)
+	}
+}
+
+func TestEvaluateErrors(t *testing.T) {
+	_, err := Evaluate(valueBlock(t, arithmetic("ADD", number("1"), `<block type="wand_x"></block>`)), nil)
+	assert.True(t, errors.Is(err, errNotConstant))
+	_, err = Evaluate(valueBlock(t, `<block type="math_random"><value name="MIN">`+number("1")+`</value><value name="MAX">`+number("2")+`</value></block>`), nil)
+	assert.True(t, errors.Is(err, errNotConstant))
+	_, err = Evaluate(valueBlock(t, arithmetic("DIVIDE", number("1"), number("0"))), nil)
+	assert.True(t, errors.Is(err, errDivisionByZero))
+	_, err = Evaluate(valueBlock(t, `<block type="math_arithmetic"><field name="OP">ADD</field><value name="A">`+number("1")+`</value></block>`), nil)
+	assert.True(t, errors.Is(err, errEmptyInput))
+	_, err = Evaluate(valueBlock(t, arithmetic("MODULO", number("1"), number("2"))), nil)
+	assert.True(t, errors.Is(err, errUnknownOp))
+	_, err = Evaluate(valueBlock(t, arithmetic("ADD", number("1"), `<block type="text"><field name="TEXT">one</field></block>`)), nil)
+	assert.True(t, errors.Is(err, errTypeMismatch))
+	_, err = Evaluate(nil, nil)
+	assert.True(t, errors.Is(err, errEmptyInput))
+	// Results no number block can hold
+	for op, n := range map[string]string{"ROOT": "-1", "LN": "0", "LOG10": "-5", "EXP": "1000"} {
+		_, err = Evaluate(valueBlock(t, single(op, number(n))), nil)
+		assert.True(t, errors.Is(err, errNotFinite), op)
+	}
+	_, err = Evaluate(valueBlock(t, arithmetic("POWER", number("10"), number("400"))), nil)
+	assert.True(t, errors.Is(err, errNotFinite))
+	for _, n := range []string{"NaN", "Inf", "-infinity"} {
+		_, err = Evaluate(valueBlock(t, number(n)), nil)
+		assert.True(t, errors.Is(err, errNotFinite), n)
+		_, err = Evaluate(valueBlock(t, arithmetic("ADD", number(n), number("1"))), nil)
+		assert.True(t, errors.Is(err, errNotFinite), n)
+	}
+	// ParseFloat gives an error for numbers too big for a float64 so they are not numbers at all
+	_, err = Evaluate(valueBlock(t, number("1e999")), nil)
+	assert.True(t, errors.Is(err, errTypeMismatch))
+	root := valueBlock(t, arithmetic("ADD", number("1"), single("ROOT", arithmetic("MINUS", number("0"), number("1")))))
+	folded := Fold(root, nil)
+	assert.Equal(t, "math_single", folded.Input("B").Block.Type)
+	assert.Equal(t, "math_number", folded.Input("B").Block.Input("NUM").Block.Type)
+}
+
+func single(op string, n string) string {
+	return fmt.Sprintf(`<block type="math_single"><field name="OP">%s</field><value name="NUM">%s</value></block>`, op, n)
+}
+
+func TestEvaluateEnv(t *testing.T) {
+	b := valueBlock(t, arithmetic("MULTIPLY", `<block type="variables_get"><field name="VAR" id="v1">size</field></block>`, number("2")))
+	_, err := Evaluate(b, nil)
+	assert.True(t, errors.Is(err, errNotConstant))
+	c, err := Evaluate(b, Env{"size": {FieldNumber, 21.0}})
+	assert.Nil(t, err)
+	assert.Equal(t, 42.0, c.Value)
+	n, err := c.Number()
+	assert.Nil(t, err)
+	assert.Equal(t, 42.0, n)
+	_, err = c.Bool()
+	assert.True(t, errors.Is(err, errTypeMismatch))
+	assert.Equal(t, "42", c.String())
+}
+
+func TestFold(t *testing.T) {
+	// 2 * (wand_x + (3 - 1)) folds to 2 * (wand_x + 2)
+	b := valueBlock(t, arithmetic("MULTIPLY", number("2"), arithmetic("ADD", `<block type="wand_x" id="x"></block>`, arithmetic("MINUS", number("3"), number("1")))))
+	folded := Fold(b, nil)
+	assert.Equal(t, "math_arithmetic(MULTIPLY, 2, math_arithmetic(ADD, wand_x, 2))", describeValue(folded))
+	literal := folded.Input("B").Block.Input("B").Block
+	assert.Equal(t, &Block{Type: "math_number", Id: "MINUS", Fields: []Field{{Name: "NUM", Value: "2"}}}, literal)
+	// The original block is left alone
+	assert.Equal(t, "math_arithmetic(MULTIPLY, 2, math_arithmetic(ADD, wand_x, math_arithmetic(MINUS, 3, 1)))", describeValue(b))
+	// A constant block folds to a single literal
+	folded = Fold(valueBlock(t, `<block type="logic_compare" id="c"><field name="OP">LT</field><value name="A">`+number("1")+`</value><value name="B">`+number("2")+`</value></block>`), nil)
+	assert.Equal(t, &Block{Type: "logic_boolean", Id: "c", Fields: []Field{{Name: "BOOL", Value: "TRUE"}}}, folded)
+	assert.Nil(t, Fold(nil, nil))
+}
+
+func TestCheckExpressions(t *testing.T) {
+	prog, err := ParseProgram([]byte(`<xml><block type="events_onGesture" id="a"><field name="TYPE">reducio</field>
+		<statement name="CALLBACK"><block type="objects_scale" id="b"><field name="PROPORTION">shrink</field>
+		<value name="TARGET"><shadow type="objects_get" id="c"><field name="ID">all</field></shadow></value>
+		<value name="VALUE"><shadow type="math_number" id="d"><field name="NUM">50</field></shadow>` +
+		arithmetic("MINUS", number("5"), number("5")) + `</value>
+		<next><block type="objects_scale" id="e"><field name="PROPORTION">grow</field>
+		<value name="VALUE">` + arithmetic("DIVIDE", `<block type="wand_x"></block>`, arithmetic("MULTIPLY", number("0"), number("3"))) + `</value>
+		</block></next></block></statement></block></xml>`))
+	assert.Nil(t, err)
+	issues := CheckExpressions(prog)
+	assert.Equal(t, []string{"zero-scale", "division-by-zero"}, issueKinds(issues))
+	assert.Equal(t, "b", issues[0].BlockId)
+	assert.Equal(t, "scale factor evaluates to 0", issues[0].Message)
+	assert.Equal(t, "/block[1]/statement[CALLBACK]/block", issues[0].Path)
+	assert.Equal(t, "DIVIDE", issues[1].BlockId)
+	assert.Equal(t, "warning", RuleFor("zero-scale").Level)
+}
+
+func TestEvaluateAllChallenges(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	// The challenges have no constant mistakes and every value block either evaluates or is not constant
+	for _, f := range ListFilesInDirectory("challenges") {
+		prog, err := ExtractProgram(ReadFile("challenges/" + f.Name()))
+		assert.Nil(t, err, f.Name())
+		assert.Empty(t, CheckExpressions(prog), f.Name())
+		eachBlockPath(prog, func(b *Block, path string) {
+			schema, ok := blockRegistry.Lookup(b.Type)
+			if !ok || !schema.HasOutput {
+				return
+			}
+			if _, err := Evaluate(b, nil); err != nil {
+				assert.True(t, errors.Is(err, errNotConstant), "%s %s: %s", f.Name(), path, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package kcode
+
+// fields.go
+// ---------
+// Description:
+// Typed extraction of the literal values in a creation's fields, e.g. the COLOUR hex
+// codes of colour_picker, the NUM of math_number, the object ID and NAME fields and
+// the flick direction of events_onFlick.  Each field becomes a FieldRecord holding the
+// value parsed according to its kind: numbers are float64, booleans are bool and
+// everything else is a string, with colours as upper case #RRGGBB.  The kind comes from
+// the block registry so fields of block types it does not know are text.  Shadows are
+// included since they hold the values the child typed into the inputs.
+//
+// API:
+// Fields(prog *Program) []FieldRecord
+// ExtractFields(jsdata []byte) ([]FieldRecord, error)
+//
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Kinds of field value
+const (
+	FieldColour    = "colour"
+	FieldNumber    = "number"
+	FieldBoolean   = "boolean"
+	FieldObject    = "object"
+	FieldDirection = "direction"
+	FieldSpell     = "spell"
+	FieldVariable  = "variable"
+	FieldOption    = "option"
+	FieldText      = "text"
+)
+
+var hexColour = regexp.MustCompile(`^#([0-9a-fA-F]{3}){1,2}$`)
+
+// FieldRecord is the value of one field of a block.  Raw is the text of the field as it
+// is in the XML and Value is that text parsed according to Kind.
+type FieldRecord struct {
+	BlockId   string      `json:"blockId"`
+	BlockType string      `json:"blockType"`
+	Field     string      `json:"field"`
+	Kind      string      `json:"kind"`
+	Value     interface{} `json:"value"`
+	Raw       string      `json:"raw"`
+	Path      string      `json:"path"`
+}
+
+// Fields returns the fields of every block and shadow in the program in document order
+func Fields(prog *Program) []FieldRecord {
+	records := make([]FieldRecord, 0)
+	eachBlockPath(prog, func(b *Block, path string) {
+		for _, f := range b.Fields {
+			kind, value := parseField(b.Type, f)
+			records = append(records, FieldRecord{BlockId: b.Id, BlockType: b.Type, Field: f.Name,
+				Kind: kind, Value: value, Raw: f.Value, Path: path})
+		}
+	})
+	return records
+}
+
+// ExtractFields extracts the typed field records from .kcode JSON
+func ExtractFields(jsdata []byte) ([]FieldRecord, error) {
+	prog, err := ExtractProgram(jsdata)
+	if err != nil {
+		return nil, err
+	}
+	return Fields(prog), nil
+}
+
+// parseField works out the kind of a field and parses its value.  Values that do not
+// parse as their kind, such as a colour that is not a hex code, are returned as text.
+func parseField(blockType string, f Field) (string, interface{}) {
+	raw := strings.TrimSpace(f.Value)
+	kind := fieldKind(blockType, f.Name)
+	switch kind {
+	case FieldNumber:
+		if n, err := strconv.ParseFloat(raw, 64); err == nil {
+			return kind, n
+		}
+		return FieldText, raw
+	case FieldBoolean:
+		if b, err := strconv.ParseBool(strings.ToLower(raw)); err == nil {
+			return kind, b
+		}
+		return FieldText, raw
+	case FieldColour:
+		if hexColour.MatchString(raw) {
+			if len(raw) == 4 {
+				// #RGB is short for #RRGGBB
+				raw = string([]byte{'#', raw[1], raw[1], raw[2], raw[2], raw[3], raw[3]})
+			}
+			return kind, strings.ToUpper(raw)
+		}
+		return FieldText, raw
+	}
+	return kind, raw
+}
+
+// fieldKind looks up the kind of a field of a block type
+func fieldKind(blockType string, name string) string {
+	if i := strings.Index(blockType, "#"); i >= 0 {
+		blockType = blockType[i+1:]
+	}
+	switch {
+	case blockType == "logic_boolean" && name == "BOOL":
+		return FieldBoolean
+	case strings.HasPrefix(blockType, "objects_") && (name == "ID" || name == "NAME"):
+		return FieldObject
+	case (blockType == "events_onFlick" || blockType == "events_whileFlick") && name == "TYPE":
+		return FieldDirection
+	case blockType == "events_onGesture" && name == "TYPE":
+		return FieldSpell
+	}
+	schema, ok := blockRegistry.Lookup(blockType)
+	if !ok {
+		return FieldText
+	}
+	for _, fs := range schema.Fields {
+		if fs.Name != name {
+			continue
+		}
+		switch fs.Kind {
+		case "field_number", "field_angle":
+			return FieldNumber
+		case "field_colour":
+			return FieldColour
+		case "field_variable":
+			return FieldVariable
+		case "field_dropdown":
+			return FieldOption
+		}
+	}
+	return FieldText
+}
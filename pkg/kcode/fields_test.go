@@ -0,0 +1,65 @@
+package kcode
+
+import (
+	"io/ioutil"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFields(t *testing.T) {
+	prog, err := ParseProgram([]byte(`<xml><block type="events_onFlick" id="a"><field name="TYPE">up</field>
+		<statement name="CALLBACK"><block type="objects_setColor" id="b">
+		<value name="TINT"><shadow type="objects_get" id="c"><field name="ID">Pumpkin Pasty</field></shadow></value>
+		<value name="TO COLOR"><shadow type="colour_picker" id="d"><field name="COLOUR">#ff5723</field></shadow></value>
+		<next><block type="speaker2#speaker_sample" id="e"><field name="SET">Music</field><field name="SAMPLE">Bass Loop</field>
+		<next><block type="wand_vibrate" id="f"><field name="PATTERN">long</field><field name="MYSTERY">?</field></block></next>
+		</block></next></block></statement></block>
+		<block type="events_onGesture" id="g"><field name="TYPE">reducio</field></block>
+		<block type="math_number" id="h"><field name="NUM">-2.5</field></block>
+		<block type="math_number" id="i"><field name="NUM">lots</field></block>
+		<block type="logic_boolean" id="j"><field name="BOOL">TRUE</field></block>
+		<block type="colour_picker" id="k"><field name="COLOUR">#0a0</field></block>
+		<block type="variables_get" id="l"><field name="VAR" id="v1">hue</field></block>
+		<block type="angle" id="m"><field name="VALUE">90</field></block></xml>`))
+	assert.Nil(t, err)
+	records := Fields(prog)
+	kinds := make([]string, 0, len(records))
+	values := make([]interface{}, 0, len(records))
+	for _, r := range records {
+		kinds = append(kinds, r.Kind)
+		values = append(values, r.Value)
+	}
+	assert.Equal(t, []string{FieldDirection, FieldObject, FieldColour, FieldOption, FieldOption, FieldOption, FieldText,
+		FieldSpell, FieldNumber, FieldText, FieldBoolean, FieldColour, FieldVariable, FieldNumber}, kinds)
+	assert.Equal(t, []interface{}{"up", "Pumpkin Pasty", "#FF5723", "Music", "Bass Loop", "long", "?",
+		"reducio", -2.5, "lots", true, "#00AA00", "hue", 90.0}, values)
+	assert.Equal(t, FieldRecord{BlockId: "d", BlockType: "colour_picker", Field: "COLOUR", Kind: FieldColour,
+		Value: "#FF5723", Raw: "#ff5723", Path: "/block[1]/statement[CALLBACK]/block/value[TO COLOR]/shadow"}, records[2])
+}
+
+func TestExtractFields(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	records, err := ExtractFields(ReadFile("challenges/001_colovaria.kcode"))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(records))
+	assert.Equal(t, FieldDirection, records[0].Kind)
+	assert.Equal(t, "up", records[0].Value)
+	assert.Equal(t, "#FF5723", records[2].Value)
+	_, err = ExtractFields([]byte(`not json`))
+	assert.NotNil(t, err)
+	contents := ProcessKcodeContents(ReadFile("challenges/001_colovaria.kcode"), KCodeFlags{Fields: true}, false)
+	assert.Equal(t, records, contents.Fields)
+	assert.Nil(t, contents.Blocks)
+	// Every colour and number in the challenges parses
+	for _, f := range ListFilesInDirectory("challenges") {
+		records, err := ExtractFields(ReadFile("challenges/" + f.Name()))
+		assert.Nil(t, err)
+		for _, r := range records {
+			if r.Field == "NUM" || r.Field == "COLOUR" {
+				assert.NotEqual(t, FieldText, r.Kind, r.Raw)
+			}
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package kcode
+
+// files.go
+// --------
+// Description:
+// File systems that .kcode files are read from.  Everything goes through fs.FS so that
+// a directory on disk and a .zip or .tar.gz archive of creations are handled the same way.
+// Archives are read into memory and never extracted to disk.  They are kept in memory
+// so that each entry can be read without reopening the archive until CloseArchive or
+// CloseArchives drops them.  A .tar.gz archive is
+// repacked as an uncompressed zip in memory so that both kinds share archive/zip's fs.FS.
+// Files inside an archive can be named by joining the archive path and the name of
+// the entry, e.g. "exports.zip/challenges/001_colovaria.kcode", wherever a filename
+// is taken.
+//
+// API:
+// IsArchive(filename string) bool
+// OpenArchive(filename string) (fs.FS, error)
+// CloseArchive(filename string)
+// CloseArchives()
+// OpenFS(dirname string) (fs.FS, error)
+// ReadFileFS(fsys fs.FS, name string) []byte
+// ListFilesFS(fsys fs.FS, dir string) []os.FileInfo
+// KcodeFiles(fsys fs.FS) []string
+// EachKcodeFile(dirname string, fn func(filename string, data []byte)) error
+//
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errNotArchive = errors.New("not a .zip or .tar.gz archive")
+	// archives caches opened archives by path so that reading each entry does not reopen the archive
+	archives   = make(map[string]cachedArchive)
+	archivesMu sync.Mutex
+)
+
+type cachedArchive struct {
+	fsys    fs.FS
+	modTime time.Time
+	size    int64
+}
+
+// IsArchive reports whether a filename has a .zip, .tar.gz or .tgz extension
+func IsArchive(filename string) bool {
+	name := strings.ToLower(filename)
+	return strings.HasSuffix(name, ".zip") || strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz")
+}
+
+// OpenArchive reads a .zip or .tar.gz archive into memory and returns its contents as an fs.FS
+func OpenArchive(filename string) (fs.FS, error) {
+	if !IsArchive(filename) {
+		return nil, errNotArchive
+	}
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	archivesMu.Lock()
+	defer archivesMu.Unlock()
+	if cached, ok := archives[filename]; ok && cached.modTime.Equal(fi.ModTime()) && cached.size == fi.Size() {
+		return cached.fsys, nil
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(strings.ToLower(filename), ".zip") {
+		if data, err = tarToZip(data); err != nil {
+			return nil, err
+		}
+	}
+	fsys, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	archives[filename] = cachedArchive{fsys, fi.ModTime(), fi.Size()}
+	return fsys, nil
+}
+
+// CloseArchive drops an archive opened by OpenArchive from memory.  File systems already
+// returned for it stay usable but the next use of the archive reads it again.
+func CloseArchive(filename string) {
+	archivesMu.Lock()
+	defer archivesMu.Unlock()
+	delete(archives, filename)
+}
+
+// CloseArchives drops every archive opened by OpenArchive from memory, see CloseArchive
+func CloseArchives() {
+	archivesMu.Lock()
+	defer archivesMu.Unlock()
+	archives = make(map[string]cachedArchive)
+}
+
+// tarToZip repacks a gzipped tar archive as an uncompressed zip archive
+func tarToZip(data []byte) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: hdr.ModTime})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(w, tr); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// OpenFS returns a directory or archive as an fs.FS.  A path inside an archive such as
+// "exports.zip/challenges" returns that directory of the archive.
+func OpenFS(dirname string) (fs.FS, error) {
+	if IsArchive(dirname) {
+		return OpenArchive(dirname)
+	}
+	if archive, entry := splitArchivePath(dirname); len(archive) > 0 {
+		fsys, err := OpenArchive(archive)
+		if err != nil {
+			return nil, err
+		}
+		return fs.Sub(fsys, entry)
+	}
+	return os.DirFS(dirname), nil
+}
+
+// ReadFileFS reads a file from a file system
+func ReadFileFS(fsys fs.FS, name string) []byte {
+	data, err := fs.ReadFile(fsys, name)
+	check("readFile", err)
+	return data
+}
+
+// ListFilesFS lists the files in a directory of a file system sorted by name
+func ListFilesFS(fsys fs.FS, dir string) []os.FileInfo {
+	entries, err := fs.ReadDir(fsys, dir)
+	check("listdir", err)
+	files := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		fi, err := entry.Info()
+		check("listdir", err)
+		files = append(files, fi)
+	}
+	return files
+}
+
+// KcodeFiles lists the .kcode files in a file system, including those in subdirectories,
+// as paths relative to its root in lexical order
+func KcodeFiles(fsys fs.FS) []string {
+	names := make([]string, 0)
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && path.Ext(name) == ".kcode" {
+			names = append(names, name)
+		}
+		return nil
+	})
+	check("kcodeFiles", err)
+	sort.Strings(names)
+	return names
+}
+
+// EachKcodeFile calls fn with the name and contents of every .kcode file in a directory or archive.
+// Only the top level of a directory is read, whereas the whole of an archive is since exports
+// keep their creations in subdirectories.  Files in a directory are named by their path and
+// files in an archive by their name inside it.
+func EachKcodeFile(dirname string, fn func(filename string, data []byte)) error {
+	fsys, err := OpenFS(dirname)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0)
+	if IsArchive(dirname) {
+		names = KcodeFiles(fsys)
+	} else {
+		entries, err := fs.ReadDir(fsys, ".")
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() && path.Ext(entry.Name()) == ".kcode" {
+				names = append(names, entry.Name())
+			}
+		}
+	}
+	for _, name := range names {
+		filename := name
+		if !IsArchive(dirname) {
+			filename = dirname + "/" + name
+		}
+		fn(filename, ReadFileFS(fsys, name))
+	}
+	return nil
+}
+
+// splitArchivePath splits a path that goes through an archive, e.g. "exports.zip/001.kcode",
+// into the archive and the name of the entry.  The archive is empty if there is none.
+func splitArchivePath(filename string) (archive string, entry string) {
+	slashed := filepath.ToSlash(filename)
+	for i := 0; i < len(slashed); i++ {
+		if slashed[i] != '/' || !IsArchive(slashed[:i]) {
+			continue
+		}
+		if fi, err := os.Stat(filepath.FromSlash(slashed[:i])); err == nil && fi.Mode().IsRegular() {
+			return filepath.FromSlash(slashed[:i]), strings.Trim(path.Clean(slashed[i+1:]), "/")
+		}
+	}
+	return "", ""
+}
+
+// statFile stats a file on disk or inside an archive.  Paths that do not go through an
+// archive are left to os.Stat so that names such as ".." and "/" work as they always have.
+func statFile(filename string) (os.FileInfo, error) {
+	if archive, entry := splitArchivePath(filename); len(archive) > 0 {
+		fsys, err := OpenArchive(archive)
+		if err != nil {
+			return nil, err
+		}
+		return fs.Stat(fsys, entry)
+	}
+	return os.Stat(filename)
+}
+
+// readFile reads a file on disk or inside an archive, see statFile
+func readFile(filename string) ([]byte, error) {
+	if archive, entry := splitArchivePath(filename); len(archive) > 0 {
+		fsys, err := OpenArchive(archive)
+		if err != nil {
+			return nil, err
+		}
+		return fs.ReadFile(fsys, entry)
+	}
+	return ioutil.ReadFile(filename)
+}
@@ -0,0 +1,134 @@
+package kcode
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeArchives writes the challenges into a zip and a tar.gz archive under the
+// "challenges" directory and returns the paths of the archives
+func writeArchives(t *testing.T) (string, string) {
+	dir := t.TempDir()
+	zipname := filepath.Join(dir, "exports.zip")
+	tgzname := filepath.Join(dir, "exports.tar.gz")
+	zf, err := os.Create(zipname)
+	assert.Nil(t, err)
+	zw := zip.NewWriter(zf)
+	tf, err := os.Create(tgzname)
+	assert.Nil(t, err)
+	gz := gzip.NewWriter(tf)
+	tw := tar.NewWriter(gz)
+	for _, f := range ListFilesInDirectory("challenges") {
+		data := ReadFile("challenges/" + f.Name())
+		w, err := zw.Create("challenges/" + f.Name())
+		assert.Nil(t, err)
+		w.Write(data)
+		assert.Nil(t, tw.WriteHeader(&tar.Header{Name: "./challenges/" + f.Name(), Mode: 0644, Size: int64(len(data))}))
+		tw.Write(data)
+	}
+	assert.Nil(t, zw.Close())
+	assert.Nil(t, zf.Close())
+	assert.Nil(t, tw.Close())
+	assert.Nil(t, gz.Close())
+	assert.Nil(t, tf.Close())
+	return zipname, tgzname
+}
+
+func TestArchives(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	files := ListFilesInDirectory("challenges")
+	zipname, tgzname := writeArchives(t)
+	for _, archive := range []string{zipname, tgzname} {
+		assert.True(t, IsArchive(archive))
+		assert.True(t, IsDirectory(archive))
+		assert.True(t, IsDirectory(archive+"/challenges"))
+		assert.Equal(t, len(files), len(ListFilesInDirectory(archive+"/challenges")))
+
+		fsys, err := OpenFS(archive)
+		assert.Nil(t, err)
+		names := KcodeFiles(fsys)
+		assert.Equal(t, len(files), len(names))
+		assert.Equal(t, "challenges/"+files[0].Name(), names[0])
+		assert.Equal(t, ReadFile("challenges/"+files[0].Name()), ReadFileFS(fsys, names[0]))
+
+		filename := archive + "/" + names[0]
+		assert.True(t, ExistsFile(filename))
+		assert.False(t, ExistsFile(archive+"/nothing.kcode"))
+		assert.False(t, IsDirectory(filename))
+		assert.True(t, ValidateFile(filename, false).Valid, filename)
+	}
+	_, err := OpenArchive("challenges")
+	assert.Equal(t, errNotArchive, err)
+}
+
+func TestKcodeFilesDirectory(t *testing.T) {
+	fsys, err := OpenFS("challenges")
+	assert.Nil(t, err)
+	assert.Equal(t, len(ListFilesInDirectory("challenges")), len(KcodeFiles(fsys)))
+}
+
+func TestEachKcodeFile(t *testing.T) {
+	dir := t.TempDir()
+	data := ReadFile("challenges/001_colovaria.kcode")
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, "old"), 0755))
+	for _, name := range []string{"b.kcode", "a.kcode", "notes.txt", "old/c.kcode"} {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, name), data, 0644))
+	}
+	// Subdirectories of a directory are left alone
+	names := make([]string, 0)
+	assert.Nil(t, EachKcodeFile(dir, func(filename string, _ []byte) {
+		names = append(names, filename)
+	}))
+	assert.Equal(t, []string{dir + "/a.kcode", dir + "/b.kcode"}, names)
+	// but the whole of an archive is read
+	zipname, _ := writeArchives(t)
+	count := 0
+	assert.Nil(t, EachKcodeFile(zipname, func(filename string, _ []byte) {
+		count++
+	}))
+	assert.Equal(t, len(ListFilesInDirectory("challenges")), count)
+	CloseArchives()
+}
+
+func TestPlainPaths(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	abs, err := filepath.Abs("challenges")
+	assert.Nil(t, err)
+	for _, dir := range []string{"..", "/", abs, abs + "/"} {
+		assert.True(t, ExistsFile(dir), dir)
+		assert.True(t, IsDirectory(dir), dir)
+	}
+	files := ListFilesInDirectory(abs)
+	assert.Equal(t, len(ListFilesInDirectory("challenges")), len(files))
+	filename := filepath.Join(abs, files[0].Name())
+	assert.False(t, IsDirectory(filename))
+	assert.Equal(t, ReadFile("challenges/"+files[0].Name()), ReadFile(filename))
+	assert.Equal(t, ReadFile(filename), ReadFile("../kcode/challenges/"+files[0].Name()))
+	assert.False(t, ExistsFile(filepath.Join(abs, "nothing.kcode")))
+}
+
+func TestCloseArchives(t *testing.T) {
+	zipname, tgzname := writeArchives(t)
+	for _, archive := range []string{zipname, tgzname} {
+		_, err := OpenArchive(archive)
+		assert.Nil(t, err)
+		assert.Contains(t, archives, archive)
+	}
+	CloseArchive(zipname)
+	assert.NotContains(t, archives, zipname)
+	assert.Contains(t, archives, tgzname)
+	CloseArchives()
+	assert.Empty(t, archives)
+	// A closed archive is read again when it is next used
+	assert.True(t, IsDirectory(zipname+"/challenges"))
+	assert.Contains(t, archives, zipname)
+	CloseArchives()
+}
@@ -0,0 +1,158 @@
+package kcode
+
+// handlers.go
+// -----------
+// Description:
+// What each event handler of a creation does.  A handler is a top level events_ block,
+// e.g. events_onGesture for a spell, and its actions are the statement blocks in its
+// CALLBACK, following next links through each stack and into the statement inputs of
+// blocks such as repeat_x_times.  Each action is described by its block type and the
+// values of its fields and inputs, e.g.
+//   reducio → objects_scale(shrink, Pumpkin3, 15)
+// Disabled blocks are left out since they never run.
+//
+// API:
+// Handlers(prog *Program) []Handler
+// ExtractHandlers(jsdata []byte) ([]Handler, error)
+// (h Handler) Name() string
+// (h Handler) String() string
+// (a Action) String() string
+//
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Handler is an event handler along with the actions it triggers in the order they appear.
+// Trigger is the value of the TYPE field of the event, e.g. the spell of events_onGesture
+// or the direction of events_onFlick, and is empty for events without one.
+type Handler struct {
+	Event   string   `json:"event"`
+	Trigger string   `json:"trigger,omitempty"`
+	BlockId string   `json:"blockId"`
+	Path    string   `json:"path"`
+	Actions []Action `json:"actions"`
+}
+
+// Action is a statement block run by a handler.  Args are the values of its fields then
+// its value inputs.  Depth counts the statement inputs the action is nested in below the
+// handler, so the body of a repeat_x_times in the handler is at depth 1.
+type Action struct {
+	BlockId string   `json:"blockId"`
+	Type    string   `json:"type"`
+	Args    []string `json:"args"`
+	Depth   int      `json:"depth"`
+	Path    string   `json:"path"`
+}
+
+// Handlers returns the enabled event handlers of a program in document order
+func Handlers(prog *Program) []Handler {
+	handlers := make([]Handler, 0)
+	eachHandlerBlock(prog, func(b *Block, trigger string, path string) {
+		h := Handler{Event: b.Type, Trigger: trigger, BlockId: b.Id, Path: path, Actions: make([]Action, 0)}
+		for _, in := range b.Statements {
+			if in.Block != nil {
+				h.Actions = appendActions(h.Actions, in.Block, 0, fmt.Sprintf("%s/statement[%s]/block", h.Path, in.Name))
+			}
+		}
+		handlers = append(handlers, h)
+	})
+	return handlers
+}
+
+// eachHandlerBlock calls fn for the enabled top level events_ blocks in document order
+func eachHandlerBlock(prog *Program, fn func(b *Block, trigger string, path string)) {
+	for i, b := range prog.Blocks {
+		if !strings.HasPrefix(b.Type, "events_") || b.Disabled {
+			continue
+		}
+		trigger, _ := b.Field("TYPE")
+		fn(b, strings.TrimSpace(trigger), fmt.Sprintf("/block[%d]", i+1))
+	}
+}
+
+// ExtractHandlers extracts the event handlers from .kcode JSON
+func ExtractHandlers(jsdata []byte) ([]Handler, error) {
+	prog, err := ExtractProgram(jsdata)
+	if err != nil {
+		return nil, err
+	}
+	return Handlers(prog), nil
+}
+
+// Name is the spell for a spell handler, otherwise the event along with its trigger if it has one
+func (h Handler) Name() string {
+	return handlerName(h.Event, h.Trigger)
+}
+
+// String renders the handler on a single line e.g. "reducio → objects_scale(shrink, Pumpkin3, 15)"
+func (h Handler) String() string {
+	actions := make([]string, 0, len(h.Actions))
+	for _, a := range h.Actions {
+		actions = append(actions, a.String())
+	}
+	return fmt.Sprintf("%s → %s", h.Name(), strings.Join(actions, ", "))
+}
+
+// String renders the action as a call e.g. "objects_scale(shrink, Pumpkin3, 15)"
+func (a Action) String() string {
+	return fmt.Sprintf("%s(%s)", a.Type, strings.Join(a.Args, ", "))
+}
+
+func handlerName(event string, trigger string) string {
+	switch {
+	case event == "events_onGesture" && len(trigger) > 0:
+		return trigger
+	case len(trigger) > 0:
+		return fmt.Sprintf("%s(%s)", event, trigger)
+	}
+	return event
+}
+
+// appendActions appends the enabled blocks of a stack along with the stacks nested in their statement inputs
+func appendActions(actions []Action, b *Block, depth int, path string) []Action {
+	for b != nil {
+		if !b.Disabled {
+			actions = append(actions, Action{BlockId: b.Id, Type: b.Type, Args: blockArgs(b), Depth: depth, Path: path})
+			for _, in := range b.Statements {
+				if in.Block != nil {
+					actions = appendActions(actions, in.Block, depth+1, fmt.Sprintf("%s/statement[%s]/block", path, in.Name))
+				}
+			}
+		}
+		if b.Next == nil {
+			break
+		}
+		b = b.Next.Block
+		path += "/next/block"
+	}
+	return actions
+}
+
+// blockArgs describes the fields then the value inputs of a block
+func blockArgs(b *Block) []string {
+	args := make([]string, 0, len(b.Fields)+len(b.Values))
+	for _, f := range b.Fields {
+		args = append(args, strings.TrimSpace(f.Value))
+	}
+	for i := range b.Values {
+		args = append(args, describeValue(b.Values[i].Target()))
+	}
+	return args
+}
+
+// describeValue renders a value block: its field for a literal such as math_number or
+// objects_get, its type for a block with neither fields nor inputs such as random_colour,
+// otherwise its type with its arguments e.g. math_arithmetic(ADD, 1, 2)
+func describeValue(b *Block) string {
+	switch {
+	case b == nil:
+		return ""
+	case len(b.Values) == 0 && len(b.Fields) == 1:
+		return strings.TrimSpace(b.Fields[0].Value)
+	case len(b.Values) == 0 && len(b.Fields) == 0:
+		return b.Type
+	}
+	return fmt.Sprintf("%s(%s)", b.Type, strings.Join(blockArgs(b), ", "))
+}
@@ -0,0 +1,74 @@
+package kcode
+
+import (
+	"io/ioutil"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandlers(t *testing.T) {
+	prog, err := ParseProgram([]byte(`<xml><block type="events_onGesture" id="a"><field name="TYPE">reducio</field>
+		<statement name="CALLBACK"><block type="objects_scale" id="b"><field name="PROPORTION">shrink</field>
+		<value name="TARGET"><shadow type="objects_get" id="c"><field name="ID">all</field></shadow></value>
+		<value name="VALUE"><shadow type="math_number" id="d"><field name="NUM">50</field></shadow>
+		<block type="math_arithmetic" id="e"><field name="OP">MULTIPLY</field>
+		<value name="A"><shadow type="math_number" id="f"><field name="NUM">2</field></shadow></value>
+		<value name="B"><block type="wand_speed" id="g"></block></value></block></value>
+		<next><block type="repeat_x_times" id="h"><value name="N"><shadow type="math_number" id="i"><field name="NUM">3</field></shadow></value>
+		<statement name="DO"><block type="wand_vibrate" id="j"><field name="PATTERN">short</field>
+		<next><block type="objects_remove" id="k" disabled="true"></block></next></block></statement>
+		<next><block type="restart_code" id="l"></block></next>
+		</block></next></block></statement></block>
+		<block type="procedures_defnoreturn" id="m"><field name="NAME">helper</field></block>
+		<block type="events_onFlick" id="n"><field name="TYPE">up</field></block>
+		<block type="events_onAppStart" id="o" disabled="true"></block>
+		<block type="events_onAppStart" id="p"></block></xml>`))
+	assert.Nil(t, err)
+	handlers := Handlers(prog)
+	assert.Equal(t, 3, len(handlers))
+	h := handlers[0]
+	assert.Equal(t, "reducio", h.Name())
+	assert.Equal(t, "a", h.BlockId)
+	assert.Equal(t, []Action{
+		{BlockId: "b", Type: "objects_scale", Args: []string{"shrink", "all", "math_arithmetic(MULTIPLY, 2, wand_speed)"}, Depth: 0,
+			Path: "/block[1]/statement[CALLBACK]/block"},
+		{BlockId: "h", Type: "repeat_x_times", Args: []string{"3"}, Depth: 0,
+			Path: "/block[1]/statement[CALLBACK]/block/next/block"},
+		{BlockId: "j", Type: "wand_vibrate", Args: []string{"short"}, Depth: 1,
+			Path: "/block[1]/statement[CALLBACK]/block/next/block/statement[DO]/block"},
+		{BlockId: "l", Type: "restart_code", Args: []string{}, Depth: 0,
+			Path: "/block[1]/statement[CALLBACK]/block/next/block/next/block"},
+	}, h.Actions)
+	assert.Equal(t, "reducio → objects_scale(shrink, all, math_arithmetic(MULTIPLY, 2, wand_speed)), repeat_x_times(3), wand_vibrate(short), restart_code()", h.String())
+	assert.Equal(t, "events_onFlick(up)", handlers[1].Name())
+	assert.Empty(t, handlers[1].Actions)
+	assert.Equal(t, "events_onAppStart → ", handlers[2].String())
+}
+
+func TestExtractHandlers(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	handlers, err := ExtractHandlers(ReadFile("challenges/022_pumpkins.kcode"))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(handlers))
+	assert.Equal(t, "engorgio → objects_scale(grow, Pumpkin1, 50), objects_scale(grow, Pumpkin2, 100)", handlers[0].String())
+	assert.Equal(t, "reducio → objects_scale(shrink, Pumpkin3, 15)", handlers[1].String())
+	_, err = ExtractHandlers([]byte(`not json`))
+	assert.NotNil(t, err)
+	// Every spell in the challenges has a handler
+	for _, f := range ListFilesInDirectory("challenges") {
+		data := ReadFile("challenges/" + f.Name())
+		handlers, err := ExtractHandlers(data)
+		assert.Nil(t, err)
+		spells := 0
+		for _, h := range handlers {
+			if h.Event == "events_onGesture" {
+				spells++
+			}
+		}
+		_, _, _, foundSpells, err := extractWithIds(GetXML("challenges/"+f.Name()), false)
+		assert.Nil(t, err)
+		assert.Equal(t, len(foundSpells), spells, f.Name())
+	}
+}
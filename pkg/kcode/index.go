@@ -0,0 +1,287 @@
+package kcode
+
+// index.go
+// --------
+// Description:
+// Reverse index over a corpus of creations, answering questions like "which challenges
+// use wand_vibrate?" without parsing every file again.  For each file the index records
+// the ids of the blocks of each type, the spells, the parts and the scene.  Lookups give
+// the files and block ids where a block type, spell, part or scene appears.
+// The index is saved as JSON and updated incrementally: a file is only parsed again when
+// the SHA-256 of its contents changes.  An index covers one directory or archive.
+// Block types are indexed without their part prefix, so speaker2#speaker_play is found
+// under speaker_play, and each part is mapped to the blocks that use it.
+//
+// API:
+// NewIndex() *Index
+// LoadIndex(filename string) (*Index, error)
+// (ix *Index) Save(filename string) error
+// (ix *Index) Update(dirname string) (IndexStats, error)
+// (ix *Index) Add(filename string, data []byte)
+// (ix *Index) Lookup(kind string, name string) []Occurrence
+// (ix *Index) Keys(kind string) []string
+// CheckIndexKind(kind string) error
+//
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// indexVersion is bumped whenever the saved format or what gets indexed changes.
+// Indexes saved with another version are rebuilt.
+const indexVersion = 1
+
+// Kinds of key in the index
+const (
+	IndexBlock = "block"
+	IndexSpell = "spell"
+	IndexPart  = "part"
+	IndexScene = "scene"
+)
+
+var (
+	errUnknownIndexKind = errors.New("unknown index kind")
+)
+
+// Index is a reverse index of a corpus keyed by file name
+type Index struct {
+	Version int                     `json:"version"`
+	Root    string                  `json:"root"`
+	Files   map[string]*IndexedFile `json:"files"`
+}
+
+// IndexedFile is what the index knows about one file.
+// Blocks, Spells and Parts map each name to the ids of the blocks where it appears.
+// Error is set for files that could not be parsed so they are not retried until they change.
+type IndexedFile struct {
+	Hash   string              `json:"sha256"`
+	Blocks map[string][]string `json:"blocks"`
+	Spells map[string][]string `json:"spells"`
+	Parts  map[string][]string `json:"parts"`
+	Scene  string              `json:"scene"`
+	Error  string              `json:"error,omitempty"`
+}
+
+// Occurrence is a file containing an indexed name along with the ids of the blocks concerned.
+// BlockIds is empty for scenes.
+type Occurrence struct {
+	File     string   `json:"file"`
+	BlockIds []string `json:"blockIds,omitempty"`
+}
+
+// IndexStats counts what an Update did
+type IndexStats struct {
+	Added     int `json:"added"`
+	Updated   int `json:"updated"`
+	Removed   int `json:"removed"`
+	Unchanged int `json:"unchanged"`
+}
+
+// NewIndex returns an empty index
+func NewIndex() *Index {
+	return &Index{Version: indexVersion, Files: make(map[string]*IndexedFile)}
+}
+
+// LoadIndex reads an index saved by Save.  A missing file or one saved by another version
+// of kcode gives an empty index.
+func LoadIndex(filename string) (*Index, error) {
+	data, err := ioutil.ReadFile(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return NewIndex(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ix := NewIndex()
+	if err := json.Unmarshal(data, ix); err != nil {
+		return nil, fmt.Errorf("%s: %s", errInvalidJSON, err)
+	}
+	if ix.Version != indexVersion || ix.Files == nil {
+		return NewIndex(), nil
+	}
+	return ix, nil
+}
+
+// Save writes the index as JSON.  The file is replaced in one go so that a
+// reader never sees half an index.
+func (ix *Index) Save(filename string) error {
+	data, err := json.MarshalIndent(ix, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// Update brings the index up to date with the .kcode files in a directory or archive.
+// Files whose contents have not changed are skipped and files that have gone are removed.
+// Updating with a different directory starts the index again.
+func (ix *Index) Update(dirname string) (IndexStats, error) {
+	var stats IndexStats
+	if ix.Root != dirname {
+		ix.Root = dirname
+		ix.Files = make(map[string]*IndexedFile)
+	}
+	seen := make(map[string]bool)
+	err := EachKcodeFile(dirname, func(filename string, data []byte) {
+		seen[filename] = true
+		old, ok := ix.Files[filename]
+		switch {
+		case !ok:
+			stats.Added++
+		case old.Hash == hashContents(data):
+			stats.Unchanged++
+			return
+		default:
+			stats.Updated++
+		}
+		ix.Add(filename, data)
+	})
+	if err != nil {
+		return stats, err
+	}
+	for filename := range ix.Files {
+		if !seen[filename] {
+			delete(ix.Files, filename)
+			stats.Removed++
+		}
+	}
+	return stats, nil
+}
+
+// Add indexes the contents of a single file, replacing anything indexed under its name
+func (ix *Index) Add(filename string, data []byte) {
+	entry := &IndexedFile{
+		Hash:   hashContents(data),
+		Blocks: make(map[string][]string),
+		Spells: make(map[string][]string),
+		Parts:  make(map[string][]string),
+	}
+	ix.Files[filename] = entry
+	prog, err := ExtractProgram(data)
+	if err == nil {
+		entry.Scene, err = ExtractScene(data)
+	}
+	var parts []string
+	if err == nil {
+		parts, err = ExtractParts(data)
+	}
+	if err != nil {
+		entry.Error = err.Error()
+		return
+	}
+	for _, part := range parts {
+		entry.Parts[part] = []string{}
+	}
+	eachBlock(prog, func(b *Block) {
+		blockType := b.Type
+		if i := strings.Index(blockType, "#"); i >= 0 {
+			part := blockType[:i]
+			entry.Parts[part] = append(entry.Parts[part], b.Id)
+			blockType = blockType[i+1:]
+		}
+		entry.Blocks[blockType] = append(entry.Blocks[blockType], b.Id)
+		if b.Type == "events_onGesture" {
+			if spell, ok := b.Field("TYPE"); ok {
+				entry.Spells[spell] = append(entry.Spells[spell], b.Id)
+			}
+		}
+	})
+}
+
+// Lookup returns the files where a block type, spell, part or scene appears in file name order
+func (ix *Index) Lookup(kind string, name string) []Occurrence {
+	occurrences := make([]Occurrence, 0)
+	for _, filename := range ix.fileNames() {
+		entry := ix.Files[filename]
+		if kind == IndexScene {
+			if len(entry.Scene) > 0 && entry.Scene == name {
+				occurrences = append(occurrences, Occurrence{File: filename})
+			}
+			continue
+		}
+		if ids, ok := entry.names(kind)[name]; ok {
+			occurrences = append(occurrences, Occurrence{File: filename, BlockIds: ids})
+		}
+	}
+	return occurrences
+}
+
+// Keys returns every indexed name of a kind in sorted order
+func (ix *Index) Keys(kind string) []string {
+	keys := make(map[string]bool)
+	for _, entry := range ix.Files {
+		if kind == IndexScene {
+			if len(entry.Scene) > 0 {
+				keys[entry.Scene] = true
+			}
+			continue
+		}
+		for name := range entry.names(kind) {
+			keys[name] = true
+		}
+	}
+	list := make([]string, 0, len(keys))
+	for name := range keys {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// CheckIndexKind returns an error unless kind is one of the index kinds
+func CheckIndexKind(kind string) error {
+	switch kind {
+	case IndexBlock, IndexSpell, IndexPart, IndexScene:
+		return nil
+	}
+	return fmt.Errorf("%w '%s': expected %s, %s, %s or %s", errUnknownIndexKind, kind, IndexBlock, IndexSpell, IndexPart, IndexScene)
+}
+
+func (entry *IndexedFile) names(kind string) map[string][]string {
+	switch kind {
+	case IndexBlock:
+		return entry.Blocks
+	case IndexSpell:
+		return entry.Spells
+	case IndexPart:
+		return entry.Parts
+	}
+	return nil
+}
+
+func (ix *Index) fileNames() []string {
+	names := make([]string, 0, len(ix.Files))
+	for filename := range ix.Files {
+		names = append(names, filename)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func hashContents(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
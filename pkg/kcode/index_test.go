@@ -0,0 +1,82 @@
+package kcode
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func occurrenceFiles(occurrences []Occurrence) []string {
+	files := make([]string, 0, len(occurrences))
+	for _, o := range occurrences {
+		files = append(files, o.File)
+	}
+	return files
+}
+
+func TestIndex(t *testing.T) {
+	ix := NewIndex()
+	stats, err := ix.Update("challenges")
+	assert.Nil(t, err)
+	assert.Equal(t, len(ListFilesInDirectory("challenges")), stats.Added)
+	assert.Contains(t, occurrenceFiles(ix.Lookup(IndexBlock, "wand_vibrate")), "challenges/020_big_beans.kcode")
+	assert.Contains(t, occurrenceFiles(ix.Lookup(IndexScene, "puzzle022")), "challenges/1022_pumpkins.kcode")
+	assert.Contains(t, ix.Keys(IndexBlock), "objects_scale")
+	assert.Empty(t, ix.Lookup(IndexSpell, "avadaKedavra"))
+
+	spells := ix.Lookup(IndexSpell, "engorgio")
+	assert.Contains(t, occurrenceFiles(spells), "challenges/1022_pumpkins.kcode")
+	prog, _ := GetProgram("challenges/1022_pumpkins.kcode")
+	matches, _ := Query(prog, "events_onGesture[TYPE=engorgio]")
+	for _, o := range spells {
+		if o.File == "challenges/1022_pumpkins.kcode" {
+			assert.Equal(t, []string{matches[0].Block.Id}, o.BlockIds)
+		}
+	}
+
+	// Part blocks are indexed under the type without the part prefix and under the part
+	parts := ix.Lookup(IndexPart, "speaker")
+	assert.Contains(t, occurrenceFiles(parts), "challenges/020_big_beans.kcode")
+	assert.NotEmpty(t, ix.Lookup(IndexBlock, "speaker_play"))
+
+	assert.NotNil(t, CheckIndexKind("blocks"))
+	assert.Nil(t, CheckIndexKind(IndexScene))
+}
+
+func TestIndexIncremental(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"009_accio.kcode", "1022_pumpkins.kcode", "020_big_beans.kcode"} {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, name), ReadFile("challenges/"+name), 0644))
+	}
+	indexfile := filepath.Join(dir, "index.json")
+	ix, err := LoadIndex(indexfile)
+	assert.Nil(t, err)
+	stats, err := ix.Update(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, IndexStats{Added: 3}, stats)
+	assert.Nil(t, ix.Save(indexfile))
+
+	// Change one file, remove another and add a broken one
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "009_accio.kcode"), ReadFile("challenges/001_colovaria.kcode"), 0644))
+	assert.Nil(t, os.Remove(filepath.Join(dir, "020_big_beans.kcode")))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "broken.kcode"), []byte("not json"), 0644))
+
+	ix, err = LoadIndex(indexfile)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(ix.Files))
+	stats, err = ix.Update(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, IndexStats{Added: 1, Updated: 1, Removed: 1, Unchanged: 1}, stats)
+	assert.Empty(t, ix.Lookup(IndexSpell, "accio"))
+	assert.Empty(t, ix.Lookup(IndexPart, "speaker"))
+	assert.NotEmpty(t, ix.Files[dir+"/broken.kcode"].Error)
+
+	// An index from another version is rebuilt
+	assert.Nil(t, ioutil.WriteFile(indexfile, []byte(`{"version": 0, "files": {}}`), 0644))
+	ix, err = LoadIndex(indexfile)
+	assert.Nil(t, err)
+	assert.Empty(t, ix.Files)
+}
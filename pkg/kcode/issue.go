@@ -0,0 +1,113 @@
+package kcode
+
+// issue.go
+// --------
+// Description:
+// Common type for problems found when checking a creation plus "did you mean"
+// suggestions for names that aren't recognised.
+//
+// API:
+// (i Issue) String() string
+// Suggest(name string, candidates []string) []string
+//
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// maxSuggestions caps the number of "did you mean" suggestions returned
+const maxSuggestions = 3
+
+// Issue describes a single problem found in a creation.
+// Kind is a short machine readable tag such as "unknown-scene".
+// Path locates the block in the XML tree, see eachBlockPath.
+type Issue struct {
+	Kind        string   `json:"kind"`
+	BlockId     string   `json:"blockId,omitempty"`
+	BlockType   string   `json:"blockType,omitempty"`
+	Path        string   `json:"path,omitempty"`
+	Message     string   `json:"message"`
+	Suggestions []string `json:"suggestions,omitempty"`
+}
+
+// String renders the issue on a single line
+func (i Issue) String() string {
+	str := fmt.Sprintf("[%s] %s", i.Kind, i.Message)
+	if len(i.BlockId) > 0 {
+		str += fmt.Sprintf(" (block %s id=%s)", i.BlockType, i.BlockId)
+	}
+	if len(i.Path) > 0 {
+		str += fmt.Sprintf(" at %s", i.Path)
+	}
+	return str + i.didYouMean()
+}
+
+// didYouMean renders the suggestions, if any, as " - did you mean 'a', 'b'?"
+func (i Issue) didYouMean() string {
+	if len(i.Suggestions) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" - did you mean '%s'?", strings.Join(i.Suggestions, "', '"))
+}
+
+// Suggest returns the candidates closest to name by edit distance, closest first.
+// Only candidates within a third of the length of name (and at least 2 edits) are returned.
+func Suggest(name string, candidates []string) []string {
+	type match struct {
+		candidate string
+		distance  int
+	}
+	limit := len(name) / 3
+	if limit < 2 {
+		limit = 2
+	}
+	lname := strings.ToLower(name)
+	matches := make([]match, 0)
+	for _, c := range candidates {
+		d := editDistance(lname, strings.ToLower(c))
+		if d <= limit && c != name {
+			matches = append(matches, match{c, d})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].distance < matches[j].distance
+	})
+	suggestions := make([]string, 0)
+	for i, m := range matches {
+		if i == maxSuggestions {
+			break
+		}
+		suggestions = append(suggestions, m.candidate)
+	}
+	return suggestions
+}
+
+// editDistance is the Levenshtein distance between a and b
+func editDistance(a string, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
@@ -0,0 +1,91 @@
+package kcode
+
+// junit.go
+// --------
+// Description:
+// JUnit XML output for validation reports so that CI pipelines can show one
+// test case per .kcode file.  Parser errors are written as <error>, every other
+// discrepancy as a <failure> and warnings go to <system-out>.
+//
+// API:
+// WriteJUnit(w io.Writer, suite string, reports []*ValidationReport) error
+//
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Errors   int             `xml:"errors,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Failure   *junitProblem `xml:"failure,omitempty"`
+	Error     *junitProblem `xml:"error,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitProblem struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Details string `xml:",chardata"`
+}
+
+// WriteJUnit writes the reports as a JUnit XML test suite with one test case per file
+func WriteJUnit(w io.Writer, suite string, reports []*ValidationReport) error {
+	ts := junitTestSuite{Name: suite, Tests: len(reports), Cases: make([]junitTestCase, 0, len(reports))}
+	for _, report := range reports {
+		tc := junitTestCase{Name: report.File, ClassName: suite}
+		if len(report.Discrepancies) > 0 {
+			details := make([]string, 0, len(report.Discrepancies))
+			for _, issue := range report.Discrepancies {
+				details = append(details, issue.String())
+			}
+			first := report.Discrepancies[0]
+			problem := &junitProblem{
+				Message: fmt.Sprintf("%d discrepancies, first: %s", len(report.Discrepancies), first.Message),
+				Type:    first.Kind,
+				Details: strings.Join(details, "\n"),
+			}
+			if first.Kind == KindParserError {
+				tc.Error = problem
+				ts.Errors++
+			} else {
+				tc.Failure = problem
+				ts.Failures++
+			}
+		}
+		if len(report.Warnings) > 0 {
+			warnings := make([]string, 0, len(report.Warnings))
+			for _, issue := range report.Warnings {
+				warnings = append(warnings, "warning: "+issue.String())
+			}
+			tc.SystemOut = strings.Join(warnings, "\n")
+		}
+		ts.Cases = append(ts.Cases, tc)
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(junitTestSuites{Suites: []junitTestSuite{ts}}); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,35 @@
+package kcode
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteJUnit(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	valid := ValidateFile("challenges/009_accio.kcode", false)
+	malformed := ValidateString([]byte(`not json`), false)
+	malformed.File = "broken.kcode"
+	parser := ValidateString([]byte(`{"source": "<xml><block type=\"events_onAppStart\"></block></xml>", "parts": [], "scene": "owlery"}`), false)
+	parser.File = "noid.kcode"
+
+	var buf bytes.Buffer
+	err := WriteJUnit(&buf, "kcode validate", []*ValidationReport{valid, malformed, parser})
+	assert.Nil(t, err)
+
+	var suites junitTestSuites
+	assert.Nil(t, xml.Unmarshal(buf.Bytes(), &suites))
+	suite := suites.Suites[0]
+	assert.Equal(t, 3, suite.Tests)
+	assert.Equal(t, 1, suite.Failures)
+	assert.Equal(t, 1, suite.Errors)
+	assert.Equal(t, "challenges/009_accio.kcode", suite.Cases[0].Name)
+	assert.Nil(t, suite.Cases[0].Failure)
+	assert.Equal(t, KindMalformed, suite.Cases[1].Failure.Type)
+	assert.Equal(t, KindParserError, suite.Cases[2].Error.Type)
+}
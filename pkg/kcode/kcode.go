@@ -10,14 +10,14 @@ package kcode
 // SpellCount(xml []byte) int
 // PartCount(kcode []string) int
 // SceneCount(kcode []byte) int
-// ValidateFile(filename string, verbose bool) (int,int,int,int,bool)
-// ValidateString(kcode []byte, verbose bool) (int,int,int,int,bool)
 // Extract(pblocks *[]string, jstr []byte, flags KCodeFlags, verbose bool) ([]string)
 // ExtractBlocks(jstr []byte, verbose bool) []string
 // ExtractSpells(jstr []byte, verbose bool) []string
+// ExtractVariables(jstr []byte, verbose bool) []string
 // ExtractXML(jsdata []byte) ([]byte, error)
 // ExtractParts(jsdata []byte) ([]string, error)
 // ExtractScene(jsdata []byte) (string, error)
+// (kc KCode) FormatVersion() string
 // DumpXML(kcode []byte, prettyPrint bool, verbose bool)
 // IsDirectory(filename string) bool
 // ExistsFile(filename string) bool
@@ -27,6 +27,8 @@ package kcode
 // GetXML(filename string) (kcode []byte)
 // ProcessKcodeFile(filename string, flags KCodeFlags, verbose bool) (spells []string, blocks []string, parts []string)
 // ProcessKcodeFileString(data []byte, flags KCodeFlags, verbose bool) (spells []string, blocks []string, parts []string, scene string)
+// ProcessKcodeReader(r io.Reader, flags KCodeFlags, verbose bool) (spells []string, blocks []string, parts []string, scene string, err error)
+// ProcessKcodeContents(data []byte, flags KCodeFlags, verbose bool) KCodeContents
 // InitLogging(verbose bool)
 //
 
@@ -35,10 +37,13 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"io/ioutil"
 	"os"
 	"reflect"
 	"regexp"
+	"strings"
 
 	xml2json "github.com/basgys/goxml2json"
 	"github.com/buger/jsonparser"
@@ -50,11 +55,25 @@ var (
 	errInvalidJSON = errors.New("invalid JSON")
 )
 
+// KCodeFlags says what to extract.  Variables and Fields are only used by ProcessKcodeContents.
 type KCodeFlags struct {
-	Blocks bool `json:"blocks"`
-	Spells bool `json:"spells"`
-	Scene  bool `json:"scene"`
-	Parts  bool `json:"parts"`
+	Blocks    bool `json:"blocks"`
+	Spells    bool `json:"spells"`
+	Scene     bool `json:"scene"`
+	Parts     bool `json:"parts"`
+	Variables bool `json:"variables"`
+	Fields    bool `json:"fields"`
+}
+
+// KCodeContents is what ProcessKcodeContents extracts from a .kcode file, with each
+// member filled in only when its flag is set
+type KCodeContents struct {
+	Spells    []string      `json:"spells,omitempty"`
+	Blocks    []string      `json:"blocks,omitempty"`
+	Parts     []string      `json:"parts,omitempty"`
+	Scene     string        `json:"scene,omitempty"`
+	Variables []Variable    `json:"variables,omitempty"`
+	Fields    []FieldRecord `json:"fields,omitempty"`
 }
 
 // Struct for Kano Code .kcode files
@@ -79,9 +98,10 @@ type KCodeLegacy struct {
 
 // KCode struct ...
 type KCode struct {
-	Source string      `json:"source"`
-	Parts  []KCodePart `json:"parts"`
-	Scene  string      `json:"scene"`
+	Source  string          `json:"source"`
+	Parts   []KCodePart     `json:"parts"`
+	Scene   string          `json:"scene"`
+	Version json.RawMessage `json:"version,omitempty"`
 }
 
 // Parts
@@ -91,11 +111,18 @@ type KCode struct {
 // "userStyle":{},"userProperties":{},"nonvolatileProperties":[],"position":{"x":54.444437662760414,"y":40.833333333333336},
 // "partType":"hardware","supportedHardware":[]}]
 type KCodePart struct {
-	Id       string `json:"id"`
-	Name     string `json:"name"`
-	Type     string `json:"type"`
-	Tag      string `json:"tagName"`
-	PartType string `json:"partType"`
+	Id                string   `json:"id"`
+	Name              string   `json:"name"`
+	Type              string   `json:"type"`
+	Tag               string   `json:"tagName"`
+	PartType          string   `json:"partType"`
+	SupportedHardware []string `json:"supportedHardware"`
+}
+
+// FormatVersion is the version of the .kcode format as text, which is "" for files without one.
+// Some apps write it as a number and others as a string.
+func (kc KCode) FormatVersion() string {
+	return strings.Trim(strings.TrimSpace(string(kc.Version)), `"`)
 }
 
 // ---------- Utils  ----------
@@ -107,7 +134,7 @@ func typeof(v interface{}) string {
 func check(err string, e error) {
 	if e != nil {
 		msg := fmt.Sprintf("%s ('%s')\n", err, e)
-		fmt.Printf(msg)
+		fmt.Print(msg)
 		log.Panic(err)
 		panic(e)
 	}
@@ -115,7 +142,8 @@ func check(err string, e error) {
 
 // ---------- Block and Spell handling  ----------
 
-// BlockCount counts the number of `<block` found in input kcode XML
+// BlockCount counts the number of `<block` found in input kcode XML.
+// The count functions are quick regex estimates.  See ValidateString for a structural check.
 func BlockCount(xml []byte) int {
 	r := regexp.MustCompile(`(<block)`)
 	res := r.FindAllStringSubmatch(string(xml), -1)
@@ -144,28 +172,6 @@ func SceneCount(kcode []byte) int {
 	return len(res)
 }
 
-// ValidateFile validates that the number of blocks and spells found matches expected counts
-func ValidateFile(filename string, verbose bool) (int, int, int, int, int, int, int, int, bool) {
-	log.Info(fmt.Sprintf("------- Reading file '%s' ------\n", filename))
-	filedata := ReadFile(filename)
-	xml := GetXML(filename)
-	return ValidateString(filedata, xml, verbose)
-}
-
-// ValidateString validates that the number of blocks and spells found matches expected counts
-func ValidateString(filedata []byte, kcode []byte, verbose bool) (int, int, int, int, int, int, int, int, bool) {
-	nexpectedblocks := BlockCount(kcode)
-	nexpectedspells := SpellCount(kcode)
-	nexpectedparts := PartCount(filedata)
-	nexpectedscene := SceneCount(filedata)
-	//fmt.Printf("%d %d %d %d\n", nexpectedblocks, nexpectedspells, nexpectedparts, nexpectedscene)
-	flags := KCodeFlags{Spells: true, Blocks: true, Parts: true, Scene: true}
-	spells, blocks, parts, scene := ProcessKcodeFileString(filedata, flags, verbose)
-	nfoundspells, nfoundblocks, nfoundparts, nfoundscene := len(spells), len(blocks), len(parts), len(scene)
-	isvalid := (nfoundblocks == nexpectedblocks) && (nfoundspells == nexpectedspells) && (nfoundparts == nexpectedparts)
-	return nexpectedspells, nfoundspells, nexpectedblocks, nfoundblocks, nexpectedparts, nfoundparts, nexpectedscene, nfoundscene, isvalid
-}
-
 func dumpString(str string, verbose bool) {
 	log.Info(str)
 	if verbose {
@@ -173,7 +179,8 @@ func dumpString(str string, verbose bool) {
 	}
 }
 
-func processBlock(pblocks *[]string, pvalue *[]byte, flags KCodeFlags, datatype jsonparser.ValueType, verbose bool) {
+// pids, when not nil, collects the id of each block or spell appended to *pblocks
+func processBlock(pblocks *[]string, pids *[]string, pvalue *[]byte, flags KCodeFlags, datatype jsonparser.ValueType, verbose bool) {
 	//fmt.Println(string(*pvalue))
 	t, _, _, err := jsonparser.Get(*pvalue, "-type")
 	check("extractType", err)
@@ -187,6 +194,9 @@ func processBlock(pblocks *[]string, pvalue *[]byte, flags KCodeFlags, datatype
 		dumpString(fmt.Sprintf("SPELL: type=%s, spell=%s, id=%s\n", string(t), spell, string(id)), verbose)
 		// Update *pblocks with spell
 		*pblocks = append(*pblocks, string(spell))
+		if pids != nil {
+			*pids = append(*pids, string(id))
+		}
 	}
 
 	parseBlock := func(t []byte, pblocks *[]string, value []byte) {
@@ -202,19 +212,22 @@ func processBlock(pblocks *[]string, pvalue *[]byte, flags KCodeFlags, datatype
 				string(t), string(id), string(x), string(y), len(statement), len(next), len(v), datatype), verbose)
 			// Update *pblocks
 			*pblocks = append(*pblocks, string(t))
+			if pids != nil {
+				*pids = append(*pids, string(id))
+			}
 		}
 		// We now need to recurse on any "statement", "next" or "value" keys found in this block
 		if len(statement) > 0 {
 			//log.Info(Sprintf("Found statement block:\n%s\n", string(statement)))
-			processValue(pblocks, &statement, flags, stdatatype, verbose)
+			processValue(pblocks, pids, &statement, flags, stdatatype, verbose)
 		}
 		if len(next) > 0 {
 			//log.Info(fmt.Sprintf("Found next block:\n%s\n", string(next)))
-			processValue(pblocks, &next, flags, ndatatype, verbose)
+			processValue(pblocks, pids, &next, flags, ndatatype, verbose)
 		}
 		if len(v) > 0 {
 			//log.Info(fmt.Sprintf("Found value block:\n%s\n", string(v)))
-			processValue(pblocks, &v, flags, vdatatype, verbose)
+			processValue(pblocks, pids, &v, flags, vdatatype, verbose)
 		}
 	}
 
@@ -236,7 +249,7 @@ func processBlock(pblocks *[]string, pvalue *[]byte, flags KCodeFlags, datatype
 	}
 }
 
-func processValue(pblocks *[]string, pvalue *[]byte, flags KCodeFlags, datatype jsonparser.ValueType, verbose bool) {
+func processValue(pblocks *[]string, pids *[]string, pvalue *[]byte, flags KCodeFlags, datatype jsonparser.ValueType, verbose bool) {
 	// See here for how to do a function within a function in Go:
 	// https://stackoverflow.com/questions/21961615/why-doesnt-go-allow-nested-function-declarations-functions-inside-functions
 	parseVal := func(value []byte) {
@@ -254,23 +267,23 @@ func processValue(pblocks *[]string, pvalue *[]byte, flags KCodeFlags, datatype
 		// We now need to recurse on any "value" keys found in this block
 		if len(block) > 0 {
 			//log.Info(fmt.Sprintf("Found BLOCK in VALUE: %s\n",string(block)))
-			processBlock(pblocks, &block, flags, bdatatype, verbose)
+			processBlock(pblocks, pids, &block, flags, bdatatype, verbose)
 		}
 		if len(shadow) > 0 {
 			//log.Info(fmt.Sprintf("Found value block:\n%s\n", string(valueBlock)))
-			processValue(pblocks, &shadow, flags, shdatatype, verbose)
+			processValue(pblocks, pids, &shadow, flags, shdatatype, verbose)
 		}
 		if len(v) > 0 {
 			//log.Info(fmt.Sprintf("Found value block:\n%s\n", string(valueBlock)))
-			processValue(pblocks, &v, flags, vdatatype, verbose)
+			processValue(pblocks, pids, &v, flags, vdatatype, verbose)
 		}
 		if len(statement) > 0 {
 			//log.Info(fmt.Sprintf("Found statement block:\n%s\n", string(statementBlock)))
-			processValue(pblocks, &statement, flags, stdatatype, verbose)
+			processValue(pblocks, pids, &statement, flags, stdatatype, verbose)
 		}
 		if len(next) > 0 {
 			//log.Info(fmt.Sprintf("Found NEXT in VALUE:\n%s\n", string(next)))
-			processValue(pblocks, &next, flags, ndatatype, verbose)
+			processValue(pblocks, pids, &next, flags, ndatatype, verbose)
 		}
 	}
 
@@ -288,6 +301,11 @@ func processValue(pblocks *[]string, pvalue *[]byte, flags KCodeFlags, datatype
 
 // Extract is the main logic function to process input code
 func Extract(pblocks *[]string, jstr []byte, flags KCodeFlags, verbose bool) []string {
+	return extract(pblocks, nil, jstr, flags, verbose)
+}
+
+// extract is Extract which also collects the id of each block or spell found into *pids
+func extract(pblocks *[]string, pids *[]string, jstr []byte, flags KCodeFlags, verbose bool) []string {
 	//log.Info(fmt.Sprintf("%s,%s\n",string(jstr),typeof(jstr)))
 	// The top level input for kcode could contain:
 	// a. Single Object block
@@ -298,12 +316,12 @@ func Extract(pblocks *[]string, jstr []byte, flags KCodeFlags, verbose bool) []s
 	switch datatype {
 	case jsonparser.Object:
 		log.Info("---- extract: Top level single block ----")
-		processBlock(pblocks, &block, flags, datatype, verbose)
+		processBlock(pblocks, pids, &block, flags, datatype, verbose)
 	case jsonparser.Array:
 		log.Info("---- extract: Top level array of blocks ----")
 		// You can use `ArrayEach` helper to iterate items in block [item1, item2 .... itemN]
 		jsonparser.ArrayEach(jstr, func(block []byte, dataType jsonparser.ValueType, offset int, err error) {
-			processBlock(pblocks, &block, flags, datatype, verbose)
+			processBlock(pblocks, pids, &block, flags, datatype, verbose)
 		}, "xml", "block")
 	default:
 		log.Panic(fmt.Sprintf("extract - unknown datatype=%s", datatype))
@@ -311,6 +329,28 @@ func Extract(pblocks *[]string, jstr []byte, flags KCodeFlags, verbose bool) []s
 	return *pblocks
 }
 
+// processVariables appends the variables declared in <variables> to *pvars.
+// An empty <variables> element is converted to "" so there is nothing to do, and a
+// variable with no name gives "".
+func processVariables(pvars *[]Variable, jstr []byte, verbose bool) {
+	variable := func(value []byte) {
+		name, _, _, _ := jsonparser.Get(value, "#content")
+		id, _, _, _ := jsonparser.Get(value, "-id")
+		t, _, _, _ := jsonparser.Get(value, "-type")
+		dumpString(fmt.Sprintf("VARIABLE: name=%s, id=%s, type=%s\n", string(name), string(id), string(t)), verbose)
+		*pvars = append(*pvars, Variable{Type: string(t), Id: string(id), Name: string(name)})
+	}
+	value, datatype, _, _ := jsonparser.Get(jstr, "xml", "variables", "variable")
+	switch datatype {
+	case jsonparser.Object:
+		variable(value)
+	case jsonparser.Array:
+		jsonparser.ArrayEach(value, func(value []byte, dataType jsonparser.ValueType, offset int, err error) {
+			variable(value)
+		})
+	}
+}
+
 // ExtractBlocks extracts the blocks from input
 func ExtractBlocks(jstr []byte, verbose bool) []string {
 	blocks := make([]string, 0)
@@ -325,6 +365,17 @@ func ExtractSpells(jstr []byte, verbose bool) []string {
 	return Extract(&spells, jstr, flags, verbose)
 }
 
+// ExtractVariables extracts the names of the variables declared in input
+func ExtractVariables(jstr []byte, verbose bool) []string {
+	variables := make([]Variable, 0)
+	processVariables(&variables, jstr, verbose)
+	names := make([]string, 0, len(variables))
+	for _, v := range variables {
+		names = append(names, v.Name)
+	}
+	return names
+}
+
 // ExtractXML extracts the kcode from input
 func ExtractXML(jsdata []byte) ([]byte, error) {
 	var kc KCode
@@ -383,9 +434,12 @@ func DumpXML(xml []byte, prettyPrint bool, verbose bool) {
 
 // ---------- File handling  ----------
 
-// IsDirectory check whether the file is a directory
+// IsDirectory check whether the file is a directory.  Archives count as directories, see files.go.
 func IsDirectory(filename string) bool {
-	fi, err := os.Stat(filename)
+	if IsArchive(filename) && ExistsFile(filename) {
+		return true
+	}
+	fi, err := statFile(filename)
 	check("isDirectory", err)
 	directory := false
 	switch mode := fi.Mode(); {
@@ -404,26 +458,31 @@ func IsDirectory(filename string) bool {
 
 // ExistsFile check whether the file exists
 func ExistsFile(filename string) bool {
-	if _, err := os.Stat(filename); err != nil {
-		if os.IsNotExist(err) {
+	if _, err := statFile(filename); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
 			return false
 		}
 	}
 	return true
 }
 
-// ReadFile open and read file and return contents as a []byte
+// ReadFile open and read file and return contents as a []byte.  The file can be inside an archive.
 func ReadFile(filename string) (data []byte) {
-	data, err := ioutil.ReadFile(filename)
+	data, err := readFile(filename)
 	check("readFile", err)
 	return data
 }
 
-// ListFilesInDirectory list files in directory
+// ListFilesInDirectory list files in directory.  The directory can be an archive or inside one.
 func ListFilesInDirectory(dirname string) []os.FileInfo {
-	files, err := ioutil.ReadDir(dirname)
+	if archive, _ := splitArchivePath(dirname); len(archive) == 0 && !IsArchive(dirname) {
+		files, err := ioutil.ReadDir(dirname)
+		check("listdir", err)
+		return files
+	}
+	fsys, err := OpenFS(dirname)
 	check("listdir", err)
-	return files
+	return ListFilesFS(fsys, ".")
 }
 
 // GetParts extracts parts as array slice from file
@@ -454,8 +513,25 @@ func ProcessKcodeFile(filename string, flags KCodeFlags, verbose bool) (spells [
 	return
 }
 
+// ProcessKcodeReader process .kcode read from r, e.g. stdin or an HTTP request body, see ProcessKcodeFileString.
+// err is the error reading r, which can fail part way through.
+func ProcessKcodeReader(r io.Reader, flags KCodeFlags, verbose bool) (spells []string, blocks []string, parts []string, scene string, err error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, nil, nil, "", err
+	}
+	spells, blocks, parts, scene = ProcessKcodeFileString(data, flags, verbose)
+	return spells, blocks, parts, scene, nil
+}
+
 // ProcessKcodeFileString process .kcode in string and return []string of spells and/or blocks, []string of parts and string scene.
 func ProcessKcodeFileString(data []byte, flags KCodeFlags, verbose bool) (spells []string, blocks []string, parts []string, scene string) {
+	contents := ProcessKcodeContents(data, flags, verbose)
+	return contents.Spells, contents.Blocks, contents.Parts, contents.Scene
+}
+
+// ProcessKcodeContents process .kcode in string and return whatever flags asks for, including the declared variables and typed fields.
+func ProcessKcodeContents(data []byte, flags KCodeFlags, verbose bool) (contents KCodeContents) {
 	xml, _ := ExtractXML(data)
 	DumpXML(xml, true, verbose)
 	// Parse the XML and convert to JSON
@@ -472,9 +548,9 @@ func ProcessKcodeFileString(data []byte, flags KCodeFlags, verbose bool) (spells
 		// Extract blocks from JSON
 		//fmt.Printf("------- Extracting blocks from .kcode file '%s' ------\n", filename)
 		log.Info("------- Extracting blocks ------")
-		blocks = ExtractBlocks(jsn.Bytes(), verbose)
-		log.Info(fmt.Sprintf("--- Found %d blocks ---\n", len(blocks)))
-		for i, block := range blocks {
+		contents.Blocks = ExtractBlocks(jsn.Bytes(), verbose)
+		log.Info(fmt.Sprintf("--- Found %d blocks ---\n", len(contents.Blocks)))
+		for i, block := range contents.Blocks {
 			log.Info(fmt.Sprintf("%d] %s\n", i+1, block))
 		}
 	}
@@ -482,17 +558,32 @@ func ProcessKcodeFileString(data []byte, flags KCodeFlags, verbose bool) (spells
 		// Extract spells from JSON
 		//fmt.Printf("------- Extracting spells from .kcode file '%s' ------\n", filename)
 		log.Info("------- Extracting spells ------")
-		spells = ExtractSpells(jsn.Bytes(), verbose)
-		log.Info(fmt.Sprintf("--- Found %d spells ---\n", len(spells)))
-		for i, spell := range spells {
+		contents.Spells = ExtractSpells(jsn.Bytes(), verbose)
+		log.Info(fmt.Sprintf("--- Found %d spells ---\n", len(contents.Spells)))
+		for i, spell := range contents.Spells {
 			log.Info(fmt.Sprintf("%d] %s\n", i+1, spell))
 		}
 	}
+	if flags.Variables {
+		log.Info("------- Extracting variables ------")
+		contents.Variables = make([]Variable, 0)
+		processVariables(&contents.Variables, jsn.Bytes(), verbose)
+		log.Info(fmt.Sprintf("--- Found %d variables ---\n", len(contents.Variables)))
+	}
+	if flags.Fields {
+		log.Info("------- Extracting fields ------")
+		contents.Fields, _ = ExtractFields(data)
+		log.Info(fmt.Sprintf("--- Found %d fields ---\n", len(contents.Fields)))
+		for i, f := range contents.Fields {
+			dumpString(fmt.Sprintf("FIELD: type=%s, id=%s, field=%s, kind=%s, value=%v\n", f.BlockType, f.BlockId, f.Field, f.Kind, f.Value), verbose)
+			log.Info(fmt.Sprintf("%d] %s.%s=%v\n", i+1, f.BlockType, f.Field, f.Value))
+		}
+	}
 	if flags.Parts {
-		parts, _ = ExtractParts(data)
+		contents.Parts, _ = ExtractParts(data)
 	}
 	if flags.Scene {
-		scene, _ = ExtractScene(data)
+		contents.Scene, _ = ExtractScene(data)
 	}
 
 	return
@@ -1,10 +1,14 @@
 package kcode
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"path/filepath"
 	"testing"
+	"testing/iotest"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
@@ -143,6 +147,23 @@ func TestIndividualParts(t *testing.T) {
 	validateParts("challenges/020_big_beans.kcode", t, expecting, verbose)
 }
 
+func TestProcessKcodeReader(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	flags := KCodeFlags{Spells: true, Blocks: true, Parts: true, Scene: true}
+	filedata := ReadFile("challenges/1022_pumpkins.kcode")
+	spells, blocks, parts, scene, err := ProcessKcodeReader(bytes.NewReader(filedata), flags, false)
+	assert.Nil(t, err)
+	spells2, blocks2, parts2, scene2 := ProcessKcodeFileString(filedata, flags, false)
+	assert.Equal(t, spells2, spells)
+	assert.Equal(t, blocks2, blocks)
+	assert.Equal(t, parts2, parts)
+	assert.Equal(t, scene2, scene)
+	assert.Equal(t, []string{"engorgio", "reducio"}, spells)
+	// Reads can fail part way through, e.g. a dropped HTTP connection
+	_, _, _, _, err = ProcessKcodeReader(io.MultiReader(bytes.NewReader(filedata[:100]), iotest.ErrReader(errors.New("reset"))), flags, false)
+	assert.EqualError(t, err, "reset")
+}
+
 func TestValidateAllChallenges(t *testing.T) {
 	verbose := false
 	flags := KCodeFlags{Spells: true, Blocks: true, Parts: true, Scene: true}
@@ -0,0 +1,271 @@
+package kcode
+
+// kits.go
+// -------
+// Description:
+// Works out which Kano kit a creation is made for: the Harry Potter Wand, the Pixel Kit,
+// the Motion Sensor Kit or just the screen.  A creation uses a kit when it has
+// - an enabled block whose type starts with one of the block prefixes of the kit or is
+//   one of its block types, e.g. wand_vibrate or events_onGesture for the wand
+// - a part whose type is one of the parts of the kit
+// - a part listing one of the hardware ids of the kit in its supportedHardware
+// - a format version that only the app for the kit writes
+// Part block types such as speaker#speaker_play are matched without the part prefix.
+// A creation that uses no kit runs on the screen alone and gets the default kit.  Kits
+// work together if either lists the other as compatible, e.g. the Pixel Kit and the
+// Motion Sensor Kit.  Otherwise a creation using both is reported as mixing kits.
+// The default catalogue is embedded from kits.json and can be swapped for one loaded
+// from disk.  It lists no format versions as the versions each app writes are not
+// known, so only a catalogue loaded from disk can detect a kit by version.
+//
+// API:
+// ParseKitCatalogue(data []byte) (*KitCatalogue, error)
+// LoadKitCatalogue(filename string) (*KitCatalogue, error)
+// DefaultKitCatalogue() *KitCatalogue
+// SetKitCatalogue(catalogue *KitCatalogue)
+// (c *KitCatalogue) Lookup(id string) (Kit, bool)
+// (c *KitCatalogue) Detect(prog *Program, parts []KCodePart, version string) KitReport
+// DetectKits(prog *Program, parts []KCodePart, version string) KitReport
+// ExtractKits(jsdata []byte) (KitReport, error)
+// (c *KitCatalogue) Names(kits []string) string
+// KitNames(kits []string) string
+// (r KitReport) String() string
+//
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+//go:embed kits.json
+var defaultKitData []byte
+
+var (
+	errInvalidKitCatalogue = errors.New("invalid kit catalogue")
+	// kitCatalogue is the catalogue used by DetectKits and ExtractKits
+	kitCatalogue = DefaultKitCatalogue()
+)
+
+// Kit describes a kit and how to tell that a creation uses it
+type Kit struct {
+	Id            string   `json:"id"`
+	Name          string   `json:"name"`
+	BlockPrefixes []string `json:"blockPrefixes,omitempty"`
+	BlockTypes    []string `json:"blockTypes,omitempty"`
+	Parts         []string `json:"parts,omitempty"`
+	Hardware      []string `json:"hardware,omitempty"`
+	Versions      []string `json:"versions,omitempty"`
+	Compatible    []string `json:"compatible,omitempty"`
+}
+
+// KitCatalogue is the set of known kits along with the id of the kit for creations that use none
+type KitCatalogue struct {
+	Default string `json:"default"`
+	Kits    []Kit  `json:"kits"`
+	byId    map[string]Kit
+}
+
+// KitUse is something in a creation that needs a kit e.g. "block wand_vibrate" or "part lightboard"
+type KitUse struct {
+	Kit       string `json:"kit"`
+	What      string `json:"what"`
+	BlockId   string `json:"blockId,omitempty"`
+	BlockType string `json:"blockType,omitempty"`
+	Path      string `json:"path,omitempty"`
+}
+
+// KitReport gives the ids of the kits a creation uses in catalogue order along with the
+// first use of each thing that needs a kit.  Issues are the pairs of kits that do not work together.
+type KitReport struct {
+	Kits   []string `json:"kits"`
+	Uses   []KitUse `json:"uses"`
+	Issues []Issue  `json:"issues"`
+}
+
+// ParseKitCatalogue parses a kit catalogue from JSON
+func ParseKitCatalogue(data []byte) (*KitCatalogue, error) {
+	var c KitCatalogue
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, errInvalidKitCatalogue
+	}
+	c.byId = make(map[string]Kit)
+	for _, kit := range c.Kits {
+		if _, ok := c.byId[kit.Id]; ok || len(kit.Id) == 0 {
+			return nil, errInvalidKitCatalogue
+		}
+		if len(kit.Name) == 0 {
+			kit.Name = kit.Id
+		}
+		c.byId[kit.Id] = kit
+	}
+	if _, ok := c.byId[c.Default]; !ok {
+		return nil, errInvalidKitCatalogue
+	}
+	return &c, nil
+}
+
+// LoadKitCatalogue reads a kit catalogue from a JSON file on disk
+func LoadKitCatalogue(filename string) (*KitCatalogue, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKitCatalogue(data)
+}
+
+// DefaultKitCatalogue returns the embedded kit catalogue
+func DefaultKitCatalogue() *KitCatalogue {
+	c, err := ParseKitCatalogue(defaultKitData)
+	check("defaultKitCatalogue", err)
+	return c
+}
+
+// SetKitCatalogue replaces the catalogue used by DetectKits and ExtractKits.  Passing nil restores the default.
+func SetKitCatalogue(catalogue *KitCatalogue) {
+	if catalogue == nil {
+		catalogue = DefaultKitCatalogue()
+	}
+	kitCatalogue = catalogue
+	resetConfigHash()
+}
+
+// Lookup finds the kit with the given id
+func (c *KitCatalogue) Lookup(id string) (Kit, bool) {
+	kit, ok := c.byId[id]
+	return kit, ok
+}
+
+// Detect works out the kits used by a program along with the parts and format version of its file
+func (c *KitCatalogue) Detect(prog *Program, parts []KCodePart, version string) KitReport {
+	report := KitReport{Kits: make([]string, 0), Uses: make([]KitUse, 0), Issues: make([]Issue, 0)}
+	seen := make(map[string]bool)
+	use := func(kit *Kit, what string, b *Block, path string) {
+		if kit == nil || seen[kit.Id+" "+what] {
+			return
+		}
+		seen[kit.Id+" "+what] = true
+		u := KitUse{Kit: kit.Id, What: what, Path: path}
+		if b != nil {
+			u.BlockId, u.BlockType = b.Id, b.Type
+		}
+		report.Uses = append(report.Uses, u)
+	}
+	if len(version) > 0 {
+		use(c.find(func(k *Kit) bool { return containsString(k.Versions, version) }), "version "+version, nil, "/version")
+	}
+	for i, part := range parts {
+		path := fmt.Sprintf("/parts[%d]", i+1)
+		use(c.find(func(k *Kit) bool { return containsString(k.Parts, part.Type) }), "part "+part.Type, nil, path)
+		for _, hardware := range part.SupportedHardware {
+			use(c.find(func(k *Kit) bool { return containsString(k.Hardware, hardware) }), "hardware "+hardware, nil, path+"/supportedHardware")
+		}
+	}
+	eachEnabledBlockPath(prog, func(b *Block, path string) {
+		blockType := b.Type
+		if i := strings.Index(blockType, "#"); i >= 0 {
+			blockType = blockType[i+1:]
+		}
+		use(c.find(func(k *Kit) bool { return k.hasBlock(blockType) }), "block "+blockType, b, path)
+	})
+
+	first := make(map[string]KitUse)
+	for _, u := range report.Uses {
+		if _, ok := first[u.Kit]; !ok {
+			first[u.Kit] = u
+		}
+	}
+	for _, kit := range c.Kits {
+		if _, ok := first[kit.Id]; ok {
+			report.Kits = append(report.Kits, kit.Id)
+		}
+	}
+	for i, a := range report.Kits {
+		for _, b := range report.Kits[i+1:] {
+			if c.compatible(a, b) {
+				continue
+			}
+			ua, ub := first[a], first[b]
+			report.Issues = append(report.Issues, Issue{Kind: "mixed-kits", BlockId: ub.BlockId, BlockType: ub.BlockType, Path: ub.Path,
+				Message: fmt.Sprintf("%s is for the %s, which does not work with the %s used by %s", ub.What, c.Names([]string{b}), c.Names([]string{a}), ua.What)})
+		}
+	}
+	if len(report.Kits) == 0 {
+		report.Kits = append(report.Kits, c.Default)
+	}
+	return report
+}
+
+// DetectKits works out the kits used by a program using the current kit catalogue
+func DetectKits(prog *Program, parts []KCodePart, version string) KitReport {
+	return kitCatalogue.Detect(prog, parts, version)
+}
+
+// ExtractKits works out the kits used by .kcode JSON
+func ExtractKits(jsdata []byte) (KitReport, error) {
+	prog, err := ExtractProgram(jsdata)
+	if err != nil {
+		return KitReport{}, err
+	}
+	return detectFileKits(jsdata, prog)
+}
+
+// KitNames joins the names of kits in the current kit catalogue, see Names
+func KitNames(kits []string) string {
+	return kitCatalogue.Names(kits)
+}
+
+// Names joins the names of kits e.g. "Pixel Kit + Motion Sensor Kit".  Unknown ids are shown as they are.
+func (c *KitCatalogue) Names(kits []string) string {
+	names := make([]string, 0, len(kits))
+	for _, id := range kits {
+		if kit, ok := c.Lookup(id); ok {
+			names = append(names, kit.Name)
+		} else {
+			names = append(names, id)
+		}
+	}
+	return strings.Join(names, " + ")
+}
+
+// String renders the kits used e.g. "Harry Potter Wand"
+func (r KitReport) String() string {
+	return KitNames(r.Kits)
+}
+
+// detectFileKits works out the kits used by the program of .kcode JSON along with its parts and format version
+func detectFileKits(jsdata []byte, prog *Program) (KitReport, error) {
+	var kc KCode
+	if err := json.Unmarshal(jsdata, &kc); err != nil {
+		return KitReport{}, errInvalidJSON
+	}
+	return DetectKits(prog, kc.Parts, kc.FormatVersion()), nil
+}
+
+// find returns the first kit matching or nil if there isn't one
+func (c *KitCatalogue) find(match func(k *Kit) bool) *Kit {
+	for i := range c.Kits {
+		if match(&c.Kits[i]) {
+			return &c.Kits[i]
+		}
+	}
+	return nil
+}
+
+// compatible reports whether two kits work together
+func (c *KitCatalogue) compatible(a string, b string) bool {
+	ka, kb := c.byId[a], c.byId[b]
+	return a == c.Default || b == c.Default || containsString(ka.Compatible, b) || containsString(kb.Compatible, a)
+}
+
+func (k *Kit) hasBlock(blockType string) bool {
+	for _, prefix := range k.BlockPrefixes {
+		if strings.HasPrefix(blockType, prefix) {
+			return true
+		}
+	}
+	return containsString(k.BlockTypes, blockType)
+}
@@ -0,0 +1,100 @@
+package kcode
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKitCatalogue(t *testing.T) {
+	catalogue := DefaultKitCatalogue()
+	kit, ok := catalogue.Lookup("wand")
+	assert.True(t, ok)
+	assert.Equal(t, "Harry Potter Wand", kit.Name)
+	assert.Equal(t, "Pixel Kit + Motion Sensor Kit", catalogue.Names([]string{"pixel-kit", "motion-sensor"}))
+	assert.Equal(t, "Screen only + lego", catalogue.Names([]string{"screen", "lego"}))
+	for _, data := range []string{`not json`, `{"default": "screen", "kits": [{"id": "screen"}, {"id": "screen"}]}`,
+		`{"default": "screen", "kits": [{"name": "No id"}]}`, `{"default": "missing", "kits": [{"id": "screen"}]}`} {
+		_, err := ParseKitCatalogue([]byte(data))
+		assert.Equal(t, errInvalidKitCatalogue, err, data)
+	}
+}
+
+func TestDetectKits(t *testing.T) {
+	prog, err := ParseProgram([]byte(`<xml>
+		<block type="events_onGesture" id="a"><field name="TYPE">lumos</field><statement name="CALLBACK">
+		<block type="lightboard#lights_all" id="b"><next><block type="wand_vibrate" id="c"></block></next></block></statement></block>
+		<block type="motion_sensor_distance" id="d" disabled="true"></block>
+		</xml>`))
+	assert.Nil(t, err)
+	report := DetectKits(prog, nil, "")
+	assert.Equal(t, []string{"wand", "pixel-kit"}, report.Kits)
+	assert.Equal(t, "Harry Potter Wand + Pixel Kit", report.String())
+	assert.Equal(t, 3, len(report.Uses))
+	assert.Equal(t, KitUse{Kit: "pixel-kit", What: "block lights_all", BlockId: "b", BlockType: "lightboard#lights_all",
+		Path: "/block[1]/statement[CALLBACK]/block"}, report.Uses[1])
+	assert.Equal(t, []string{"mixed-kits"}, issueKinds(report.Issues))
+	assert.Equal(t, "block lights_all is for the Pixel Kit, which does not work with the Harry Potter Wand used by block events_onGesture",
+		report.Issues[0].Message)
+	assert.Equal(t, "b", report.Issues[0].BlockId)
+
+	// Parts and the hardware they support count too and the Pixel Kit works with the Motion Sensor Kit
+	parts := []KCodePart{{Id: "speaker", Type: "speaker"}, {Id: "sensor", Type: "motion-sensor", SupportedHardware: []string{"pixel-kit"}}}
+	empty, err := ParseProgram([]byte(`<xml></xml>`))
+	assert.Nil(t, err)
+	report = DetectKits(empty, parts, "")
+	assert.Equal(t, []string{"pixel-kit", "motion-sensor"}, report.Kits)
+	assert.Equal(t, []KitUse{{Kit: "motion-sensor", What: "part motion-sensor", Path: "/parts[2]"},
+		{Kit: "pixel-kit", What: "hardware pixel-kit", Path: "/parts[2]/supportedHardware"}}, report.Uses)
+	assert.Empty(t, report.Issues)
+
+	// A creation that uses no kit is for the screen
+	report = DetectKits(empty, parts[:1], "")
+	assert.Equal(t, []string{"screen"}, report.Kits)
+	assert.Empty(t, report.Uses)
+
+	// The format version can say which app wrote the file
+	catalogue, err := ParseKitCatalogue([]byte(`{"default": "screen", "kits": [{"id": "screen"}, {"id": "wand", "versions": ["2"]},
+		{"id": "pixel-kit", "parts": ["lightboard"]}]}`))
+	assert.Nil(t, err)
+	report = catalogue.Detect(empty, []KCodePart{{Type: "lightboard"}}, "2")
+	assert.Equal(t, []string{"wand", "pixel-kit"}, report.Kits)
+	assert.Equal(t, "part lightboard is for the pixel-kit, which does not work with the wand used by version 2", report.Issues[0].Message)
+	assert.Equal(t, "/parts[1]", report.Issues[0].Path)
+}
+
+func TestExtractKits(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	_, err := ExtractKits([]byte(`not json`))
+	assert.NotNil(t, err)
+	report, err := ExtractKits([]byte(`{"source": "<xml><block type=\"lights_all\" id=\"a\"></block></xml>", "version": 3,
+		"parts": [{"id": "wand", "type": "wand", "supportedHardware": ["wand"]}]}`))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"wand", "pixel-kit"}, report.Kits)
+	assert.Equal(t, "/block[1]", report.Issues[0].Path)
+	// The challenges are all made for the wand apart from a couple that only use the screen
+	screen := 0
+	for _, f := range ListFilesInDirectory("challenges") {
+		data := ReadFile("challenges/" + f.Name())
+		report, err := ExtractKits(data)
+		assert.Nil(t, err, f.Name())
+		assert.Empty(t, report.Issues, f.Name())
+		assert.Contains(t, [][]string{{"wand"}, {"screen"}}, report.Kits, f.Name())
+		if report.Kits[0] == "screen" {
+			screen++
+		}
+		assert.Equal(t, report.Kits, ValidateString(data, false).Kits, f.Name())
+	}
+	assert.Equal(t, 2, screen)
+}
+
+func TestFormatVersion(t *testing.T) {
+	for data, expected := range map[string]string{`{}`: "", `{"version": 3}`: "3", `{"version": "1.2.0"}`: "1.2.0"} {
+		var kc KCode
+		assert.Nil(t, json.Unmarshal([]byte(data), &kc))
+		assert.Equal(t, expected, kc.FormatVersion(), data)
+	}
+}
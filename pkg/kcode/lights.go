@@ -0,0 +1,557 @@
+package kcode
+
+// lights.go
+// ---------
+// Description:
+// Renders what a creation shows on the 16x8 lights of a Pixel Kit, or the light grid on
+// the screen, without the hardware, so that light creations can be previewed.  The
+// creation is simulated from when the app starts: events_onAppStart handlers run along
+// with the every_x_seconds and in_x_time timers at the top level.  Handlers waiting for
+// gestures, buttons or other input never run.  The light blocks draw on a 16x8 buffer
+// with 0, 0 being the top left light:
+//   lights_all(COLOR), lights_off(), lights_set(X, Y, COLOR),
+//   lights_rectangle(X, Y, WIDTH, HEIGHT, COLOR) and lights_scroll(DIRECTION)
+// Lights off the grid are left out and lights_scroll moves every light one place left,
+// right, up or down, wrapping round.  wait blocks, timers, loops, ifs, variables, unary
+// and procedure calls work as they do in the app with values worked out by Evaluate.
+// Variables start at 0 and a value only known at run time, such as a random colour, uses
+// the value in the shadow of its input instead.  Part blocks such as
+// lightboard#lights_all are run without the part prefix.
+// Code runs until it waits and time then moves on to the next thing waiting to run, so a
+// frame is what the lights show between two moments when time moves on.  Frames that
+// look the same as the one before are merged.  Code that keeps going for too long
+// without waiting is reported as busy, as the app would hang.
+// An animation can be written as a looping animated GIF or as a PNG sprite sheet with
+// the frames from left to right.
+//
+// API:
+// RenderLights(prog *Program, seconds float64) (*LightAnimation, error)
+// ExtractLights(jsdata []byte, seconds float64) (*LightAnimation, error)
+// (a *LightAnimation) WriteGIF(w io.Writer, scale int) error
+// (a *LightAnimation) WriteSpriteSheet(w io.Writer, scale int) error
+//
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Size of the Pixel Kit lights
+const (
+	LightsWidth  = 16
+	LightsHeight = 8
+)
+
+// maxLightSteps is how many blocks can run without time moving on before the code is busy
+const maxLightSteps = 100000
+
+// maxLightCalls is how deep procedure calls can go
+const maxLightCalls = 100
+
+// lightOff is the colour of a light that is off
+var lightOff = color.RGBA{A: 255}
+
+var (
+	errNoLights         = errors.New("creation has no light blocks")
+	errLightsBusy       = errors.New("code never waits")
+	errLightsDuration   = errors.New("duration must be more than 0 seconds")
+	errLightsRecursion  = errors.New("procedure calls go too deep")
+	errLightsScale      = errors.New("scale must be at least 1")
+	errLightsNoVariable = errors.New("variable has no number")
+)
+
+// Lights is what the 16x8 lights show, by row then column
+type Lights [LightsHeight][LightsWidth]color.RGBA
+
+// LightFrame is what the lights show from Start for Seconds
+type LightFrame struct {
+	Lights  Lights  `json:"-"`
+	Start   float64 `json:"start"`
+	Seconds float64 `json:"seconds"`
+}
+
+// LightAnimation is the frames shown by a creation in order
+type LightAnimation struct {
+	Frames []LightFrame `json:"frames"`
+}
+
+// lightSim simulates a creation.  Each thread of the creation runs in its own goroutine
+// but only one runs at a time, handing control back when it waits or ends.
+type lightSim struct {
+	procedures map[string]*Block
+	env        Env
+	lights     Lights
+	frames     []LightFrame
+	now        float64
+	end        float64
+	steps      int
+	threads    []*lightThread
+	yield      chan struct{}
+	err        error
+}
+
+// lightThread is a stack of code running until it waits or ends
+type lightThread struct {
+	wake   float64
+	calls  int
+	done   bool
+	resume chan bool
+}
+
+// stopThread stops a thread still waiting when the simulation ends
+type stopThread struct{}
+
+// RenderLights simulates the first seconds of a program and returns what its lights show
+func RenderLights(prog *Program, seconds float64) (*LightAnimation, error) {
+	if seconds <= 0 {
+		return nil, errLightsDuration
+	}
+	lights := false
+	eachEnabledBlockPath(prog, func(b *Block, path string) {
+		lights = lights || isLightBlock(b)
+	})
+	if !lights {
+		return nil, errNoLights
+	}
+	s := &lightSim{procedures: make(map[string]*Block), env: make(Env), end: seconds, yield: make(chan struct{})}
+	for _, p := range Procedures(prog) {
+		s.procedures[p.Name] = p.Block
+	}
+	for _, v := range prog.Variables {
+		s.env[v.Name] = Constant{Kind: FieldNumber, Value: 0.0}
+	}
+	s.fill(0, 0, LightsWidth, LightsHeight, lightOff)
+	s.frames = []LightFrame{{Lights: s.lights}}
+	for _, b := range prog.Blocks {
+		if b.Disabled {
+			continue
+		}
+		b := b
+		switch b.Type {
+		case "events_onAppStart":
+			s.spawn(0, func(t *lightThread) {
+				s.run(t, b.Input("CALLBACK").Target())
+			})
+		case "every_x_seconds", "in_x_time":
+			s.spawn(0, func(t *lightThread) {
+				s.step(t, b)
+			})
+		}
+	}
+	s.schedule()
+	if s.err != nil {
+		return nil, s.err
+	}
+	for i := range s.frames {
+		if i+1 < len(s.frames) {
+			s.frames[i].Seconds = s.frames[i+1].Start - s.frames[i].Start
+		} else {
+			s.frames[i].Seconds = s.end - s.frames[i].Start
+		}
+	}
+	return &LightAnimation{Frames: s.frames}, nil
+}
+
+// ExtractLights renders the lights of .kcode JSON, see RenderLights
+func ExtractLights(jsdata []byte, seconds float64) (*LightAnimation, error) {
+	prog, err := ExtractProgram(jsdata)
+	if err != nil {
+		return nil, err
+	}
+	return RenderLights(prog, seconds)
+}
+
+// WriteGIF writes the animation as a looping animated GIF with each light a scale by scale
+// square.  GIF delays are in hundredths of a second so frames shorter than that are left out.
+func (a *LightAnimation) WriteGIF(w io.Writer, scale int) error {
+	if scale < 1 {
+		return errLightsScale
+	}
+	colours := a.palette()
+	anim := &gif.GIF{}
+	shown := 0
+	for i, f := range a.Frames {
+		end := int(math.Round((f.Start + f.Seconds) * 100))
+		delay := end - shown
+		if delay <= 0 && (i+1 < len(a.Frames) || len(anim.Image) > 0) {
+			continue
+		}
+		if delay <= 0 {
+			delay = 1
+		}
+		shown = end
+		frame := f.Lights.image(scale)
+		img := image.NewPaletted(frame.Bounds(), colours)
+		draw.Draw(img, img.Bounds(), frame, image.Point{}, draw.Src)
+		anim.Image = append(anim.Image, img)
+		anim.Delay = append(anim.Delay, delay)
+	}
+	return gif.EncodeAll(w, anim)
+}
+
+// WriteSpriteSheet writes the frames from left to right as a PNG with each light a scale by scale square
+func (a *LightAnimation) WriteSpriteSheet(w io.Writer, scale int) error {
+	if scale < 1 {
+		return errLightsScale
+	}
+	width, height := LightsWidth*scale, LightsHeight*scale
+	sheet := image.NewRGBA(image.Rect(0, 0, width*len(a.Frames), height))
+	for i, f := range a.Frames {
+		draw.Draw(sheet, image.Rect(i*width, 0, (i+1)*width, height), f.Lights.image(scale), image.Point{}, draw.Src)
+	}
+	return png.Encode(w, sheet)
+}
+
+// image draws the lights with each light a scale by scale square
+func (l *Lights) image(scale int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, LightsWidth*scale, LightsHeight*scale))
+	for y, row := range l {
+		for x, c := range row {
+			draw.Draw(img, image.Rect(x*scale, y*scale, (x+1)*scale, (y+1)*scale), image.NewUniform(c), image.Point{}, draw.Src)
+		}
+	}
+	return img
+}
+
+// palette lists the colours used by the animation, falling back to a general palette if there are too many
+func (a *LightAnimation) palette() color.Palette {
+	colours := make(color.Palette, 0)
+	seen := make(map[color.RGBA]bool)
+	for _, f := range a.Frames {
+		for _, row := range f.Lights {
+			for _, c := range row {
+				if !seen[c] {
+					seen[c] = true
+					colours = append(colours, c)
+				}
+			}
+		}
+	}
+	if len(colours) > 256 {
+		return palette.Plan9
+	}
+	return colours
+}
+
+func isLightBlock(b *Block) bool {
+	return strings.HasPrefix(lightBlockType(b), "lights_")
+}
+
+// lightBlockType is the type of a block without its part prefix
+func lightBlockType(b *Block) string {
+	if i := strings.Index(b.Type, "#"); i >= 0 {
+		return b.Type[i+1:]
+	}
+	return b.Type
+}
+
+// spawn starts a thread running at the given time
+func (s *lightSim) spawn(at float64, run func(t *lightThread)) {
+	t := &lightThread{wake: at, resume: make(chan bool)}
+	s.threads = append(s.threads, t)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				if _, ok := r.(stopThread); ok {
+					return
+				}
+				err, ok := r.(error)
+				if !ok {
+					panic(r)
+				}
+				s.err = err
+			}
+			t.done = true
+			s.yield <- struct{}{}
+		}()
+		if !<-t.resume {
+			panic(stopThread{})
+		}
+		run(t)
+	}()
+}
+
+// schedule runs the thread that is due first until it waits or ends, over and over, until
+// the simulation ends or nothing is left to run, then stops the threads still waiting.
+// Threads due at the same time run in the order they were started.
+func (s *lightSim) schedule() {
+	for s.err == nil {
+		var next *lightThread
+		running := s.threads[:0]
+		for _, t := range s.threads {
+			if t.done {
+				continue
+			}
+			running = append(running, t)
+			if next == nil || t.wake < next.wake {
+				next = t
+			}
+		}
+		s.threads = running
+		if next == nil || next.wake >= s.end {
+			break
+		}
+		if next.wake > s.now {
+			s.capture()
+			s.now, s.steps = next.wake, 0
+		}
+		next.resume <- true
+		<-s.yield
+	}
+	s.capture()
+	for _, t := range s.threads {
+		if !t.done {
+			t.resume <- false
+		}
+	}
+}
+
+// capture records what the lights show now
+func (s *lightSim) capture() {
+	last := &s.frames[len(s.frames)-1]
+	switch {
+	case last.Lights == s.lights:
+	case last.Start < s.now:
+		s.frames = append(s.frames, LightFrame{Lights: s.lights, Start: s.now})
+	case len(s.frames) > 1 && s.frames[len(s.frames)-2].Lights == s.lights:
+		// The lights changed back before time moved on
+		s.frames = s.frames[:len(s.frames)-1]
+	default:
+		last.Lights = s.lights
+	}
+}
+
+// sleep waits for some seconds, letting other threads run
+func (s *lightSim) sleep(t *lightThread, seconds float64) {
+	t.wake = s.now + math.Max(seconds, 0)
+	s.yield <- struct{}{}
+	if !<-t.resume {
+		panic(stopThread{})
+	}
+}
+
+// run runs a stack of blocks
+func (s *lightSim) run(t *lightThread, b *Block) {
+	for ; b != nil; b = nextBlock(b) {
+		if !b.Disabled {
+			s.step(t, b)
+		}
+	}
+}
+
+// count counts running a block, or going round a loop, without time moving on
+func (s *lightSim) count(b *Block) {
+	s.steps++
+	if s.steps > maxLightSteps {
+		panic(fmt.Errorf("%w: %s id=%s keeps running at %ss", errLightsBusy, b.Type, b.Id, formatSeconds(s.now)))
+	}
+}
+
+// step runs a single block
+func (s *lightSim) step(t *lightThread, b *Block) {
+	s.count(b)
+	switch blockType := lightBlockType(b); {
+	case blockType == "wait":
+		s.sleep(t, s.delay(b, "DELAY"))
+	case blockType == "in_x_time":
+		body := b.Input("DO").Target()
+		s.spawn(s.now+s.delay(b, "DELAY"), func(t *lightThread) {
+			s.run(t, body)
+		})
+	case blockType == "every_x_seconds":
+		body := b.Input("DO").Target()
+		interval := s.delay(b, "INTERVAL")
+		s.spawn(s.now+interval, func(t *lightThread) {
+			for {
+				s.count(b)
+				s.spawn(s.now, func(t *lightThread) {
+					s.run(t, body)
+				})
+				s.sleep(t, interval)
+			}
+		})
+	case blockType == "repeat_x_times":
+		n := s.number(b, "N")
+		for i := 0; i < int(n); i++ {
+			s.run(t, b.Input("DO").Target())
+		}
+	case blockType == "loops_forever":
+		for {
+			s.count(b)
+			s.run(t, b.Input("DO").Target())
+		}
+	case blockType == "controls_whileUntil":
+		mode, _ := b.Field("MODE")
+		until := strings.TrimSpace(mode) == "UNTIL"
+		for s.boolean(b, "BOOL") != until {
+			s.count(b)
+			s.run(t, b.Input("DO").Target())
+		}
+	case blockType == "controls_if" || blockType == "controls_if_else_custom":
+		count := 1
+		if n, err := strconv.Atoi(attrOrEmpty(b.Mutation, "elseif")); err == nil {
+			count += n
+		}
+		for i := 0; i < count; i++ {
+			if s.boolean(b, fmt.Sprintf("IF%d", i)) {
+				s.run(t, b.Input(fmt.Sprintf("DO%d", i)).Target())
+				return
+			}
+		}
+		s.run(t, b.Input("ELSE").Target())
+	case blockType == "variables_set":
+		name, _ := b.Field("VAR")
+		s.env[name] = s.value(b, "VALUE")
+	case blockType == "unary":
+		s.unary(b)
+	case isProcedureCall(b):
+		def, ok := s.procedures[calledProcedure(b)]
+		if !ok {
+			return
+		}
+		if t.calls >= maxLightCalls {
+			panic(fmt.Errorf("%w: %s id=%s", errLightsRecursion, b.Type, b.Id))
+		}
+		t.calls++
+		s.run(t, def.Input("STACK").Target())
+		t.calls--
+	case blockType == "lights_all":
+		s.fill(0, 0, LightsWidth, LightsHeight, s.colour(b, "COLOR"))
+	case blockType == "lights_off":
+		s.fill(0, 0, LightsWidth, LightsHeight, lightOff)
+	case blockType == "lights_set":
+		s.fill(s.integer(b, "X"), s.integer(b, "Y"), 1, 1, s.colour(b, "COLOR"))
+	case blockType == "lights_rectangle":
+		s.fill(s.integer(b, "X"), s.integer(b, "Y"), s.integer(b, "WIDTH"), s.integer(b, "HEIGHT"), s.colour(b, "COLOR"))
+	case blockType == "lights_scroll":
+		direction, _ := b.Field("DIRECTION")
+		s.scroll(strings.TrimSpace(direction))
+	}
+}
+
+// unary updates a variable e.g. count += 1
+func (s *lightSim) unary(b *Block) {
+	name, _ := b.Field("LEFT_HAND")
+	op, _ := b.Field("OPERATOR")
+	value := s.number(b, "RIGHT_HAND")
+	if strings.TrimSpace(op) == "=" {
+		s.env[name] = Constant{Kind: FieldNumber, Value: value}
+		return
+	}
+	current, err := s.env[name].Number()
+	if err != nil {
+		panic(fmt.Errorf("%w: '%s' in %s id=%s", errLightsNoVariable, name, b.Type, b.Id))
+	}
+	switch strings.TrimSpace(op) {
+	case "+=":
+		current += value
+	case "-=":
+		current -= value
+	case "*=":
+		current *= value
+	case "/=":
+		if value == 0 {
+			panic(fmt.Errorf("%w in %s id=%s", errDivisionByZero, b.Type, b.Id))
+		}
+		current /= value
+	default:
+		panic(fmt.Errorf("%w %s in %s id=%s", errUnknownOp, op, b.Type, b.Id))
+	}
+	s.env[name] = Constant{Kind: FieldNumber, Value: current}
+}
+
+// value evaluates the named value input of a block, falling back to its shadow when the
+// block in it is not constant
+func (s *lightSim) value(b *Block, name string) Constant {
+	in := b.Input(name)
+	c, err := Evaluate(in.Target(), s.env)
+	if err != nil && in != nil && in.Block != nil && in.Shadow != nil {
+		c, err = Evaluate(in.Shadow, s.env)
+	}
+	if err != nil {
+		panic(fmt.Errorf("%s of %s id=%s: %w", name, b.Type, b.Id, err))
+	}
+	return c
+}
+
+func (s *lightSim) number(b *Block, name string) float64 {
+	n, err := s.value(b, name).Number()
+	if err != nil {
+		panic(fmt.Errorf("%s of %s id=%s: %w", name, b.Type, b.Id, err))
+	}
+	return n
+}
+
+func (s *lightSim) integer(b *Block, name string) int {
+	return int(math.Round(s.number(b, name)))
+}
+
+func (s *lightSim) boolean(b *Block, name string) bool {
+	v, err := s.value(b, name).Bool()
+	if err != nil {
+		panic(fmt.Errorf("%s of %s id=%s: %w", name, b.Type, b.Id, err))
+	}
+	return v
+}
+
+func (s *lightSim) colour(b *Block, name string) color.RGBA {
+	c := s.value(b, name)
+	if c.Kind != FieldColour {
+		panic(fmt.Errorf("%s of %s id=%s: %w: %s is not a colour", name, b.Type, b.Id, errTypeMismatch, c))
+	}
+	rgb := make([]uint8, 3)
+	for i := range rgb {
+		n, _ := strconv.ParseUint(c.String()[1+2*i:3+2*i], 16, 8)
+		rgb[i] = uint8(n)
+	}
+	return color.RGBA{R: rgb[0], G: rgb[1], B: rgb[2], A: 255}
+}
+
+// delay is the named duration input of a block in seconds, in the units of its UNIT field
+func (s *lightSim) delay(b *Block, name string) float64 {
+	unit, _ := b.Field("UNIT")
+	return toSeconds(s.number(b, name), unit, costTable.FramesPerSecond)
+}
+
+// fill sets the lights in a rectangle, leaving out those off the grid
+func (s *lightSim) fill(x int, y int, width int, height int, c color.RGBA) {
+	for row := y; row < y+height; row++ {
+		for col := x; col < x+width; col++ {
+			if row >= 0 && row < LightsHeight && col >= 0 && col < LightsWidth {
+				s.lights[row][col] = c
+			}
+		}
+	}
+}
+
+// scroll moves every light one place in a direction, wrapping round
+func (s *lightSim) scroll(direction string) {
+	dx, dy := 0, 0
+	switch direction {
+	case "left":
+		dx = -1
+	case "right":
+		dx = 1
+	case "up":
+		dy = -1
+	case "down":
+		dy = 1
+	}
+	var moved Lights
+	for row := range s.lights {
+		for col := range s.lights[row] {
+			moved[(row+dy+LightsHeight)%LightsHeight][(col+dx+LightsWidth)%LightsWidth] = s.lights[row][col]
+		}
+	}
+	s.lights = moved
+}
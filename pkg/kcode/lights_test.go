@@ -0,0 +1,161 @@
+package kcode
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"io/ioutil"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func colour(c string) string {
+	return fmt.Sprintf(`<shadow type="colour_picker"><field name="COLOUR">%s</field></shadow>`, c)
+}
+
+func onAppStart(body string) string {
+	return `<block type="events_onAppStart"><statement name="CALLBACK">` + body + `</statement></block>`
+}
+
+func renderLights(t *testing.T, xml string, seconds float64) (*LightAnimation, error) {
+	prog, err := ParseProgram([]byte("<xml>" + xml + "</xml>"))
+	assert.Nil(t, err)
+	return RenderLights(prog, seconds)
+}
+
+// frameTimes lists the start and length of each frame
+func frameTimes(a *LightAnimation) []string {
+	times := make([]string, 0, len(a.Frames))
+	for _, f := range a.Frames {
+		times = append(times, formatSeconds(f.Start)+"+"+formatSeconds(f.Seconds))
+	}
+	return times
+}
+
+var (
+	red   = color.RGBA{R: 255, A: 255}
+	green = color.RGBA{G: 255, A: 255}
+)
+
+func TestRenderLightsBlink(t *testing.T) {
+	a, err := renderLights(t, onAppStart(`<block type="loops_forever"><statement name="DO">
+		<block type="lights_all"><value name="COLOR">`+colour("#FF0000")+`</value>
+		<next>`+wait("milliseconds", number("500"))+`<next><block type="lightboard#lights_off">
+		<next>`+wait("seconds", number("0.5"))+`</block></next></block></next></block></next></block>
+		</statement></block>`), 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"0+0.5", "0.5+0.5", "1+0.5", "1.5+0.5"}, frameTimes(a))
+	for i, f := range a.Frames {
+		expected := red
+		if i%2 == 1 {
+			expected = lightOff
+		}
+		assert.Equal(t, expected, f.Lights[0][0], i)
+		assert.Equal(t, expected, f.Lights[LightsHeight-1][LightsWidth-1], i)
+	}
+}
+
+func TestRenderLightsScroll(t *testing.T) {
+	// A green light at the right edge moved right every 100ms by a timer counting in a variable
+	a, err := renderLights(t, `<variables><variable type="" id="v">count</variable></variables>`+
+		onAppStart(`<block type="lights_set"><value name="X">`+number("15")+`</value><value name="Y">`+number("2")+`</value>
+		<value name="COLOR">`+colour("#00FF00")+`</value></block>`)+`
+		<block type="every_x_seconds"><field name="UNIT">milliseconds</field><value name="INTERVAL">`+number("100")+`</value>
+		<statement name="DO"><block type="controls_if"><value name="IF0"><block type="logic_compare"><field name="OP">LT</field>
+		<value name="A"><block type="variables_get"><field name="VAR">count</field></block></value><value name="B">`+number("3")+`</value></block></value>
+		<statement name="DO0"><block type="lights_scroll"><field name="DIRECTION">right</field>
+		<next><block type="unary"><field name="LEFT_HAND">count</field><field name="OPERATOR">+=</field><value name="RIGHT_HAND">`+number("1")+`</value>
+		</block></next></block></statement></block></statement></block>`, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"0+0.1", "0.1+0.1", "0.2+0.1", "0.3+0.7"}, frameTimes(a))
+	for i, x := range []int{15, 0, 1, 2} {
+		assert.Equal(t, green, a.Frames[i].Lights[2][x], i)
+		assert.Equal(t, lightOff, a.Frames[i].Lights[2][(x+1)%LightsWidth], i)
+	}
+}
+
+func TestRenderLightsValues(t *testing.T) {
+	// Random values use their shadow, lights off the grid are left out and in_x_time runs later
+	a, err := renderLights(t, onAppStart(`<block type="lights_rectangle"><value name="X">`+number("14")+`</value>
+		<value name="Y">`+number("-1")+`</value><value name="WIDTH">`+number("4")+`</value><value name="HEIGHT">`+number("2")+`</value>
+		<value name="COLOR">`+colour("#00FF00")+`<block type="random_colour"></block></value></block>`)+`
+		<block type="in_x_time"><field name="UNIT">seconds</field><value name="DELAY">`+number("1")+`</value>
+		<statement name="DO"><block type="procedures_callnoreturn"><mutation name="clear"></mutation></block></statement></block>
+		<block type="procedures_defnoreturn"><field name="NAME">clear</field><statement name="STACK"><block type="lights_off"></block></statement></block>`, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"0+1", "1+2"}, frameTimes(a))
+	lit := 0
+	for y, row := range a.Frames[0].Lights {
+		for x, c := range row {
+			if c == green {
+				lit++
+				assert.True(t, x >= 14 && y == 0, "%d,%d", x, y)
+			}
+		}
+	}
+	assert.Equal(t, 2, lit)
+	assert.Equal(t, lightOff, a.Frames[1].Lights[0][15])
+}
+
+func TestRenderLightsErrors(t *testing.T) {
+	_, err := renderLights(t, onAppStart(`<block type="wand_vibrate"></block>`), 1)
+	assert.Equal(t, errNoLights, err)
+	_, err = renderLights(t, onAppStart(`<block type="lights_off"></block>`), 0)
+	assert.Equal(t, errLightsDuration, err)
+	_, err = renderLights(t, onAppStart(`<block type="loops_forever" id="a"><statement name="DO">
+		<block type="lights_all"><value name="COLOR">`+colour("#FF0000")+`</value></block></statement></block>`), 1)
+	assert.True(t, errors.Is(err, errLightsBusy))
+	_, err = renderLights(t, onAppStart(`<block type="lights_all" id="b"><value name="COLOR"><block type="wand_x"></block></value></block>`), 1)
+	assert.True(t, errors.Is(err, errNotConstant))
+	assert.Contains(t, err.Error(), "COLOR of lights_all id=b")
+	_, err = renderLights(t, onAppStart(`<block type="lights_off"><next><block type="procedures_callnoreturn"><mutation name="again"></mutation></block></next></block>`)+
+		`<block type="procedures_defnoreturn"><field name="NAME">again</field><statement name="STACK">`+
+		wait("frames", number("1"))+`<next><block type="procedures_callnoreturn"><mutation name="again"></mutation></block></next></block></statement></block>`, 10)
+	assert.True(t, errors.Is(err, errLightsRecursion))
+}
+
+func TestWriteLights(t *testing.T) {
+	a, err := renderLights(t, onAppStart(`<block type="lights_set"><value name="X">`+number("1")+`</value><value name="Y">`+number("0")+`</value>
+		<value name="COLOR">`+colour("#FF0000")+`</value><next>`+wait("seconds", number("0.25"))+`<next><block type="lights_scroll">
+		<field name="DIRECTION">down</field><next>`+wait("milliseconds", number("1"))+`<next><block type="lights_scroll"><field name="DIRECTION">left</field>
+		</block></next></block></next></block></next></block></next></block>`), 1)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"0+0.25", "0.25+0", "0.25+0.75"}, frameTimes(a))
+	var buf bytes.Buffer
+	assert.Nil(t, a.WriteGIF(&buf, 4))
+	anim, err := gif.DecodeAll(&buf)
+	assert.Nil(t, err)
+	// The frame shown for a millisecond is too short for a GIF
+	assert.Equal(t, []int{25, 75}, anim.Delay)
+	assert.Equal(t, 64, anim.Image[0].Bounds().Dx())
+	assert.Equal(t, 32, anim.Image[0].Bounds().Dy())
+	r, g, b, _ := anim.Image[0].At(5, 3).RGBA()
+	assert.Equal(t, []uint32{0xffff, 0, 0}, []uint32{r, g, b})
+	r, _, _, _ = anim.Image[1].At(1, 5).RGBA()
+	assert.Equal(t, uint32(0xffff), r)
+
+	buf.Reset()
+	assert.Nil(t, a.WriteSpriteSheet(&buf, 2))
+	sheet, err := png.Decode(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, 3*32, sheet.Bounds().Dx())
+	assert.Equal(t, 16, sheet.Bounds().Dy())
+	assert.Equal(t, color.RGBA{R: 255, A: 255}, color.RGBAModel.Convert(sheet.At(32+2, 2)))
+	assert.Equal(t, errLightsScale, a.WriteGIF(&buf, 0))
+}
+
+func TestExtractLights(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	_, err := ExtractLights([]byte(`not json`), 1)
+	assert.NotNil(t, err)
+	// The challenges are for the wand so none of them have lights
+	for _, f := range ListFilesInDirectory("challenges") {
+		_, err := ExtractLights(ReadFile("challenges/"+f.Name()), 1)
+		assert.Equal(t, errNoLights, err, f.Name())
+	}
+}
@@ -0,0 +1,141 @@
+package kcode
+
+// lint.go
+// -------
+// Description:
+// Lint checks on a creation.  These look for content problems such as objects that are
+// not in the scene or misspelled block fields rather than whether the parser can read
+// the file, which is what validate.go checks.
+// Every kind of Issue has a Rule describing it.  Rule levels follow SARIF: "error",
+// "warning" or "note".
+//
+// API:
+// LintFile(filename string) ([]Issue, error)
+// LintString(jsdata []byte) ([]Issue, error)
+// LintReader(r io.Reader) ([]Issue, error)
+// LintProgram(prog *Program, scene string) []Issue
+// RuleFor(kind string) Rule
+// Rules() []Rule
+//
+
+import (
+	"io"
+	"io/ioutil"
+	"sort"
+)
+
+// Rule describes a kind of Issue
+type Rule struct {
+	Id          string `json:"id"`
+	Description string `json:"description"`
+	Level       string `json:"level"`
+}
+
+var rules = map[string]Rule{
+	// validate.go
+	KindMalformed:       {KindMalformed, "File is not valid .kcode JSON or its kcode XML is broken", "error"},
+	KindParserError:     {KindParserError, "Parser failed on a well formed file", "error"},
+	KindMissedBlock:     {KindMissedBlock, "Parser missed a block that is in the XML", "error"},
+	KindUnexpectedBlock: {KindUnexpectedBlock, "Parser found a block that is not in the XML", "error"},
+	KindMissedSpell:     {KindMissedSpell, "Parser missed a spell that is in the XML", "error"},
+	KindUnexpectedSpell: {KindUnexpectedSpell, "Parser found a spell that is not in the XML", "error"},
+	KindMissedPart:      {KindMissedPart, "Parser missed a part", "error"},
+	// scenes.go
+	"missing-scene":          {"missing-scene", "Creation has no scene", "warning"},
+	"unknown-scene":          {"unknown-scene", "Scene is not in the scene catalogue", "warning"},
+	"unknown-object":         {"unknown-object", "Object is not in the scene and is not added by the creation", "warning"},
+	"position-out-of-bounds": {"position-out-of-bounds", "Position is outside the scene canvas", "warning"},
+	// spells.go
+	"unknown-spell": {"unknown-spell", "Spell is not in the spell catalogue", "warning"},
+	// registry.go
+	"unknown-block-type": {"unknown-block-type", "Block type is not in the block registry", "warning"},
+	"unknown-field":      {"unknown-field", "Block has a field its type does not define", "warning"},
+	"unknown-input":      {"unknown-input", "Block has an input its type does not define", "warning"},
+	"missing-input":      {"missing-input", "Block is missing a required value input", "warning"},
+	"bad-connection":     {"bad-connection", "Block is connected where its type does not allow", "warning"},
+	// variables.go
+	"unused-variable":     {"unused-variable", "Variable is declared but never used", "warning"},
+	"undeclared-variable": {"undeclared-variable", "Variable is used but not declared", "warning"},
+	"write-only-variable": {"write-only-variable", "Variable is set but never read", "warning"},
+	// procedures.go
+	"recursive-procedure": {"recursive-procedure", "Procedure calls itself directly or through other procedures", "warning"},
+	"unused-procedure":    {"unused-procedure", "Procedure is never called from an event handler", "warning"},
+	"undefined-procedure": {"undefined-procedure", "Call to a procedure that is not defined", "warning"},
+	"disabled-procedure":  {"disabled-procedure", "Call to a procedure whose definition is disabled", "warning"},
+	// evaluate.go
+	"zero-scale":       {"zero-scale", "Scale factor evaluates to 0", "warning"},
+	"division-by-zero": {"division-by-zero", "Divisor evaluates to 0", "warning"},
+	// loops.go
+	"loop-without-wait": {"loop-without-wait", "Loop never waits so it hangs the app", "warning"},
+	"busy-handler":      {"busy-handler", "Handler does heavy work on every tick", "warning"},
+	// timing.go
+	"slow-handler": {"slow-handler", "Handler takes longer than the limit in the cost table", "warning"},
+	// kits.go
+	"mixed-kits": {"mixed-kits", "Creation uses kits that do not work together", "warning"},
+}
+
+// LintFile lints a .kcode file
+func LintFile(filename string) ([]Issue, error) {
+	return LintString(ReadFile(filename))
+}
+
+// LintReader lints .kcode read from r
+func LintReader(r io.Reader) ([]Issue, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return LintString(data)
+}
+
+// LintString lints .kcode data against the current scene, spell and kit catalogues, block registry and cost table.
+// Besides the checks of LintProgram it checks the kits used, which depend on the parts of the creation as well as its blocks.
+func LintString(jsdata []byte) ([]Issue, error) {
+	scene, err := ExtractScene(jsdata)
+	if err != nil {
+		return nil, err
+	}
+	prog, err := ExtractProgram(jsdata)
+	if err != nil {
+		return nil, err
+	}
+	kits, err := detectFileKits(jsdata, prog)
+	if err != nil {
+		return nil, err
+	}
+	return append(LintProgram(prog, scene), kits.Issues...), nil
+}
+
+// LintProgram runs every lint check on a program set in the given scene
+func LintProgram(prog *Program, scene string) []Issue {
+	issues := make([]Issue, 0)
+	issues = append(issues, sceneCatalogue.Check(scene, prog)...)
+	issues = append(issues, spellCatalogue.Check(prog)...)
+	issues = append(issues, blockRegistry.Check(prog)...)
+	issues = append(issues, CheckVariables(prog)...)
+	issues = append(issues, CheckProcedures(prog)...)
+	issues = append(issues, CheckExpressions(prog)...)
+	issues = append(issues, CheckLoops(prog)...)
+	issues = append(issues, CheckTimings(prog)...)
+	return issues
+}
+
+// RuleFor returns the rule for an issue kind.  Unknown kinds are warnings.
+func RuleFor(kind string) Rule {
+	if rule, ok := rules[kind]; ok {
+		return rule
+	}
+	return Rule{Id: kind, Description: kind, Level: "warning"}
+}
+
+// Rules returns every known rule sorted by id
+func Rules() []Rule {
+	list := make([]Rule, 0, len(rules))
+	for _, rule := range rules {
+		list = append(list, rule)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Id < list[j].Id
+	})
+	return list
+}
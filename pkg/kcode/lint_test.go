@@ -0,0 +1,62 @@
+package kcode
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// knownIssues are the kinds of the issues found in the challenges.
+// 048_smoke declares xPosition and yPosition and never uses them.
+// 006_celebration starts an every_x_seconds timer and 010_bring_beans adds beans in a
+// repeat_x_times on every tick of an events_whileFlick.
+var knownIssues = map[string][]string{
+	"challenges/006_celebration.kcode": {"busy-handler"},
+	"challenges/010_bring_beans.kcode": {"busy-handler"},
+	"challenges/048_smoke.kcode":       {"unused-variable", "unused-variable"},
+}
+
+func issueKinds(issues []Issue) []string {
+	kinds := make([]string, 0, len(issues))
+	for _, issue := range issues {
+		kinds = append(kinds, issue.Kind)
+	}
+	return kinds
+}
+
+func TestLintAllChallenges(t *testing.T) {
+	files := ListFilesInDirectory("challenges")
+	for _, f := range files {
+		filename := "challenges/" + f.Name()
+		issues, err := LintFile(filename)
+		assert.Nil(t, err, filename)
+		if kinds, ok := knownIssues[filename]; ok {
+			assert.Equal(t, kinds, issueKinds(issues), filename)
+		} else {
+			assert.Empty(t, issues, filename)
+		}
+	}
+}
+
+func TestLintString(t *testing.T) {
+	issues, err := LintString([]byte(`{"source": "<xml><block type=\"events_onAppStart\" id=\"a\"><statement name=\"CALLBACK\"><block type=\"wand_vibrat\" id=\"b\"></block></statement></block></xml>", "parts": [], "scene": "owlery"}`))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(issues))
+	assert.Equal(t, "unknown-block-type", issues[0].Kind)
+	assert.Equal(t, "b", issues[0].BlockId)
+	_, err = LintString([]byte(`not json`))
+	assert.NotNil(t, err)
+	issues, err = LintReader(strings.NewReader(`{"source": "<xml></xml>", "parts": [], "scene": "owlery"}`))
+	assert.Nil(t, err)
+	assert.Empty(t, issues)
+}
+
+func TestRules(t *testing.T) {
+	assert.Equal(t, "error", RuleFor(KindMissedBlock).Level)
+	assert.Equal(t, "warning", RuleFor("unknown-object").Level)
+	assert.Equal(t, "warning", RuleFor("no-such-kind").Level)
+	for _, rule := range Rules() {
+		assert.NotEmpty(t, rule.Description, rule.Id)
+	}
+}
@@ -0,0 +1,198 @@
+package kcode
+
+// loops.go
+// --------
+// Description:
+// Checks for code that keeps the wand app busy and so hangs it on slow tablets.
+// The app runs a creation a tick at a time, so a loops_forever or controls_whileUntil
+// whose body never waits stops anything else from happening.  Waiting includes calling
+// a procedure that waits but not a wait in the body of an every_x_seconds or in_x_time,
+// which runs later and does not hold up the loop.  A while loop whose condition means
+// it never runs is fine.
+// Handlers such as events_whileFlick run their body on every tick for as long as the
+// gesture goes on, so heavy work there is repeated many times a second.  Heavy work is:
+// - scheduling a timer with every_x_seconds or in_x_time, which piles up new timers
+// - starting a loops_forever or controls_whileUntil
+// - creating objects or particles in a repeat_x_times
+// - calling a procedure that does any of these
+// Disabled blocks are left out since they never run.
+//
+// API:
+// CheckLoops(prog *Program) []Issue
+//
+
+import (
+	"fmt"
+	"strings"
+)
+
+// waitBlocks are the blocks that give the app a chance to do something else
+var waitBlocks = map[string]bool{
+	"wait": true,
+}
+
+// unboundedLoops are the loops that can run for ever
+var unboundedLoops = map[string]bool{
+	"loops_forever":       true,
+	"controls_whileUntil": true,
+}
+
+// tickHandlers are the event handlers whose body runs on every tick while the event lasts
+var tickHandlers = map[string]bool{
+	"events_whileFlick": true,
+}
+
+// timerBlocks schedule their body to run later
+var timerBlocks = map[string]bool{
+	"every_x_seconds": true,
+	"in_x_time":       true,
+}
+
+// spawnBlocks create objects or particles
+var spawnBlocks = map[string]bool{
+	"objects_add":       true,
+	"particle_bang":     true,
+	"particle_fizz":     true,
+	"particle_generate": true,
+}
+
+// loopChecker finds blocks in stacks, following calls into the bodies of procedures
+type loopChecker struct {
+	procedures map[string]*Block
+}
+
+// CheckLoops reports loops that never wait and heavy work in handlers that run on every tick
+func CheckLoops(prog *Program) []Issue {
+	c := &loopChecker{procedures: make(map[string]*Block)}
+	for _, p := range Procedures(prog) {
+		c.procedures[p.Name] = p.Block
+	}
+	issues := make([]Issue, 0)
+	eachEnabledBlockPath(prog, func(b *Block, path string) {
+		if !unboundedLoops[b.Type] || neverLoops(b) {
+			return
+		}
+		if c.find(b.Input("DO").Target(), isWait) == nil {
+			issues = append(issues, Issue{Kind: "loop-without-wait", BlockId: b.Id, BlockType: b.Type, Path: path,
+				Message: fmt.Sprintf("%s never waits so it hangs the app", b.Type)})
+		}
+	})
+	eachHandlerBlock(prog, func(b *Block, trigger string, path string) {
+		if !tickHandlers[b.Type] {
+			return
+		}
+		name := handlerName(b.Type, trigger)
+		for _, in := range b.Statements {
+			if in.Block != nil {
+				issues = c.checkTickStack(issues, name, in.Block, fmt.Sprintf("%s/statement[%s]/block", path, in.Name))
+			}
+		}
+	})
+	return issues
+}
+
+// checkTickStack reports the heavy blocks in a stack run on every tick by the named handler
+func (c *loopChecker) checkTickStack(issues []Issue, handler string, b *Block, path string) []Issue {
+	for ; b != nil; path += "/next/block" {
+		if !b.Disabled {
+			if work := c.heavyWork(b); len(work) > 0 {
+				issues = append(issues, Issue{Kind: "busy-handler", BlockId: b.Id, BlockType: b.Type, Path: path,
+					Message: fmt.Sprintf("%s %s on every tick", handler, work)})
+			} else {
+				for _, in := range b.Statements {
+					if in.Block != nil {
+						issues = c.checkTickStack(issues, handler, in.Block, fmt.Sprintf("%s/statement[%s]/block", path, in.Name))
+					}
+				}
+			}
+		}
+		if b.Next == nil {
+			break
+		}
+		b = b.Next.Block
+	}
+	return issues
+}
+
+// heavyWork describes the heavy work a block does or returns "" if it does none
+func (c *loopChecker) heavyWork(b *Block) string {
+	switch {
+	case timerBlocks[b.Type]:
+		return fmt.Sprintf("schedules a new timer with %s", b.Type)
+	case unboundedLoops[b.Type]:
+		return fmt.Sprintf("starts a %s", b.Type)
+	case b.Type == "repeat_x_times":
+		if spawn := c.find(b.Input("DO").Target(), isSpawn); spawn != nil {
+			return fmt.Sprintf("runs %s in a repeat_x_times", spawn.Type)
+		}
+	case isProcedureCall(b):
+		name := calledProcedure(b)
+		// find follows the calls in the procedure itself
+		heavy := func(b *Block) bool { return !isProcedureCall(b) && len(c.heavyWork(b)) > 0 }
+		if c.find(c.procedures[name], heavy) != nil {
+			return fmt.Sprintf("calls '%s' which does heavy work", name)
+		}
+	}
+	return ""
+}
+
+// find returns the first enabled block matching in a stack, the stacks nested in it and
+// the bodies of the procedures it calls, or nil if there isn't one.  The bodies of timers
+// are left out as they run later rather than as part of the stack.
+func (c *loopChecker) find(b *Block, match func(b *Block) bool) *Block {
+	return c.findIn(b, match, make(map[string]bool))
+}
+
+func (c *loopChecker) findIn(b *Block, match func(b *Block) bool, called map[string]bool) *Block {
+	for ; b != nil; b = nextBlock(b) {
+		if b.Disabled {
+			continue
+		}
+		if match(b) {
+			return b
+		}
+		if isProcedureCall(b) {
+			name := calledProcedure(b)
+			if def, ok := c.procedures[name]; ok && !called[name] {
+				called[name] = true
+				if found := c.findIn(def, match, called); found != nil {
+					return found
+				}
+			}
+		}
+		if timerBlocks[b.Type] {
+			continue
+		}
+		for _, in := range b.Statements {
+			if found := c.findIn(in.Block, match, called); found != nil {
+				return found
+			}
+		}
+	}
+	return nil
+}
+
+// neverLoops reports whether the condition of a controls_whileUntil means its body never runs
+func neverLoops(b *Block) bool {
+	if b.Type != "controls_whileUntil" {
+		return false
+	}
+	always, constant := constantCondition(b.Input("BOOL"))
+	mode, _ := b.Field("MODE")
+	return constant && always == (strings.TrimSpace(mode) == "UNTIL")
+}
+
+func isWait(b *Block) bool {
+	return waitBlocks[b.Type]
+}
+
+func isSpawn(b *Block) bool {
+	return spawnBlocks[b.Type]
+}
+
+func nextBlock(b *Block) *Block {
+	if b.Next == nil {
+		return nil
+	}
+	return b.Next.Block
+}
@@ -0,0 +1,96 @@
+package kcode
+
+import (
+	"io/ioutil"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckLoops(t *testing.T) {
+	prog, err := ParseProgram([]byte(`<xml>
+		<block type="events_onAppStart" id="a"><statement name="CALLBACK">
+		<block type="loops_forever" id="b"><statement name="DO"><block type="wand_vibrate" id="c"><field name="PATTERN">short</field>
+		<next><block type="wait" id="d" disabled="true"><field name="UNIT">seconds</field></block></next></block></statement></block>
+		</statement></block>
+		<block type="events_onGesture" id="e"><field name="TYPE">accio</field><statement name="CALLBACK">
+		<block type="loops_forever" id="f"><statement name="DO"><block type="procedures_callnoreturn" id="g"><mutation name="pause"></mutation></block></statement>
+		</block></statement></block>
+		<block type="procedures_defnoreturn" id="h"><field name="NAME">pause</field><statement name="STACK">
+		<block type="wait" id="i"><field name="UNIT">seconds</field></block></statement></block>
+		<block type="events_onGesture" id="j"><field name="TYPE">reducio</field><statement name="CALLBACK">
+		<block type="controls_whileUntil" id="k"><field name="MODE">WHILE</field><value name="BOOL"><block type="logic_boolean"><field name="BOOL">FALSE</field></block></value>
+		<statement name="DO"><block type="wand_vibrate" id="l"><field name="PATTERN">short</field></block></statement>
+		<next><block type="controls_whileUntil" id="m"><field name="MODE">UNTIL</field><value name="BOOL"><block type="logic_compare"><field name="OP">GT</field>
+		<value name="A"><block type="wand_x"></block></value><value name="B"><block type="math_number"><field name="NUM">100</field></block></value></block></value>
+		</block></next></block></statement></block>
+		<block type="events_onGesture" id="n"><field name="TYPE">accio</field><statement name="CALLBACK">
+		<block type="loops_forever" id="o"><statement name="DO"><block type="in_x_time" id="p"><field name="UNIT">seconds</field>
+		<value name="DELAY"><block type="math_number"><field name="NUM">1</field></block></value>
+		<statement name="DO"><block type="wait" id="q"><field name="UNIT">seconds</field></block></statement></block></statement>
+		</block></statement></block>
+		</xml>`))
+	assert.Nil(t, err)
+	issues := CheckLoops(prog)
+	assert.Equal(t, []string{"loop-without-wait", "loop-without-wait", "loop-without-wait"}, issueKinds(issues))
+	// The wait in b's body is disabled, f waits by calling pause and k never runs
+	assert.Equal(t, "b", issues[0].BlockId)
+	assert.Equal(t, "loops_forever never waits so it hangs the app", issues[0].Message)
+	assert.Equal(t, "/block[1]/statement[CALLBACK]/block", issues[0].Path)
+	assert.Equal(t, "m", issues[1].BlockId)
+	// The wait in the in_x_time runs later so o starts a new timer on every pass without waiting
+	assert.Equal(t, "o", issues[2].BlockId)
+	assert.Equal(t, "warning", RuleFor("loop-without-wait").Level)
+}
+
+func TestCheckLoopsTickHandlers(t *testing.T) {
+	prog, err := ParseProgram([]byte(`<xml>
+		<block type="events_whileFlick" id="a"><field name="TYPE">upMove</field><statement name="CALLBACK">
+		<block type="objects_scale" id="b"><field name="PROPORTION">grow</field>
+		<next><block type="every_x_seconds" id="c"><field name="UNIT">seconds</field>
+		<statement name="DO"><block type="in_x_time" id="d"><field name="UNIT">seconds</field></block></statement>
+		<next><block type="repeat_x_times" id="e"><statement name="DO"><block type="repeat_x_times" id="f">
+		<statement name="DO"><block type="particle_bang" id="g"></block></statement></block></statement>
+		<next><block type="repeat_x_times" id="h"><statement name="DO"><block type="objects_setColor" id="i"></block></statement>
+		<next><block type="procedures_callnoreturn" id="j"><mutation name="spawn"></mutation>
+		<next><block type="procedures_callnoreturn" id="k"><mutation name="spin"></mutation>
+		</block></next></block></next></block></next></block></next></block></next></block></statement></block>
+		<block type="procedures_defnoreturn" id="l"><field name="NAME">spawn</field><statement name="STACK">
+		<block type="procedures_callnoreturn" id="m"><mutation name="spawn"></mutation><next><block type="in_x_time" id="n"></block></next></block></statement></block>
+		<block type="procedures_defnoreturn" id="o"><field name="NAME">spin</field><statement name="STACK">
+		<block type="procedures_callnoreturn" id="p"><mutation name="spin"></mutation></block></statement></block>
+		<block type="events_onFlick" id="q"><field name="TYPE">up</field><statement name="CALLBACK">
+		<block type="every_x_seconds" id="r"><field name="UNIT">seconds</field></block></statement></block>
+		</xml>`))
+	assert.Nil(t, err)
+	issues := CheckLoops(prog)
+	assert.Equal(t, []string{"busy-handler", "busy-handler", "busy-handler"}, issueKinds(issues))
+	assert.Equal(t, "c", issues[0].BlockId)
+	assert.Equal(t, "events_whileFlick(upMove) schedules a new timer with every_x_seconds on every tick", issues[0].Message)
+	assert.Equal(t, "/block[1]/statement[CALLBACK]/block/next/block", issues[0].Path)
+	assert.Equal(t, "e", issues[1].BlockId)
+	assert.Equal(t, "events_whileFlick(upMove) runs particle_bang in a repeat_x_times on every tick", issues[1].Message)
+	// Recursive procedures are only looked at once
+	assert.Equal(t, "j", issues[2].BlockId)
+	assert.Equal(t, "events_whileFlick(upMove) calls 'spawn' which does heavy work on every tick", issues[2].Message)
+}
+
+func TestCheckLoopsAllChallenges(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	for _, f := range ListFilesInDirectory("challenges") {
+		prog, err := ExtractProgram(ReadFile("challenges/" + f.Name()))
+		assert.Nil(t, err, f.Name())
+		issues := CheckLoops(prog)
+		switch f.Name() {
+		case "006_celebration.kcode":
+			assert.Equal(t, 1, len(issues))
+			assert.Equal(t, "every_x_seconds", issues[0].BlockType)
+		case "010_bring_beans.kcode":
+			assert.Equal(t, 1, len(issues))
+			assert.Equal(t, "events_whileFlick(upMove) runs objects_add in a repeat_x_times on every tick", issues[0].Message)
+		default:
+			assert.Empty(t, issues, f.Name())
+		}
+	}
+}
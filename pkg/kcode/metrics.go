@@ -0,0 +1,52 @@
+package kcode
+
+// metrics.go
+// ----------
+// Description:
+// Size and pacing figures for a creation, for comparing challenges with each other.
+// Blocks counts the enabled blocks that run, leaving out shadows, and Handlers and
+// Procedures count the enabled top level event handlers and procedure definitions.
+// Timings gives how long each handler takes, see timing.go, and Slow counts the handlers
+// taking longer than the limit in the cost table.
+//
+// API:
+// ComputeMetrics(prog *Program) Metrics
+// ExtractMetrics(jsdata []byte) (Metrics, error)
+//
+
+// Metrics are the figures for one creation
+type Metrics struct {
+	Blocks     int             `json:"blocks"`
+	Handlers   int             `json:"handlers"`
+	Procedures int             `json:"procedures"`
+	Variables  int             `json:"variables"`
+	Slow       int             `json:"slow"`
+	Timings    []HandlerTiming `json:"timings"`
+}
+
+// ComputeMetrics works out the metrics of a program
+func ComputeMetrics(prog *Program) Metrics {
+	m := Metrics{Procedures: len(Procedures(prog)), Variables: len(prog.Variables), Timings: EstimateTimings(prog)}
+	Walk(prog, SkipDisabled(VisitorFunc(func(v Visit) bool {
+		if v.Link != LinkShadow {
+			m.Blocks++
+		}
+		return true
+	})))
+	m.Handlers = len(m.Timings)
+	for _, t := range m.Timings {
+		if t.Slow {
+			m.Slow++
+		}
+	}
+	return m
+}
+
+// ExtractMetrics works out the metrics of .kcode JSON
+func ExtractMetrics(jsdata []byte) (Metrics, error) {
+	prog, err := ExtractProgram(jsdata)
+	if err != nil {
+		return Metrics{}, err
+	}
+	return ComputeMetrics(prog), nil
+}
@@ -0,0 +1,40 @@
+package kcode
+
+import (
+	"io/ioutil"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestComputeMetrics(t *testing.T) {
+	prog, err := ParseProgram([]byte(`<xml><variables><variable type="" id="v">count</variable></variables>
+		<block type="events_onGesture" id="a"><field name="TYPE">reducio</field><statement name="CALLBACK">
+		<block type="procedures_callnoreturn"><mutation name="pause"></mutation>
+		<next><block type="wand_vibrate" disabled="true"><field name="PATTERN">short</field></block></next></block></statement></block>
+		<block type="procedures_defnoreturn"><field name="NAME">pause</field><statement name="STACK">` +
+		wait("seconds", `<shadow type="math_number"><field name="NUM">1</field></shadow>`+number("11")) + `</block></statement></block>
+		<block type="events_onFlick" id="b" disabled="true"><field name="TYPE">up</field></block>
+		</xml>`))
+	assert.Nil(t, err)
+	m := ComputeMetrics(prog)
+	// The call, the definition, the wait and its number but not the shadow or disabled blocks
+	assert.Equal(t, Metrics{Blocks: 5, Handlers: 1, Procedures: 1, Variables: 1, Slow: 1, Timings: m.Timings}, m)
+	assert.Equal(t, "reducio: 11s", m.Timings[0].String())
+	assert.True(t, m.Timings[0].Slow)
+}
+
+func TestExtractMetrics(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	_, err := ExtractMetrics([]byte(`not json`))
+	assert.NotNil(t, err)
+	// No challenge has a handler slower than the default limit
+	for _, f := range ListFilesInDirectory("challenges") {
+		m, err := ExtractMetrics(ReadFile("challenges/" + f.Name()))
+		assert.Nil(t, err, f.Name())
+		assert.Equal(t, len(m.Timings), m.Handlers, f.Name())
+		assert.Zero(t, m.Slow, f.Name())
+		assert.True(t, m.Blocks > 0, f.Name())
+	}
+}
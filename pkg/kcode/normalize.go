@@ -0,0 +1,109 @@
+package kcode
+
+// normalize.go
+// ------------
+// Description:
+// Canonical form of a creation so that creations which only differ in ways the user
+// cannot see compare equal.  Normalize strips the Blockly ids, canvas coordinates, comments
+// and the collapsed and deletable attributes, which only change how the editor shows a block,
+// puts variables, fields and inputs in name order and sorts the top level blocks by their content
+// since their order in the XML only reflects when they were added.  The order of blocks
+// within a stack is kept as it is the order they run in.
+// Fingerprint is a SHA-256 of the normal form, for finding duplicate submissions,
+// unchanged starter files and equivalent solutions.
+//
+// API:
+// Normalize(prog *Program) *Program
+// Fingerprint(prog *Program) string
+//
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"sort"
+	"strings"
+)
+
+// Normalize returns the canonical form of a program.  The program passed in is not changed.
+func Normalize(prog *Program) *Program {
+	norm := &Program{Blocks: make([]*Block, 0, len(prog.Blocks))}
+	for _, v := range prog.Variables {
+		norm.Variables = append(norm.Variables, Variable{Type: v.Type, Name: v.Name})
+	}
+	sort.SliceStable(norm.Variables, func(i, j int) bool {
+		return norm.Variables[i].Name < norm.Variables[j].Name
+	})
+	keys := make(map[*Block]string)
+	for _, block := range prog.Blocks {
+		b := normalizeBlock(block)
+		keys[b] = canonicalXML(b)
+		norm.Blocks = append(norm.Blocks, b)
+	}
+	sort.SliceStable(norm.Blocks, func(i, j int) bool {
+		return keys[norm.Blocks[i]] < keys[norm.Blocks[j]]
+	})
+	return norm
+}
+
+// Fingerprint returns a hex SHA-256 of the normal form of a program.
+// Programs with the same fingerprint differ only in ids, positions and the order of top level blocks.
+func Fingerprint(prog *Program) string {
+	sum := sha256.Sum256([]byte(canonicalXML(Normalize(prog))))
+	return hex.EncodeToString(sum[:])
+}
+
+// normalizeBlock returns a copy of the block and everything attached to it in canonical form
+func normalizeBlock(b *Block) *Block {
+	if b == nil {
+		return nil
+	}
+	norm := &Block{Type: b.Type, Shadow: b.Shadow, Disabled: b.Disabled}
+	if b.Mutation != nil {
+		norm.Mutation = &Mutation{
+			Attrs: append([]xml.Attr{}, b.Mutation.Attrs...),
+			Args:  append([]MutationArg{}, b.Mutation.Args...),
+		}
+		sort.SliceStable(norm.Mutation.Attrs, func(i, j int) bool {
+			return norm.Mutation.Attrs[i].Name.Local < norm.Mutation.Attrs[j].Name.Local
+		})
+	}
+	for _, f := range b.Fields {
+		norm.Fields = append(norm.Fields, Field{Name: f.Name, VariableType: f.VariableType, Value: strings.TrimSpace(f.Value)})
+	}
+	sort.SliceStable(norm.Fields, func(i, j int) bool {
+		return norm.Fields[i].Name < norm.Fields[j].Name
+	})
+	norm.Values = normalizeInputs(b.Values)
+	norm.Statements = normalizeInputs(b.Statements)
+	if b.Next != nil {
+		next := normalizeInput(*b.Next)
+		norm.Next = &next
+	}
+	return norm
+}
+
+func normalizeInputs(inputs []Input) []Input {
+	if len(inputs) == 0 {
+		return nil
+	}
+	norm := make([]Input, 0, len(inputs))
+	for _, in := range inputs {
+		norm = append(norm, normalizeInput(in))
+	}
+	sort.SliceStable(norm, func(i, j int) bool {
+		return norm[i].Name < norm[j].Name
+	})
+	return norm
+}
+
+func normalizeInput(in Input) Input {
+	return Input{Name: in.Name, Block: normalizeBlock(in.Block), Shadow: normalizeBlock(in.Shadow)}
+}
+
+// canonicalXML serializes a program or block for comparison
+func canonicalXML(v interface{}) string {
+	data, err := xml.Marshal(v)
+	check("canonicalXML", err)
+	return string(data)
+}
@@ -0,0 +1,62 @@
+package kcode
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalize(t *testing.T) {
+	prog, err := ParseProgram([]byte(walkXML))
+	assert.Nil(t, err)
+	norm := Normalize(prog)
+	// events_onAppStart sorts before events_onGesture
+	assert.Equal(t, "events_onAppStart", norm.Blocks[0].Type)
+	assert.Equal(t, "events_onGesture", norm.Blocks[1].Type)
+	eachBlock(norm, func(b *Block) {
+		assert.Empty(t, b.Id)
+	})
+	// The original is untouched
+	assert.Equal(t, "a", prog.Blocks[0].Id)
+	assert.Equal(t, "events_onGesture", prog.Blocks[0].Type)
+	// Stack order is kept
+	assert.Equal(t, "wand_vibrate", norm.Blocks[1].Input("CALLBACK").Block.Next.Block.Type)
+	assert.True(t, norm.Blocks[1].Input("CALLBACK").Block.Input("TARGET").Target().Shadow)
+}
+
+func TestFingerprint(t *testing.T) {
+	prog, err := ParseProgram([]byte(walkXML))
+	assert.Nil(t, err)
+	fingerprint := Fingerprint(prog)
+	assert.Equal(t, 64, len(fingerprint))
+
+	// Moving blocks, new ids and reordering top level blocks make no difference
+	moved := strings.Replace(walkXML, `id="a">`, `id="zz" x="10" y="20">`, 1)
+	prog2, err := ParseProgram([]byte(moved))
+	assert.Nil(t, err)
+	prog2.Blocks[0], prog2.Blocks[1] = prog2.Blocks[1], prog2.Blocks[0]
+	assert.Equal(t, fingerprint, Fingerprint(prog2))
+
+	// Changing what the creation does does
+	changed, err := ParseProgram([]byte(strings.Replace(walkXML, "reducio", "engorgio", 1)))
+	assert.Nil(t, err)
+	assert.NotEqual(t, fingerprint, Fingerprint(changed))
+}
+
+func TestFingerprintAllChallenges(t *testing.T) {
+	files := ListFilesInDirectory("challenges")
+	for _, f := range files {
+		filename := "challenges/" + f.Name()
+		prog, err := GetProgram(filename)
+		assert.Nil(t, err, filename)
+		// The normal form is stable and parses back to itself
+		norm := Normalize(prog)
+		reparsed, err := ParseProgram([]byte(canonicalXML(norm)))
+		assert.Nil(t, err, filename)
+		assert.Equal(t, Fingerprint(prog), Fingerprint(reparsed), filename)
+	}
+	pumpkins, _ := GetProgram("challenges/022_pumpkins.kcode")
+	pumpkins2, _ := GetProgram("challenges/1022_pumpkins.kcode")
+	assert.Equal(t, Fingerprint(pumpkins), Fingerprint(pumpkins2))
+}
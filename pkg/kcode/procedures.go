@@ -0,0 +1,432 @@
+package kcode
+
+// procedures.go
+// -------------
+// Description:
+// Procedures (Blockly functions) and the call graph of a creation.  A procedure is
+// defined by a top level procedures_defnoreturn or procedures_defreturn block whose NAME
+// field names it and whose mutation lists its arguments.  procedures_callnoreturn and
+// procedures_callreturn blocks call it by the name in their mutation.
+// The call graph has a node for each event handler, each other top level stack and each
+// procedure, with an edge for every caller and callee pair.  Event handlers are the top
+// level events_ blocks along with the every_x_seconds and in_x_time timers at the top
+// level, which the app starts when it loads.  Other stacks are left lying around the
+// workspace and never run.  Calls in disabled blocks are left out since they never run.
+// CheckProcedures reports recursion, procedures that no event handler ever gets to,
+// calls to procedures that are not defined and calls to procedures that are disabled.
+//
+// API:
+// Procedures(prog *Program) []Procedure
+// BuildCallGraph(prog *Program) *CallGraph
+// (g *CallGraph) WriteDOT(w io.Writer) error
+// CheckProcedures(prog *Program) []Issue
+//
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Kinds of node in a call graph
+const (
+	NodeHandler   = "handler"
+	NodeProcedure = "procedure"
+	// NodeStack is a top level stack that is not an event handler so never runs
+	NodeStack = "stack"
+	// NodeUndefined is a procedure that is called but not defined
+	NodeUndefined = "undefined"
+)
+
+// Procedure is a procedure defined in a creation
+type Procedure struct {
+	Name    string   `json:"name"`
+	Args    []string `json:"args"`
+	Returns bool     `json:"returns"`
+	Block   *Block   `json:"-"`
+	Path    string   `json:"path"`
+}
+
+// CallNode is an event handler or procedure.  Id is unique within the graph: handlers
+// are identified by the id of their block and procedures by their name.
+type CallNode struct {
+	Id      string `json:"id"`
+	Kind    string `json:"kind"`
+	Label   string `json:"label"`
+	BlockId string `json:"blockId,omitempty"`
+}
+
+// CallEdge is a caller calling a callee from the call blocks listed
+type CallEdge struct {
+	From     string   `json:"from"`
+	To       string   `json:"to"`
+	BlockIds []string `json:"blockIds"`
+}
+
+// CallGraph is the call graph of a creation.  Nodes are in document order with undefined
+// procedures last and edges are in the order of their first call.
+type CallGraph struct {
+	Nodes []CallNode `json:"nodes"`
+	Edges []CallEdge `json:"edges"`
+}
+
+// procedureCall is a call block along with the handler or procedure it is in
+type procedureCall struct {
+	from  string
+	block *Block
+	path  string
+}
+
+// Procedures returns the enabled procedure definitions in document order
+func Procedures(prog *Program) []Procedure {
+	procedures := make([]Procedure, 0)
+	for i, b := range prog.Blocks {
+		if !isProcedureDefinition(b) || b.Disabled {
+			continue
+		}
+		name, _ := b.Field("NAME")
+		p := Procedure{Name: strings.TrimSpace(name), Args: []string{}, Returns: b.Type == "procedures_defreturn",
+			Block: b, Path: fmt.Sprintf("/block[%d]", i+1)}
+		if b.Mutation != nil {
+			for _, arg := range b.Mutation.Args {
+				p.Args = append(p.Args, arg.Name)
+			}
+		}
+		procedures = append(procedures, p)
+	}
+	return procedures
+}
+
+// BuildCallGraph builds the call graph of a program
+func BuildCallGraph(prog *Program) *CallGraph {
+	g := &CallGraph{Nodes: make([]CallNode, 0), Edges: make([]CallEdge, 0)}
+	defined := make(map[string]bool)
+	for _, p := range Procedures(prog) {
+		defined[p.Name] = true
+	}
+	for i, b := range prog.Blocks {
+		if b.Disabled {
+			continue
+		}
+		if isProcedureDefinition(b) {
+			name, _ := b.Field("NAME")
+			name = strings.TrimSpace(name)
+			if g.node(procedureNodeId(name)) == nil {
+				g.Nodes = append(g.Nodes, CallNode{Id: procedureNodeId(name), Kind: NodeProcedure, Label: name, BlockId: b.Id})
+			}
+		} else {
+			kind := NodeStack
+			if isHandlerRoot(b) {
+				kind = NodeHandler
+			}
+			g.Nodes = append(g.Nodes, CallNode{Id: handlerNodeId(b, i), Kind: kind, Label: handlerLabel(b), BlockId: b.Id})
+		}
+	}
+	undefined := make([]CallNode, 0)
+	for _, call := range procedureCalls(prog) {
+		name := calledProcedure(call.block)
+		to := procedureNodeId(name)
+		if !defined[name] {
+			defined[name] = true
+			undefined = append(undefined, CallNode{Id: to, Kind: NodeUndefined, Label: name})
+		}
+		g.addEdge(call.from, to, call.block.Id)
+	}
+	g.Nodes = append(g.Nodes, undefined...)
+	return g
+}
+
+// WriteDOT writes the call graph in Graphviz DOT form.  Handlers are boxes, other stacks
+// dotted boxes, procedures ellipses and undefined procedures dashed.
+func (g *CallGraph) WriteDOT(w io.Writer) error {
+	var sb strings.Builder
+	sb.WriteString("digraph callgraph {\n")
+	for _, n := range g.Nodes {
+		attrs := ""
+		switch n.Kind {
+		case NodeHandler:
+			attrs = ", shape=box"
+		case NodeStack:
+			attrs = ", shape=box, style=dotted"
+		case NodeUndefined:
+			attrs = ", style=dashed"
+		}
+		sb.WriteString(fmt.Sprintf("  %s [label=%s%s];\n", dotQuote(n.Id), dotQuote(n.Label), attrs))
+	}
+	for _, e := range g.Edges {
+		attrs := ""
+		if len(e.BlockIds) > 1 {
+			attrs = fmt.Sprintf(" [label=\"%d\"]", len(e.BlockIds))
+		}
+		sb.WriteString(fmt.Sprintf("  %s -> %s%s;\n", dotQuote(e.From), dotQuote(e.To), attrs))
+	}
+	sb.WriteString("}\n")
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// CheckProcedures reports recursive procedures, procedures that cannot be reached from
+// any event handler, calls to procedures that are not defined and calls to procedures
+// whose definition is disabled
+func CheckProcedures(prog *Program) []Issue {
+	issues := make([]Issue, 0)
+	procedures := Procedures(prog)
+	names := make([]string, 0, len(procedures))
+	byName := make(map[string]Procedure)
+	for _, p := range procedures {
+		names = append(names, p.Name)
+		byName[p.Name] = p
+	}
+	sort.Strings(names)
+	disabled := make(map[string]bool)
+	for _, b := range prog.Blocks {
+		if isProcedureDefinition(b) && b.Disabled {
+			name, _ := b.Field("NAME")
+			disabled[strings.TrimSpace(name)] = true
+		}
+	}
+	for _, call := range procedureCalls(prog) {
+		name := calledProcedure(call.block)
+		if _, ok := byName[name]; ok {
+			continue
+		}
+		if disabled[name] {
+			issues = append(issues, Issue{Kind: "disabled-procedure", BlockId: call.block.Id, BlockType: call.block.Type, Path: call.path,
+				Message: fmt.Sprintf("procedure '%s' is disabled so calling it does nothing", name)})
+		} else {
+			issues = append(issues, Issue{Kind: "undefined-procedure", BlockId: call.block.Id, BlockType: call.block.Type, Path: call.path,
+				Message: fmt.Sprintf("procedure '%s' is not defined", name), Suggestions: Suggest(name, names)})
+		}
+	}
+	g := BuildCallGraph(prog)
+	for _, cycle := range g.cycles() {
+		p := byName[g.node(cycle[0]).Label]
+		labels := make([]string, 0, len(cycle)+1)
+		for _, id := range append(cycle, cycle[0]) {
+			labels = append(labels, g.node(id).Label)
+		}
+		issues = append(issues, Issue{Kind: "recursive-procedure", BlockId: p.Block.Id, BlockType: p.Block.Type, Path: p.Path,
+			Message: fmt.Sprintf("procedure '%s' is recursive: %s", p.Name, strings.Join(labels, " -> "))})
+	}
+	reached := g.reachable()
+	for _, p := range procedures {
+		if !reached[procedureNodeId(p.Name)] {
+			issues = append(issues, Issue{Kind: "unused-procedure", BlockId: p.Block.Id, BlockType: p.Block.Type, Path: p.Path,
+				Message: fmt.Sprintf("procedure '%s' is never called from an event handler", p.Name)})
+		}
+	}
+	return issues
+}
+
+// cycles returns the procedures that call themselves, directly or through others, as one
+// list per strongly connected component in the order of the graph's nodes
+func (g *CallGraph) cycles() [][]string {
+	// Tarjan's algorithm
+	index := make(map[string]int)
+	low := make(map[string]int)
+	onStack := make(map[string]bool)
+	stack := make([]string, 0)
+	components := make([][]string, 0)
+	var connect func(id string)
+	connect = func(id string) {
+		index[id] = len(index)
+		low[id] = index[id]
+		stack = append(stack, id)
+		onStack[id] = true
+		for _, next := range g.callees(id) {
+			if _, ok := index[next]; !ok {
+				connect(next)
+				if low[next] < low[id] {
+					low[id] = low[next]
+				}
+			} else if onStack[next] && index[next] < low[id] {
+				low[id] = index[next]
+			}
+		}
+		if low[id] != index[id] {
+			return
+		}
+		component := make([]string, 0)
+		for {
+			top := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[top] = false
+			component = append(component, top)
+			if top == id {
+				break
+			}
+		}
+		if len(component) > 1 || containsString(g.callees(id), id) {
+			components = append(components, component)
+		}
+	}
+	for _, n := range g.Nodes {
+		if _, ok := index[n.Id]; !ok {
+			connect(n.Id)
+		}
+	}
+	// Start each cycle at the procedure defined first and follow the calls from it
+	order := make(map[string]int)
+	for i, n := range g.Nodes {
+		order[n.Id] = i
+	}
+	cycles := make([][]string, 0, len(components))
+	for _, component := range components {
+		sort.Slice(component, func(i, j int) bool {
+			return order[component[i]] < order[component[j]]
+		})
+		cycles = append(cycles, g.cyclePath(component))
+	}
+	sort.Slice(cycles, func(i, j int) bool {
+		return order[cycles[i][0]] < order[cycles[j][0]]
+	})
+	return cycles
+}
+
+// cyclePath returns a path through a strongly connected component from its first node back to it
+func (g *CallGraph) cyclePath(component []string) []string {
+	start := component[0]
+	if containsString(g.callees(start), start) {
+		return []string{start}
+	}
+	inComponent := make(map[string]bool)
+	for _, id := range component {
+		inComponent[id] = true
+	}
+	// Breadth first so that the shortest way round is reported
+	previous := map[string]string{start: ""}
+	queue := []string{start}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		for _, next := range g.callees(id) {
+			if next == start {
+				path := []string{}
+				for at := id; at != ""; at = previous[at] {
+					path = append([]string{at}, path...)
+				}
+				return path
+			}
+			if _, seen := previous[next]; !seen && inComponent[next] {
+				previous[next] = id
+				queue = append(queue, next)
+			}
+		}
+	}
+	return component
+}
+
+// reachable returns the nodes that can be reached from an event handler
+func (g *CallGraph) reachable() map[string]bool {
+	reached := make(map[string]bool)
+	var visit func(id string)
+	visit = func(id string) {
+		if reached[id] {
+			return
+		}
+		reached[id] = true
+		for _, next := range g.callees(id) {
+			visit(next)
+		}
+	}
+	for _, n := range g.Nodes {
+		if n.Kind == NodeHandler {
+			visit(n.Id)
+		}
+	}
+	return reached
+}
+
+func (g *CallGraph) callees(id string) []string {
+	callees := make([]string, 0)
+	for _, e := range g.Edges {
+		if e.From == id {
+			callees = append(callees, e.To)
+		}
+	}
+	return callees
+}
+
+func (g *CallGraph) node(id string) *CallNode {
+	for i := range g.Nodes {
+		if g.Nodes[i].Id == id {
+			return &g.Nodes[i]
+		}
+	}
+	return nil
+}
+
+func (g *CallGraph) addEdge(from string, to string, blockId string) {
+	for i := range g.Edges {
+		if g.Edges[i].From == from && g.Edges[i].To == to {
+			g.Edges[i].BlockIds = append(g.Edges[i].BlockIds, blockId)
+			return
+		}
+	}
+	g.Edges = append(g.Edges, CallEdge{From: from, To: to, BlockIds: []string{blockId}})
+}
+
+// procedureCalls returns the enabled call blocks in document order along with the node calling them
+func procedureCalls(prog *Program) []procedureCall {
+	calls := make([]procedureCall, 0)
+	for i, b := range prog.Blocks {
+		from := handlerNodeId(b, i)
+		if isProcedureDefinition(b) {
+			name, _ := b.Field("NAME")
+			from = procedureNodeId(strings.TrimSpace(name))
+		}
+		visit := Visit{Block: b, Link: LinkTop, Parents: []*Block{}, Path: fmt.Sprintf("/block[%d]", i+1)}
+		walk(visit, SkipDisabled(VisitorFunc(func(v Visit) bool {
+			if isProcedureCall(v.Block) {
+				calls = append(calls, procedureCall{from: from, block: v.Block, path: v.Path})
+			}
+			return true
+		})))
+	}
+	return calls
+}
+
+func isProcedureDefinition(b *Block) bool {
+	return b.Type == "procedures_defnoreturn" || b.Type == "procedures_defreturn"
+}
+
+// isHandlerRoot reports whether a top level block is run by the app, i.e. an events_ block or a timer
+func isHandlerRoot(b *Block) bool {
+	return strings.HasPrefix(b.Type, "events_") || b.Type == "every_x_seconds" || b.Type == "in_x_time"
+}
+
+func isProcedureCall(b *Block) bool {
+	return b.Type == "procedures_callnoreturn" || b.Type == "procedures_callreturn"
+}
+
+// calledProcedure is the name of the procedure a call block calls
+func calledProcedure(b *Block) string {
+	name, _ := b.Mutation.Attr("name")
+	return strings.TrimSpace(name)
+}
+
+func procedureNodeId(name string) string {
+	return "procedure:" + name
+}
+
+// handlerNodeId identifies a top level block by its id, or its position if it has none
+func handlerNodeId(b *Block, i int) string {
+	if len(b.Id) > 0 {
+		return "handler:" + b.Id
+	}
+	return fmt.Sprintf("handler:/block[%d]", i+1)
+}
+
+// handlerLabel describes an event handler e.g. events_onGesture(reducio)
+func handlerLabel(b *Block) string {
+	if kind, ok := b.Field("TYPE"); ok {
+		return fmt.Sprintf("%s(%s)", b.Type, strings.TrimSpace(kind))
+	}
+	return b.Type
+}
+
+// dotQuote quotes a DOT id
+func dotQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
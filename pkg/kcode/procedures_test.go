@@ -0,0 +1,121 @@
+package kcode
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const proceduresXML = `<xml><variables></variables>
+	<block type="events_onGesture" id="a">
+	<field name="TYPE">reducio</field>
+	<statement name="CALLBACK">
+	<block type="procedures_callnoreturn" id="b"><mutation name="shrink"><arg name="factor"></arg></mutation>
+	<value name="ARG0"><shadow type="math_number" id="c"><field name="NUM">0.5</field></shadow></value>
+	<next><block type="procedures_callnoreturn" id="d"><mutation name="shrink"><arg name="factor"></arg></mutation>
+	<next><block type="procedures_callnoreturn" id="e"><mutation name="shrnk"></mutation></block></next>
+	</block></next>
+	</block>
+	</statement>
+	</block>
+	<block type="procedures_defnoreturn" id="f">
+	<mutation><arg name="factor" varid="v1"></arg></mutation>
+	<field name="NAME">shrink</field>
+	<statement name="STACK"><block type="procedures_callnoreturn" id="g" disabled="true"><mutation name="bounce"></mutation>
+	<next><block type="procedures_callnoreturn" id="h"><mutation name="wobble"></mutation></block></next></block></statement>
+	</block>
+	<block type="procedures_defnoreturn" id="i"><field name="NAME">wobble</field>
+	<statement name="STACK"><block type="procedures_callnoreturn" id="j"><mutation name="shrink"></mutation></block></statement>
+	</block>
+	<block type="procedures_defreturn" id="k"><field name="NAME">bounce</field>
+	<statement name="STACK"><block type="procedures_callnoreturn" id="l"><mutation name="bounce"></mutation></block></statement>
+	<value name="RETURN"><block type="procedures_callreturn" id="m"><mutation name="bounce"></mutation></block></value>
+	</block></xml>`
+
+func TestProcedures(t *testing.T) {
+	prog, err := ParseProgram([]byte(proceduresXML))
+	assert.Nil(t, err)
+	procedures := Procedures(prog)
+	assert.Equal(t, 3, len(procedures))
+	assert.Equal(t, "shrink", procedures[0].Name)
+	assert.Equal(t, []string{"factor"}, procedures[0].Args)
+	assert.False(t, procedures[0].Returns)
+	assert.Equal(t, "/block[2]", procedures[0].Path)
+	assert.True(t, procedures[2].Returns)
+	assert.Empty(t, procedures[2].Args)
+}
+
+func TestBuildCallGraph(t *testing.T) {
+	prog, err := ParseProgram([]byte(proceduresXML))
+	assert.Nil(t, err)
+	g := BuildCallGraph(prog)
+	assert.Equal(t, []CallNode{
+		{Id: "handler:a", Kind: NodeHandler, Label: "events_onGesture(reducio)", BlockId: "a"},
+		{Id: "procedure:shrink", Kind: NodeProcedure, Label: "shrink", BlockId: "f"},
+		{Id: "procedure:wobble", Kind: NodeProcedure, Label: "wobble", BlockId: "i"},
+		{Id: "procedure:bounce", Kind: NodeProcedure, Label: "bounce", BlockId: "k"},
+		{Id: "procedure:shrnk", Kind: NodeUndefined, Label: "shrnk"},
+	}, g.Nodes)
+	// The disabled call from shrink to bounce is left out
+	assert.Equal(t, []CallEdge{
+		{From: "handler:a", To: "procedure:shrink", BlockIds: []string{"b", "d"}},
+		{From: "handler:a", To: "procedure:shrnk", BlockIds: []string{"e"}},
+		{From: "procedure:shrink", To: "procedure:wobble", BlockIds: []string{"h"}},
+		{From: "procedure:wobble", To: "procedure:shrink", BlockIds: []string{"j"}},
+		// Values are walked before statements
+		{From: "procedure:bounce", To: "procedure:bounce", BlockIds: []string{"m", "l"}},
+	}, g.Edges)
+
+	var sb strings.Builder
+	assert.Nil(t, g.WriteDOT(&sb))
+	dot := sb.String()
+	assert.True(t, strings.HasPrefix(dot, "digraph callgraph {\n"))
+	assert.Contains(t, dot, `  "handler:a" [label="events_onGesture(reducio)", shape=box];`)
+	assert.Contains(t, dot, `  "procedure:shrnk" [label="shrnk", style=dashed];`)
+	assert.Contains(t, dot, `  "handler:a" -> "procedure:shrink" [label="2"];`)
+	assert.Contains(t, dot, `  "procedure:shrink" -> "procedure:wobble";`)
+	assert.True(t, strings.HasSuffix(dot, "}\n"))
+}
+
+func TestCheckProcedures(t *testing.T) {
+	prog, err := ParseProgram([]byte(proceduresXML))
+	assert.Nil(t, err)
+	issues := CheckProcedures(prog)
+	assert.Equal(t, []string{"undefined-procedure", "recursive-procedure", "recursive-procedure", "unused-procedure"}, issueKinds(issues))
+	assert.Equal(t, "e", issues[0].BlockId)
+	assert.Equal(t, []string{"shrink"}, issues[0].Suggestions)
+	assert.Equal(t, "procedure 'shrink' is recursive: shrink -> wobble -> shrink", issues[1].Message)
+	assert.Equal(t, "f", issues[1].BlockId)
+	assert.Equal(t, "procedure 'bounce' is recursive: bounce -> bounce", issues[2].Message)
+	assert.Equal(t, "k", issues[3].BlockId)
+	assert.Equal(t, "/block[4]", issues[3].Path)
+
+	// Procedures are known to the block registry
+	assert.Empty(t, blockRegistry.Check(prog))
+}
+
+func TestCheckProceduresRoots(t *testing.T) {
+	// Only event handlers and top level timers run so procedures called from stacks left
+	// lying around are unused, and a call to a disabled procedure is not undefined
+	prog, err := ParseProgram([]byte(`<xml>
+		<block type="every_x_seconds" id="a"><statement name="DO"><block type="procedures_callnoreturn" id="b"><mutation name="tick"></mutation></block></statement></block>
+		<block type="procedures_callnoreturn" id="c"><mutation name="stray"></mutation>
+		<next><block type="procedures_callnoreturn" id="d"><mutation name="off"></mutation></block></next></block>
+		<block type="procedures_defnoreturn" id="e"><field name="NAME">tick</field></block>
+		<block type="procedures_defnoreturn" id="f"><field name="NAME">stray</field></block>
+		<block type="procedures_defnoreturn" id="g" disabled="true"><field name="NAME">off</field></block>
+		</xml>`))
+	assert.Nil(t, err)
+	g := BuildCallGraph(prog)
+	assert.Equal(t, NodeHandler, g.Nodes[0].Kind)
+	assert.Equal(t, NodeStack, g.Nodes[1].Kind)
+	var sb strings.Builder
+	assert.Nil(t, g.WriteDOT(&sb))
+	assert.Contains(t, sb.String(), `  "handler:c" [label="procedures_callnoreturn", shape=box, style=dotted];`)
+	issues := CheckProcedures(prog)
+	assert.Equal(t, []string{"disabled-procedure", "unused-procedure"}, issueKinds(issues))
+	assert.Equal(t, "d", issues[0].BlockId)
+	assert.Equal(t, "procedure 'off' is disabled so calling it does nothing", issues[0].Message)
+	assert.Equal(t, "f", issues[1].BlockId)
+}
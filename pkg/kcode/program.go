@@ -0,0 +1,245 @@
+package kcode
+
+// program.go
+// ----------
+// Description:
+// Block tree model for the kcode XML held in the "source" of a .kcode file.
+// Extract walks the xml2json output and only keeps type names.  The Program tree
+// keeps each block's fields and inputs attached to it so that checks can look at
+// what a block actually contains.
+//
+// API:
+// ParseProgram(xml []byte) (*Program, error)
+// ExtractProgram(jsdata []byte) (*Program, error)
+// GetProgram(filename string) (*Program, error)
+// (b *Block) Field(name string) (string, bool)
+// (b *Block) Input(name string) *Input
+// (b *Block) IsDeletable() bool
+// (i *Input) Target() *Block
+// (m *Mutation) Attr(name string) (string, bool)
+//
+
+import (
+	"encoding/xml"
+	"errors"
+)
+
+var (
+	errInvalidXML = errors.New("invalid kcode XML")
+)
+
+// Program is the block tree of a creation.
+// kcode XML looks like this:
+//
+//	<xml xmlns="http://www.w3.org/1999/xhtml">
+//	  <variables></variables>
+//	  <block type="events_onGesture" id="..." x="172" y="289">
+//	    <field name="TYPE">accio</field>
+//	    <statement name="CALLBACK"><block ...>...</block></statement>
+//	  </block>
+//	</xml>
+type Program struct {
+	XMLName   xml.Name   `xml:"xml"`
+	Variables []Variable `xml:"variables>variable"`
+	Blocks    []*Block   `xml:"block"`
+}
+
+// Variable is a <variable type="" id="...">name</variable> declared in <variables>
+type Variable struct {
+	Type string `xml:"type,attr"`
+	Id   string `xml:"id,attr,omitempty"`
+	Name string `xml:",chardata"`
+}
+
+// Block is a single <block> or <shadow> element.
+// A <value> input may hold a shadow (the default the user sees), a real block or both,
+// in which case the block wins.
+// A disabled block does not run and neither does anything in its inputs.  Collapsed and
+// deletable only change how the editor shows the block.  Deletable is nil unless the
+// attribute is given since blocks can be deleted by default.
+type Block struct {
+	Type       string    `xml:"type,attr"`
+	Id         string    `xml:"id,attr,omitempty"`
+	X          string    `xml:"x,attr,omitempty"`
+	Y          string    `xml:"y,attr,omitempty"`
+	Disabled   bool      `xml:"disabled,attr,omitempty"`
+	Collapsed  bool      `xml:"collapsed,attr,omitempty"`
+	Deletable  *bool     `xml:"deletable,attr,omitempty"`
+	Shadow     bool      `xml:"-"`
+	Mutation   *Mutation `xml:"mutation"`
+	Fields     []Field   `xml:"field"`
+	Comment    *Comment  `xml:"comment"`
+	Values     []Input   `xml:"value"`
+	Statements []Input   `xml:"statement"`
+	Next       *Input    `xml:"next"`
+}
+
+// Mutation is the <mutation> element holding the extra state of blocks whose shape can
+// change, e.g. <mutation elseif="2" else="1"> on controls_if.  Attributes are kept as
+// they are since each block type has its own.  Procedure blocks list their arguments
+// as <arg name="..."> children.
+type Mutation struct {
+	Attrs []xml.Attr    `xml:",any,attr"`
+	Args  []MutationArg `xml:"arg"`
+}
+
+// MutationArg is an <arg> of a procedure mutation
+type MutationArg struct {
+	Name  string `xml:"name,attr"`
+	VarId string `xml:"varid,attr,omitempty"`
+}
+
+// Comment is the <comment> a user attached to a block.  Pinned comments stay open in the editor.
+type Comment struct {
+	Pinned bool   `xml:"pinned,attr,omitempty"`
+	Height string `xml:"h,attr,omitempty"`
+	Width  string `xml:"w,attr,omitempty"`
+	Text   string `xml:",chardata"`
+}
+
+// Field is a <field name="...">value</field> element.
+// Fields naming a variable also carry the id and type of the variable.
+type Field struct {
+	Name         string `xml:"name,attr"`
+	Id           string `xml:"id,attr,omitempty"`
+	VariableType string `xml:"variabletype,attr,omitempty"`
+	Value        string `xml:",chardata"`
+}
+
+// Input is a <value>, <statement> or <next> element
+type Input struct {
+	Name   string `xml:"name,attr,omitempty"`
+	Block  *Block `xml:"block"`
+	Shadow *Block `xml:"shadow"`
+}
+
+// ParseProgram parses kcode XML into a Program
+func ParseProgram(kcode []byte) (*Program, error) {
+	var prog Program
+	if err := xml.Unmarshal(kcode, &prog); err != nil {
+		return nil, errInvalidXML
+	}
+	for _, block := range prog.Blocks {
+		markShadows(block)
+	}
+	return &prog, nil
+}
+
+// ExtractProgram extracts the kcode XML from .kcode JSON and parses it into a Program
+func ExtractProgram(jsdata []byte) (*Program, error) {
+	kcode, err := ExtractXML(jsdata)
+	if err != nil {
+		return nil, err
+	}
+	return ParseProgram(kcode)
+}
+
+// GetProgram reads a .kcode file and parses it into a Program
+func GetProgram(filename string) (*Program, error) {
+	return ExtractProgram(ReadFile(filename))
+}
+
+// markShadows flags every block that was found inside a <shadow> element
+func markShadows(b *Block) {
+	if b == nil {
+		return
+	}
+	mark := func(in *Input) {
+		if in.Shadow != nil {
+			in.Shadow.Shadow = true
+			markShadows(in.Shadow)
+		}
+		markShadows(in.Block)
+	}
+	for i := range b.Values {
+		mark(&b.Values[i])
+	}
+	for i := range b.Statements {
+		mark(&b.Statements[i])
+	}
+	if b.Next != nil {
+		mark(b.Next)
+	}
+}
+
+// eachBlock calls fn on every block and shadow in the program in document order
+func eachBlock(prog *Program, fn func(b *Block)) {
+	eachBlockPath(prog, func(b *Block, path string) {
+		fn(b)
+	})
+}
+
+// eachEnabledBlockPath is eachBlockPath for the blocks that run, see SkipDisabled
+func eachEnabledBlockPath(prog *Program, fn func(b *Block, path string)) {
+	Walk(prog, SkipDisabled(VisitorFunc(func(v Visit) bool {
+		fn(v.Block, v.Path)
+		return true
+	})))
+}
+
+// eachBlockPath calls fn on every block and shadow in the program in document order
+// along with its path from the root of the XML e.g.
+//
+//	/block[2]/statement[CALLBACK]/block/next/block/value[TARGET]/shadow
+//
+// Top level blocks are numbered from 1 in the order they appear.
+func eachBlockPath(prog *Program, fn func(b *Block, path string)) {
+	Walk(prog, VisitorFunc(func(v Visit) bool {
+		fn(v.Block, v.Path)
+		return true
+	}))
+}
+
+// Field returns the value of the named field on the block
+func (b *Block) Field(name string) (string, bool) {
+	for _, f := range b.Fields {
+		if f.Name == name {
+			return f.Value, true
+		}
+	}
+	return "", false
+}
+
+// Input returns the named value or statement input on the block or nil if there isn't one
+func (b *Block) Input(name string) *Input {
+	for i := range b.Values {
+		if b.Values[i].Name == name {
+			return &b.Values[i]
+		}
+	}
+	for i := range b.Statements {
+		if b.Statements[i].Name == name {
+			return &b.Statements[i]
+		}
+	}
+	return nil
+}
+
+// IsDeletable reports whether the user can delete the block
+func (b *Block) IsDeletable() bool {
+	return b.Deletable == nil || *b.Deletable
+}
+
+// Attr returns the value of the named attribute of the mutation
+func (m *Mutation) Attr(name string) (string, bool) {
+	if m == nil {
+		return "", false
+	}
+	for _, attr := range m.Attrs {
+		if attr.Name.Local == name {
+			return attr.Value, true
+		}
+	}
+	return "", false
+}
+
+// Target returns the block plugged into the input, falling back to its shadow
+func (i *Input) Target() *Block {
+	if i == nil {
+		return nil
+	}
+	if i.Block != nil {
+		return i.Block
+	}
+	return i.Shadow
+}
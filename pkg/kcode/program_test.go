@@ -0,0 +1,49 @@
+package kcode
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseProgram(t *testing.T) {
+	prog, err := GetProgram("challenges/009_accio.kcode")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(prog.Blocks))
+	spell := prog.Blocks[0]
+	assert.Equal(t, "events_onGesture", spell.Type)
+	gesture, ok := spell.Field("TYPE")
+	assert.True(t, ok)
+	assert.Equal(t, "accio", gesture)
+	add := spell.Input("CALLBACK").Target()
+	assert.Equal(t, "objects_add", add.Type)
+	position := add.Input("POSITION").Target()
+	assert.Equal(t, "position_create", position.Type)
+	assert.True(t, position.Shadow)
+	x, _ := position.Input("X").Target().Field("NUM")
+	assert.Equal(t, "400", x)
+}
+
+func TestParseProgramInvalid(t *testing.T) {
+	_, err := ParseProgram([]byte("<xml><block type="))
+	assert.Equal(t, errInvalidXML, err)
+	_, err = ExtractProgram([]byte("not json"))
+	assert.Equal(t, errInvalidJSON, err)
+}
+
+func TestProgramBlockCount(t *testing.T) {
+	// Every <block and <shadow element ends up in the tree
+	files := ListFilesInDirectory("challenges")
+	for _, f := range files {
+		filename := "challenges/" + f.Name()
+		prog, err := GetProgram(filename)
+		assert.Nil(t, err, filename)
+		nblocks := 0
+		eachBlock(prog, func(b *Block) {
+			if !b.Shadow {
+				nblocks++
+			}
+		})
+		assert.Equal(t, BlockCount(GetXML(filename)), nblocks, filename)
+	}
+}
@@ -0,0 +1,333 @@
+package kcode
+
+// query.go
+// --------
+// Description:
+// A small CSS-like selector language for finding blocks in a Program, e.g.
+//   events_onGesture[TYPE=engorgio] objects_scale
+// finds every objects_scale block anywhere under an engorgio spell.  A selector is a
+// list of compound selectors joined by combinators:
+//   A B        B is nested anywhere inside A
+//   A > B      B is directly inside A i.e. in one of A's inputs or the stack in it
+// A compound selector is a block type, or * for any type, followed by any of:
+//   [NAME]         the block has field NAME
+//   [NAME=value]   field NAME is value.  Also != ^= (prefix) $= (suffix) and *= (contains)
+//   [id=value]     the block id is value
+//   :in(NAME)      the block is in the input NAME of the block enclosing it
+//   :shadow        the block is a shadow
+// The type can be left out when there are predicates.  Values can be quoted with ' or ".
+// A type without a part prefix also matches part blocks, so speaker_play matches
+// speaker2#speaker_play.
+//
+// API:
+// ParseSelector(selector string) (*Selector, error)
+// (s *Selector) Match(prog *Program) []Match
+// Query(prog *Program, selector string) ([]Match, error)
+//
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	errInvalidSelector = errors.New("invalid selector")
+)
+
+// Selector is a parsed selector
+type Selector struct {
+	steps []selectorStep
+}
+
+// Match is a block matched by a selector along with its path in the program
+type Match struct {
+	Block *Block
+	Path  string
+}
+
+// selectorStep is one compound selector and the combinator joining it to the step before
+type selectorStep struct {
+	combinator string
+	blockType  string
+	predicates []selectorPredicate
+	input      string
+	shadow     bool
+}
+
+type selectorPredicate struct {
+	name  string
+	op    string
+	value string
+}
+
+// selectorParser holds the state of ParseSelector
+type selectorParser struct {
+	src string
+	pos int
+}
+
+// ParseSelector parses a selector, see the description at the top of query.go
+func ParseSelector(selector string) (*Selector, error) {
+	p := &selectorParser{src: selector}
+	s := &Selector{}
+	p.skipSpace()
+	if p.done() {
+		return nil, p.errorf("empty selector")
+	}
+	combinator := ""
+	for {
+		step, err := p.parseStep()
+		if err != nil {
+			return nil, err
+		}
+		step.combinator = combinator
+		s.steps = append(s.steps, step)
+		spaced := p.skipSpace()
+		if p.done() {
+			return s, nil
+		}
+		switch {
+		case p.peek() == '>':
+			p.pos++
+			p.skipSpace()
+			combinator = ">"
+		case spaced:
+			combinator = " "
+		default:
+			return nil, p.errorf("unexpected '%c'", p.peek())
+		}
+	}
+}
+
+// Query finds the blocks in a program matching a selector
+func Query(prog *Program, selector string) ([]Match, error) {
+	s, err := ParseSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	return s.Match(prog), nil
+}
+
+// Match returns the blocks in the program that match the selector in document order
+func (s *Selector) Match(prog *Program) []Match {
+	matches := make([]Match, 0)
+	visits := make(map[*Block]Visit)
+	Walk(prog, VisitorFunc(func(v Visit) bool {
+		visits[v.Block] = v
+		if s.matches(len(s.steps)-1, v, visits) {
+			matches = append(matches, Match{Block: v.Block, Path: v.Path})
+		}
+		return true
+	}))
+	return matches
+}
+
+// matches checks steps[i] against the visit then the steps before it against the enclosing blocks
+func (s *Selector) matches(i int, v Visit, visits map[*Block]Visit) bool {
+	step := s.steps[i]
+	if !step.matches(v) {
+		return false
+	}
+	if i == 0 {
+		return true
+	}
+	if step.combinator == ">" {
+		parent := v.Parent()
+		return parent != nil && s.matches(i-1, visits[parent], visits)
+	}
+	for j := len(v.Parents) - 1; j >= 0; j-- {
+		if s.matches(i-1, visits[v.Parents[j]], visits) {
+			return true
+		}
+	}
+	return false
+}
+
+func (step selectorStep) matches(v Visit) bool {
+	b := v.Block
+	if len(step.blockType) > 0 && step.blockType != "*" && step.blockType != b.Type {
+		i := strings.Index(b.Type, "#")
+		if strings.Contains(step.blockType, "#") || i < 0 || b.Type[i+1:] != step.blockType {
+			return false
+		}
+	}
+	if len(step.input) > 0 && (step.input != v.Input || v.Link == LinkTop) {
+		return false
+	}
+	if step.shadow && !b.Shadow {
+		return false
+	}
+	for _, pred := range step.predicates {
+		value, ok := b.Id, true
+		if pred.name != "id" {
+			value, ok = b.Field(pred.name)
+		}
+		if !ok {
+			return false
+		}
+		if !pred.matches(strings.TrimSpace(value)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (pred selectorPredicate) matches(value string) bool {
+	switch pred.op {
+	case "=":
+		return value == pred.value
+	case "!=":
+		return value != pred.value
+	case "^=":
+		return strings.HasPrefix(value, pred.value)
+	case "$=":
+		return strings.HasSuffix(value, pred.value)
+	case "*=":
+		return strings.Contains(value, pred.value)
+	}
+	// [NAME] only checks the field is there
+	return true
+}
+
+func (p *selectorParser) parseStep() (selectorStep, error) {
+	var step selectorStep
+	start := p.pos
+	if p.done() {
+		return step, p.errorf("expected a block type")
+	}
+	if p.peek() == '*' {
+		p.pos++
+		step.blockType = "*"
+	} else {
+		step.blockType = p.ident()
+	}
+	for !p.done() {
+		switch p.peek() {
+		case '[':
+			pred, err := p.parsePredicate()
+			if err != nil {
+				return step, err
+			}
+			step.predicates = append(step.predicates, pred)
+		case ':':
+			p.pos++
+			switch name := p.ident(); name {
+			case "in":
+				if !p.consume('(') {
+					return step, p.errorf("expected '(' after :in")
+				}
+				step.input = p.ident()
+				if len(step.input) == 0 || !p.consume(')') {
+					return step, p.errorf("expected :in(NAME)")
+				}
+			case "shadow":
+				step.shadow = true
+			default:
+				return step, p.errorf("unknown pseudo-class ':%s'", name)
+			}
+		default:
+			if p.pos == start {
+				return step, p.errorf("expected a block type, '*', '[' or ':' but found '%c'", p.peek())
+			}
+			return step, nil
+		}
+	}
+	return step, nil
+}
+
+func (p *selectorParser) parsePredicate() (selectorPredicate, error) {
+	var pred selectorPredicate
+	p.pos++ // [
+	p.skipSpace()
+	pred.name = p.ident()
+	if len(pred.name) == 0 {
+		return pred, p.errorf("expected a field name after '['")
+	}
+	p.skipSpace()
+	for _, op := range []string{"!=", "^=", "$=", "*=", "="} {
+		if strings.HasPrefix(p.src[p.pos:], op) {
+			pred.op = op
+			p.pos += len(op)
+			break
+		}
+	}
+	if len(pred.op) > 0 {
+		p.skipSpace()
+		value, err := p.value()
+		if err != nil {
+			return pred, err
+		}
+		pred.value = value
+		p.skipSpace()
+	}
+	if !p.consume(']') {
+		return pred, p.errorf("expected ']'")
+	}
+	return pred, nil
+}
+
+// value reads a quoted string or everything up to the closing ]
+func (p *selectorParser) value() (string, error) {
+	if p.done() {
+		return "", p.errorf("expected ']'")
+	}
+	if q := p.peek(); q == '\'' || q == '"' {
+		end := strings.IndexByte(p.src[p.pos+1:], q)
+		if end < 0 {
+			return "", p.errorf("unterminated string")
+		}
+		value := p.src[p.pos+1 : p.pos+1+end]
+		p.pos += end + 2
+		return value, nil
+	}
+	end := strings.IndexByte(p.src[p.pos:], ']')
+	if end < 0 {
+		return "", p.errorf("expected ']'")
+	}
+	value := strings.TrimSpace(p.src[p.pos : p.pos+end])
+	p.pos += end
+	return value, nil
+}
+
+// ident reads a block type, field or input name.  Part blocks have a # in their type.
+func (p *selectorParser) ident() string {
+	start := p.pos
+	for !p.done() {
+		c := p.peek()
+		if c == '_' || c == '#' || c == '-' || c == '.' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' {
+			p.pos++
+		} else {
+			break
+		}
+	}
+	return p.src[start:p.pos]
+}
+
+func (p *selectorParser) skipSpace() bool {
+	start := p.pos
+	for !p.done() && strings.IndexByte(" \t\n\r", p.peek()) >= 0 {
+		p.pos++
+	}
+	return p.pos > start
+}
+
+func (p *selectorParser) consume(c byte) bool {
+	if !p.done() && p.peek() == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *selectorParser) done() bool {
+	return p.pos >= len(p.src)
+}
+
+func (p *selectorParser) peek() byte {
+	return p.src[p.pos]
+}
+
+func (p *selectorParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w at offset %d: %s", errInvalidSelector, p.pos, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,69 @@
+package kcode
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func matchIds(matches []Match) []string {
+	ids := make([]string, 0, len(matches))
+	for _, m := range matches {
+		ids = append(ids, m.Block.Id)
+	}
+	return ids
+}
+
+func TestQuery(t *testing.T) {
+	prog, err := ParseProgram([]byte(walkXML))
+	assert.Nil(t, err)
+	for selector, expected := range map[string][]string{
+		"objects_scale": {"b"},
+		"events_onGesture[TYPE=reducio] math_number": {"d", "f"},
+		"events_onGesture[TYPE=engorgio] *":          {},
+		"events_onGesture > *":                       {"b", "g"},
+		"objects_scale > math_number":                {"d"},
+		"objects_scale math_number":                  {"d", "f"},
+		"* > :in(FACTOR)":                            {"d", "e"},
+		"math_number:shadow[NUM='2']":                {"f"},
+		"[NUM^=1]":                                   {"d"},
+		"[NUM != 1]":                                 {"f"},
+		"objects_get[ID*=al]":                        {"c"},
+		"[id=g]":                                     {"g"},
+		":in(CALLBACK)":                              {"b", "g"},
+		"objects_scale > objects_scale":              {},
+	} {
+		matches, err := Query(prog, selector)
+		assert.Nil(t, err, selector)
+		assert.Equal(t, expected, matchIds(matches), selector)
+	}
+	matches, _ := Query(prog, "wand_vibrate")
+	assert.Equal(t, "/block[1]/statement[CALLBACK]/block/next/block", matches[0].Path)
+}
+
+func TestQueryChallenge(t *testing.T) {
+	prog, err := GetProgram("challenges/1022_pumpkins.kcode")
+	assert.Nil(t, err)
+	matches, err := Query(prog, "events_onGesture[TYPE=engorgio] objects_scale")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(matches))
+	for _, m := range matches {
+		assert.Equal(t, "objects_scale", m.Block.Type)
+	}
+}
+
+func TestQueryPartBlocks(t *testing.T) {
+	prog, err := GetProgram("challenges/020_big_beans.kcode")
+	assert.Nil(t, err)
+	matches, err := Query(prog, "speaker_play")
+	assert.Nil(t, err)
+	assert.NotEmpty(t, matches)
+	assert.Contains(t, matches[0].Block.Type, "#speaker_play")
+}
+
+func TestParseSelectorInvalid(t *testing.T) {
+	for _, selector := range []string{"", "objects_scale >", "[NUM", "[=1]", ":in(", ":nope", "a[NUM='1]", "a ) b", "[NUM="} {
+		_, err := ParseSelector(selector)
+		assert.ErrorIs(t, err, errInvalidSelector, selector)
+	}
+}
@@ -0,0 +1,311 @@
+package kcode
+
+// registry.go
+// -----------
+// Description:
+// Registry of the block types kcode knows about.  Each type lists its fields, value
+// inputs, statement inputs and output.  The registry is loaded from Blockly-style JSON
+// block definitions, the defaults being embedded from blocks.json, e.g.
+//   {"type": "math_number", "message0": "%1", "args0": [{"type": "field_number", "name": "NUM"}], "output": "Number"}
+// Value inputs are required unless the arg is marked "optional": true.  An input named
+// with a trailing 0 such as IF0 also accepts IF1, IF2... as added by Blockly mutators.
+// Part blocks are named "<part id>#<type>" in creations, e.g. "speaker2#speaker_loop",
+// and are registered under <type>.
+//
+// API:
+// ParseBlockRegistry(data []byte) (*BlockRegistry, error)
+// LoadBlockRegistry(filename string) (*BlockRegistry, error)
+// DefaultBlockRegistry() *BlockRegistry
+// SetBlockRegistry(registry *BlockRegistry)
+// (r *BlockRegistry) AddDefinitions(data []byte) error
+// (r *BlockRegistry) Lookup(blockType string) (*BlockSchema, bool)
+// (r *BlockRegistry) Types() []string
+// (r *BlockRegistry) Check(prog *Program) []Issue
+// ValidateBlocks(jsdata []byte) ([]Issue, error)
+//
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+//go:embed blocks.json
+var defaultBlockData []byte
+
+var (
+	errInvalidBlockDefinitions = errors.New("invalid block definitions")
+	// blockRegistry is the registry used by ValidateBlocks
+	blockRegistry = DefaultBlockRegistry()
+)
+
+// FieldSchema describes a field on a block.  Kind is the Blockly field type e.g. field_dropdown.
+type FieldSchema struct {
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+}
+
+// InputSchema describes a value or statement input on a block
+type InputSchema struct {
+	Name     string   `json:"name"`
+	Check    []string `json:"check,omitempty"`
+	Optional bool     `json:"optional,omitempty"`
+}
+
+// BlockSchema describes a block type.
+// HasOutput is set for value blocks, Output lists the types the value can take
+// and is empty when any type is allowed.
+type BlockSchema struct {
+	Type       string        `json:"type"`
+	Fields     []FieldSchema `json:"fields"`
+	Values     []InputSchema `json:"values"`
+	Statements []InputSchema `json:"statements"`
+	HasOutput  bool          `json:"hasOutput"`
+	Output     []string      `json:"output,omitempty"`
+	Previous   bool          `json:"previous"`
+	Next       bool          `json:"next"`
+}
+
+// BlockRegistry holds the known block types keyed by type name
+type BlockRegistry struct {
+	types map[string]*BlockSchema
+}
+
+// blocklyArg is an entry in the argsN array of a Blockly block definition
+type blocklyArg struct {
+	Type     string          `json:"type"`
+	Name     string          `json:"name"`
+	Check    json.RawMessage `json:"check"`
+	Optional bool            `json:"optional"`
+}
+
+// ParseBlockRegistry creates a registry from a JSON array of Blockly block definitions
+func ParseBlockRegistry(data []byte) (*BlockRegistry, error) {
+	r := &BlockRegistry{types: make(map[string]*BlockSchema)}
+	if err := r.AddDefinitions(data); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// LoadBlockRegistry reads Blockly block definitions from a JSON file on disk
+func LoadBlockRegistry(filename string) (*BlockRegistry, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParseBlockRegistry(data)
+}
+
+// DefaultBlockRegistry returns the embedded block registry
+func DefaultBlockRegistry() *BlockRegistry {
+	r, err := ParseBlockRegistry(defaultBlockData)
+	check("defaultBlockRegistry", err)
+	return r
+}
+
+// SetBlockRegistry replaces the registry used by ValidateBlocks.  Passing nil restores the default.
+func SetBlockRegistry(registry *BlockRegistry) {
+	if registry == nil {
+		registry = DefaultBlockRegistry()
+	}
+	blockRegistry = registry
+	resetConfigHash()
+}
+
+// AddDefinitions adds Blockly block definitions to the registry, replacing any types already registered
+func (r *BlockRegistry) AddDefinitions(data []byte) error {
+	var defs []map[string]json.RawMessage
+	if err := json.Unmarshal(data, &defs); err != nil {
+		return errInvalidBlockDefinitions
+	}
+	for _, def := range defs {
+		schema, err := parseBlockDefinition(def)
+		if err != nil {
+			return err
+		}
+		r.types[schema.Type] = schema
+	}
+	// The registry may be the one in use, whose hash is part of cache keys
+	resetConfigHash()
+	return nil
+}
+
+func parseBlockDefinition(def map[string]json.RawMessage) (*BlockSchema, error) {
+	var schema BlockSchema
+	if err := json.Unmarshal(def["type"], &schema.Type); err != nil || len(schema.Type) == 0 {
+		return nil, errInvalidBlockDefinitions
+	}
+	// Blockly spreads args over args0, args1... to match message0, message1...
+	for i := 0; ; i++ {
+		raw, ok := def[fmt.Sprintf("args%d", i)]
+		if !ok {
+			break
+		}
+		var args []blocklyArg
+		if err := json.Unmarshal(raw, &args); err != nil {
+			return nil, errInvalidBlockDefinitions
+		}
+		for _, arg := range args {
+			switch {
+			case arg.Type == "input_value":
+				schema.Values = append(schema.Values, InputSchema{Name: arg.Name, Check: parseCheck(arg.Check), Optional: arg.Optional})
+			case arg.Type == "input_statement":
+				schema.Statements = append(schema.Statements, InputSchema{Name: arg.Name, Check: parseCheck(arg.Check), Optional: true})
+			case strings.HasPrefix(arg.Type, "field_"):
+				schema.Fields = append(schema.Fields, FieldSchema{Name: arg.Name, Kind: arg.Type})
+			}
+		}
+	}
+	if output, ok := def["output"]; ok {
+		schema.HasOutput = true
+		schema.Output = parseCheck(output)
+	}
+	_, schema.Previous = def["previousStatement"]
+	_, schema.Next = def["nextStatement"]
+	return &schema, nil
+}
+
+// parseCheck handles Blockly type checks which are null, a single type or a list of types
+func parseCheck(raw json.RawMessage) []string {
+	var one string
+	if err := json.Unmarshal(raw, &one); err == nil && len(one) > 0 {
+		return []string{one}
+	}
+	var many []string
+	if err := json.Unmarshal(raw, &many); err == nil {
+		return many
+	}
+	return nil
+}
+
+// Lookup finds the schema for a block type.  Part prefixes such as "speaker#" are ignored.
+func (r *BlockRegistry) Lookup(blockType string) (*BlockSchema, bool) {
+	if i := strings.Index(blockType, "#"); i >= 0 {
+		blockType = blockType[i+1:]
+	}
+	schema, ok := r.types[blockType]
+	return schema, ok
+}
+
+// Types returns the names of all registered block types in sorted order
+func (r *BlockRegistry) Types() []string {
+	types := make([]string, 0, len(r.types))
+	for t := range r.types {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// Check validates every block in a program against the registry.
+// It reports unknown block types, unknown or misspelled fields and inputs,
+// missing required inputs and blocks plugged into the wrong kind of connection.
+func (r *BlockRegistry) Check(prog *Program) []Issue {
+	issues := make([]Issue, 0)
+	var checkBlock func(b *Block, connection string, path string)
+	checkInputs := func(b *Block, schema *BlockSchema, inputs []Input, known []InputSchema, connection string, path string) {
+		names := make([]string, 0, len(known))
+		for _, in := range known {
+			names = append(names, in.Name)
+		}
+		for _, in := range inputs {
+			if schema != nil && !matchesInput(in.Name, known) {
+				issues = append(issues, Issue{Kind: "unknown-input", BlockId: b.Id, BlockType: b.Type, Path: path,
+					Message: fmt.Sprintf("%s has no %s input '%s'", b.Type, connection, in.Name), Suggestions: Suggest(in.Name, names)})
+			}
+			inpath := fmt.Sprintf("%s/%s[%s]", path, connection, in.Name)
+			checkBlock(in.Shadow, connection, inpath+"/shadow")
+			checkBlock(in.Block, connection, inpath+"/block")
+		}
+	}
+	checkBlock = func(b *Block, connection string, path string) {
+		if b == nil {
+			return
+		}
+		add := func(kind string, msg string, suggestions []string) {
+			issues = append(issues, Issue{Kind: kind, BlockId: b.Id, BlockType: b.Type, Path: path, Message: msg, Suggestions: suggestions})
+		}
+		schema, ok := r.Lookup(b.Type)
+		if !ok {
+			add("unknown-block-type", fmt.Sprintf("unknown block type '%s'", b.Type), Suggest(b.Type, r.Types()))
+		} else {
+			switch {
+			case connection == "value" && !schema.HasOutput:
+				add("bad-connection", fmt.Sprintf("%s has no output but is plugged into a value input", b.Type), nil)
+			case connection == "statement" && !schema.Previous:
+				add("bad-connection", fmt.Sprintf("%s cannot be placed in a statement", b.Type), nil)
+			}
+			fieldNames := make([]string, 0, len(schema.Fields))
+			for _, f := range schema.Fields {
+				fieldNames = append(fieldNames, f.Name)
+			}
+			for _, f := range b.Fields {
+				if !containsString(fieldNames, f.Name) {
+					add("unknown-field", fmt.Sprintf("%s has no field '%s'", b.Type, f.Name), Suggest(f.Name, fieldNames))
+				}
+			}
+			for _, in := range schema.Values {
+				if !in.Optional && b.Input(in.Name).Target() == nil {
+					add("missing-input", fmt.Sprintf("%s is missing required input '%s'", b.Type, in.Name), nil)
+				}
+			}
+		}
+		var values, statements []InputSchema
+		if schema != nil {
+			values, statements = schema.Values, schema.Statements
+		}
+		checkInputs(b, schema, b.Values, values, "value", path)
+		checkInputs(b, schema, b.Statements, statements, "statement", path)
+		if b.Next != nil {
+			if schema != nil && !schema.Next {
+				add("bad-connection", fmt.Sprintf("%s cannot have a block after it", b.Type), nil)
+			}
+			checkBlock(b.Next.Block, "statement", path+"/next/block")
+		}
+	}
+	for i, block := range prog.Blocks {
+		checkBlock(block, "top", fmt.Sprintf("/block[%d]", i+1))
+	}
+	return issues
+}
+
+// ValidateBlocks checks the blocks of a .kcode file against the current block registry
+func ValidateBlocks(jsdata []byte) ([]Issue, error) {
+	prog, err := ExtractProgram(jsdata)
+	if err != nil {
+		return nil, err
+	}
+	return blockRegistry.Check(prog), nil
+}
+
+// matchesInput reports whether name is one of the inputs, allowing mutator
+// numbering so that IF0 in the schema also matches IF1, IF2...
+func matchesInput(name string, inputs []InputSchema) bool {
+	for _, in := range inputs {
+		if in.Name == name {
+			return true
+		}
+		if strings.HasSuffix(in.Name, "0") {
+			prefix := strings.TrimSuffix(in.Name, "0")
+			suffix := strings.TrimPrefix(name, prefix)
+			if strings.HasPrefix(name, prefix) && len(suffix) > 0 && strings.Trim(suffix, "0123456789") == "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,61 @@
+package kcode
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlockRegistry(t *testing.T) {
+	registry := DefaultBlockRegistry()
+	schema, ok := registry.Lookup("events_onGesture")
+	assert.True(t, ok)
+	assert.Equal(t, "TYPE", schema.Fields[0].Name)
+	assert.Equal(t, "CALLBACK", schema.Statements[0].Name)
+	assert.False(t, schema.HasOutput)
+	schema, ok = registry.Lookup("math_number")
+	assert.True(t, ok)
+	assert.True(t, schema.HasOutput)
+	assert.Equal(t, []string{"Number"}, schema.Output)
+	// Part blocks are registered without their part prefix
+	_, ok = registry.Lookup("speaker3#speaker_loop")
+	assert.True(t, ok)
+}
+
+func TestValidateBlocksAllChallenges(t *testing.T) {
+	files := ListFilesInDirectory("challenges")
+	for _, f := range files {
+		filename := "challenges/" + f.Name()
+		issues, err := ValidateBlocks(ReadFile(filename))
+		assert.Nil(t, err, filename)
+		assert.Empty(t, issues, filename)
+	}
+}
+
+func TestBlockRegistryCheck(t *testing.T) {
+	registry, err := ParseBlockRegistry([]byte(`[
+		{"type": "events_onGesture", "message0": "on %1", "args0": [{"type": "field_dropdown", "name": "TYPE"}],
+		 "message1": "%1", "args1": [{"type": "input_statement", "name": "CALLBACK"}]},
+		{"type": "objects_scale", "message0": "scale %1 %2", "args0": [{"type": "input_value", "name": "TARGET"},
+		 {"type": "input_value", "name": "VALUE", "check": "Number"}], "previousStatement": null, "nextStatement": null},
+		{"type": "controls_if", "message0": "if %1 %2", "args0": [{"type": "input_value", "name": "IF0", "check": "Boolean"},
+		 {"type": "input_statement", "name": "DO0"}], "previousStatement": null, "nextStatement": null},
+		{"type": "math_number", "message0": "%1", "args0": [{"type": "field_number", "name": "NUM"}], "output": "Number"}]`))
+	assert.Nil(t, err)
+	schema, _ := registry.Lookup("objects_scale")
+	assert.Equal(t, []string{"Number"}, schema.Values[1].Check)
+
+	prog, err := ParseProgram([]byte(`<xml><block type="events_onGesture" id="a"><field name="TPYE">reducio</field>
+		<statement name="CALLBACK"><block type="objects_scale" id="b">
+		<value name="VALUE"><shadow type="math_number" id="c"><field name="NUM">0.5</field></shadow></value>
+		<next><block type="objects_spin" id="d"></block></next></block></statement></block>
+		<block type="controls_if" id="e"><statement name="DO1"><block type="math_number" id="f"><field name="NUM">1</field></block></statement></block></xml>`))
+	assert.Nil(t, err)
+	issues := registry.Check(prog)
+	kinds := make([]string, 0)
+	for _, issue := range issues {
+		kinds = append(kinds, issue.Kind+":"+issue.BlockId)
+	}
+	assert.Equal(t, []string{"unknown-field:a", "missing-input:b", "unknown-block-type:d", "missing-input:e", "bad-connection:f"}, kinds)
+	assert.Equal(t, []string{"TYPE"}, issues[0].Suggestions)
+}
@@ -0,0 +1,149 @@
+package kcode
+
+// sarif.go
+// --------
+// Description:
+// SARIF 2.1.0 output for lint and validation issues so that code review tools can show them.
+// Each result is located by file.  Its logical location is the block, named by block id
+// with the block type and path alongside.
+//
+// API:
+// WriteSARIF(w io.Writer, files []FileIssues) error
+// (r *ValidationReport) FileIssues() FileIssues
+//
+
+import (
+	"encoding/json"
+	"io"
+	"path/filepath"
+)
+
+const (
+	sarifVersion = "2.1.0"
+	sarifSchema  = "https://json.schemastore.org/sarif-2.1.0.json"
+	toolName     = "kcode"
+	toolURI      = "https://github.com/malminhas/kcode"
+)
+
+// FileIssues holds the issues found in one file
+type FileIssues struct {
+	File   string  `json:"file"`
+	Issues []Issue `json:"issues"`
+}
+
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	Id                   string            `json:"id"`
+	ShortDescription     sarifMessage      `json:"shortDescription"`
+	DefaultConfiguration sarifRuleDefaults `json:"defaultConfiguration"`
+}
+
+type sarifRuleDefaults struct {
+	Level string `json:"level"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleId    string          `json:"ruleId"`
+	RuleIndex int             `json:"ruleIndex"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation  `json:"physicalLocation"`
+	LogicalLocations []sarifLogicalLocation `json:"logicalLocations,omitempty"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+type sarifLogicalLocation struct {
+	Name               string            `json:"name"`
+	FullyQualifiedName string            `json:"fullyQualifiedName,omitempty"`
+	Kind               string            `json:"kind"`
+	Properties         map[string]string `json:"properties,omitempty"`
+}
+
+// FileIssues returns the discrepancies and warnings of a validation report
+func (r *ValidationReport) FileIssues() FileIssues {
+	issues := make([]Issue, 0, len(r.Discrepancies)+len(r.Warnings))
+	issues = append(issues, r.Discrepancies...)
+	issues = append(issues, r.Warnings...)
+	return FileIssues{File: r.File, Issues: issues}
+}
+
+// WriteSARIF writes the issues as a SARIF 2.1.0 log with a single run
+func WriteSARIF(w io.Writer, files []FileIssues) error {
+	run := sarifRun{
+		Tool:    sarifTool{Driver: sarifDriver{Name: toolName, InformationURI: toolURI, Rules: make([]sarifRule, 0)}},
+		Results: make([]sarifResult, 0),
+	}
+	ruleIndex := make(map[string]int)
+	for _, file := range files {
+		for _, issue := range file.Issues {
+			rule := RuleFor(issue.Kind)
+			index, ok := ruleIndex[rule.Id]
+			if !ok {
+				index = len(run.Tool.Driver.Rules)
+				ruleIndex[rule.Id] = index
+				run.Tool.Driver.Rules = append(run.Tool.Driver.Rules, sarifRule{
+					Id:                   rule.Id,
+					ShortDescription:     sarifMessage{rule.Description},
+					DefaultConfiguration: sarifRuleDefaults{rule.Level},
+				})
+			}
+			location := sarifLocation{
+				PhysicalLocation: sarifPhysicalLocation{ArtifactLocation: sarifArtifactLocation{URI: filepath.ToSlash(file.File)}},
+			}
+			if len(issue.BlockId) > 0 {
+				location.LogicalLocations = []sarifLogicalLocation{{
+					Name:               issue.BlockId,
+					FullyQualifiedName: issue.Path,
+					Kind:               "element",
+					Properties:         map[string]string{"blockType": issue.BlockType},
+				}}
+			}
+			message := issue.Message + issue.didYouMean()
+			run.Results = append(run.Results, sarifResult{
+				RuleId:    rule.Id,
+				RuleIndex: index,
+				Level:     rule.Level,
+				Message:   sarifMessage{message},
+				Locations: []sarifLocation{location},
+			})
+		}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(sarifLog{Schema: sarifSchema, Version: sarifVersion, Runs: []sarifRun{run}})
+}
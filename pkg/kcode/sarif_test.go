@@ -0,0 +1,44 @@
+package kcode
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteSARIF(t *testing.T) {
+	files := []FileIssues{
+		{File: "good.kcode", Issues: []Issue{}},
+		{File: "bad.kcode", Issues: []Issue{
+			{Kind: "unknown-block-type", BlockId: "b", BlockType: "wand_vibrat", Path: "/block[1]/statement[CALLBACK]/block",
+				Message: "unknown block type 'wand_vibrat'", Suggestions: []string{"wand_vibrate"}},
+			{Kind: KindMalformed, Message: "no kcode source"},
+		}},
+	}
+	var buf bytes.Buffer
+	assert.Nil(t, WriteSARIF(&buf, files))
+
+	var log sarifLog
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &log))
+	assert.Equal(t, "2.1.0", log.Version)
+	run := log.Runs[0]
+	assert.Equal(t, "kcode", run.Tool.Driver.Name)
+	assert.Equal(t, 2, len(run.Tool.Driver.Rules))
+	assert.Equal(t, 2, len(run.Results))
+
+	result := run.Results[0]
+	assert.Equal(t, "unknown-block-type", result.RuleId)
+	assert.Equal(t, "warning", result.Level)
+	assert.Equal(t, "unknown block type 'wand_vibrat' - did you mean 'wand_vibrate'?", result.Message.Text)
+	assert.Equal(t, "bad.kcode", result.Locations[0].PhysicalLocation.ArtifactLocation.URI)
+	assert.Equal(t, "b", result.Locations[0].LogicalLocations[0].Name)
+	assert.Equal(t, "wand_vibrat", result.Locations[0].LogicalLocations[0].Properties["blockType"])
+
+	result = run.Results[1]
+	assert.Equal(t, KindMalformed, result.RuleId)
+	assert.Equal(t, 1, result.RuleIndex)
+	assert.Equal(t, "error", result.Level)
+	assert.Empty(t, result.Locations[0].LogicalLocations)
+}
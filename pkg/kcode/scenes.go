@@ -0,0 +1,223 @@
+package kcode
+
+// scenes.go
+// ---------
+// Description:
+// Catalogue of the scenes a creation can be set in.  Each scene lists the objects
+// placed in it, its backgrounds and the bounds of its canvas.  The default catalogue
+// is embedded from scenes.json and can be swapped for one loaded from disk.
+//
+// API:
+// ParseSceneCatalogue(data []byte) (*SceneCatalogue, error)
+// LoadSceneCatalogue(filename string) (*SceneCatalogue, error)
+// DefaultSceneCatalogue() *SceneCatalogue
+// SetSceneCatalogue(catalogue *SceneCatalogue)
+// (c *SceneCatalogue) Lookup(name string) (Scene, bool)
+// (c *SceneCatalogue) Names() []string
+// (c *SceneCatalogue) Check(scene string, prog *Program) []Issue
+// ValidateScene(jsdata []byte) ([]Issue, error)
+//
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+)
+
+//go:embed scenes.json
+var defaultSceneData []byte
+
+var (
+	errInvalidSceneCatalogue = errors.New("invalid scene catalogue")
+	// sceneCatalogue is the catalogue used by ValidateScene
+	sceneCatalogue = DefaultSceneCatalogue()
+)
+
+// objects_get accepts these IDs in every scene
+var wildcardObjects = []string{"all", "random"}
+
+// Bounds is the size of a scene canvas.  Positions run from (0,0) to (Width,Height).
+type Bounds struct {
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+}
+
+// Scene describes a single scene e.g.
+// {"name": "puzzle022", "backgrounds": ["puzzle022"], "objects": ["Pumpkin1", "Pumpkin2", "Pumpkin3"]}
+// Bounds is optional and defaults to the catalogue bounds.
+type Scene struct {
+	Name        string   `json:"name"`
+	Backgrounds []string `json:"backgrounds"`
+	Objects     []string `json:"objects"`
+	Bounds      *Bounds  `json:"bounds,omitempty"`
+}
+
+// SceneCatalogue is the set of known scenes keyed by name
+type SceneCatalogue struct {
+	Bounds Bounds  `json:"bounds"`
+	Scenes []Scene `json:"scenes"`
+	byName map[string]Scene
+}
+
+// ParseSceneCatalogue parses a scene catalogue from JSON
+func ParseSceneCatalogue(data []byte) (*SceneCatalogue, error) {
+	var c SceneCatalogue
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, errInvalidSceneCatalogue
+	}
+	c.byName = make(map[string]Scene)
+	for _, scene := range c.Scenes {
+		if len(scene.Name) == 0 {
+			return nil, errInvalidSceneCatalogue
+		}
+		if scene.Bounds == nil {
+			bounds := c.Bounds
+			scene.Bounds = &bounds
+		}
+		c.byName[scene.Name] = scene
+	}
+	return &c, nil
+}
+
+// LoadSceneCatalogue reads a scene catalogue from a JSON file on disk
+func LoadSceneCatalogue(filename string) (*SceneCatalogue, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParseSceneCatalogue(data)
+}
+
+// DefaultSceneCatalogue returns the embedded scene catalogue
+func DefaultSceneCatalogue() *SceneCatalogue {
+	c, err := ParseSceneCatalogue(defaultSceneData)
+	check("defaultSceneCatalogue", err)
+	return c
+}
+
+// SetSceneCatalogue replaces the catalogue used by ValidateScene.  Passing nil restores the default.
+func SetSceneCatalogue(catalogue *SceneCatalogue) {
+	if catalogue == nil {
+		catalogue = DefaultSceneCatalogue()
+	}
+	sceneCatalogue = catalogue
+	resetConfigHash()
+}
+
+// Lookup finds the named scene
+func (c *SceneCatalogue) Lookup(name string) (Scene, bool) {
+	scene, ok := c.byName[name]
+	return scene, ok
+}
+
+// Names returns the names of all scenes in the catalogue in sorted order
+func (c *SceneCatalogue) Names() []string {
+	names := make([]string, 0, len(c.byName))
+	for name := range c.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Check validates a creation's objects and positions against its scene.
+// objects_get and objects_getRandom IDs must be in the scene, be added by objects_add
+// or be one of the wildcards.  Constant position_create coordinates must be on the canvas.
+// Disabled blocks are skipped.
+func (c *SceneCatalogue) Check(name string, prog *Program) []Issue {
+	issues := make([]Issue, 0)
+	if len(name) == 0 {
+		issues = append(issues, Issue{Kind: "missing-scene", Message: "creation has no scene"})
+		return issues
+	}
+	scene, ok := c.Lookup(name)
+	if !ok {
+		issues = append(issues, Issue{
+			Kind:        "unknown-scene",
+			Message:     fmt.Sprintf("unknown scene '%s'", name),
+			Suggestions: Suggest(name, c.Names()),
+		})
+		return issues
+	}
+	objects := append([]string{}, wildcardObjects...)
+	objects = append(objects, scene.Objects...)
+	eachEnabledBlockPath(prog, func(b *Block, path string) {
+		if b.Type == "objects_add" {
+			if id, ok := b.Field("ID"); ok {
+				objects = append(objects, id)
+			}
+		}
+	})
+	known := make(map[string]bool)
+	for _, object := range objects {
+		known[object] = true
+	}
+	eachEnabledBlockPath(prog, func(b *Block, path string) {
+		switch b.Type {
+		case "objects_get", "objects_getRandom":
+			id, _ := b.Field("ID")
+			if !known[id] {
+				issues = append(issues, Issue{
+					Kind:        "unknown-object",
+					BlockId:     b.Id,
+					BlockType:   b.Type,
+					Path:        path,
+					Message:     fmt.Sprintf("object '%s' is not in scene '%s'", id, name),
+					Suggestions: Suggest(id, objects),
+				})
+			}
+		case "position_create":
+			x, xok := constantNumber(b.Input("X"))
+			y, yok := constantNumber(b.Input("Y"))
+			if (xok && (x < 0 || x > scene.Bounds.Width)) || (yok && (y < 0 || y > scene.Bounds.Height)) {
+				issues = append(issues, Issue{
+					Kind:      "position-out-of-bounds",
+					BlockId:   b.Id,
+					BlockType: b.Type,
+					Path:      path,
+					Message: fmt.Sprintf("position (%s,%s) is outside the %gx%g canvas of scene '%s'",
+						formatCoordinate(x, xok), formatCoordinate(y, yok), scene.Bounds.Width, scene.Bounds.Height, name),
+				})
+			}
+		}
+	})
+	return issues
+}
+
+// ValidateScene checks the scene of a .kcode file against the current scene catalogue
+func ValidateScene(jsdata []byte) ([]Issue, error) {
+	scene, err := ExtractScene(jsdata)
+	if err != nil {
+		return nil, err
+	}
+	prog, err := ExtractProgram(jsdata)
+	if err != nil {
+		return nil, err
+	}
+	return sceneCatalogue.Check(scene, prog), nil
+}
+
+// constantNumber returns the value of an input that holds a plain math_number
+func constantNumber(in *Input) (float64, bool) {
+	b := in.Target()
+	if b == nil || b.Type != "math_number" {
+		return 0, false
+	}
+	num, _ := b.Field("NUM")
+	f, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0, false
+	}
+	return f, true
+}
+
+func formatCoordinate(v float64, ok bool) string {
+	if !ok {
+		return "?"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
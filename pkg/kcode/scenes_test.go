@@ -0,0 +1,65 @@
+package kcode
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSceneCatalogue(t *testing.T) {
+	catalogue := DefaultSceneCatalogue()
+	scene, ok := catalogue.Lookup("puzzle022")
+	assert.True(t, ok)
+	assert.Contains(t, scene.Objects, "Pumpkin1")
+	assert.Equal(t, 960.0, scene.Bounds.Width)
+	_, ok = catalogue.Lookup("nowhere")
+	assert.False(t, ok)
+}
+
+func TestValidateSceneAllChallenges(t *testing.T) {
+	files := ListFilesInDirectory("challenges")
+	for _, f := range files {
+		filename := "challenges/" + f.Name()
+		issues, err := ValidateScene(ReadFile(filename))
+		assert.Nil(t, err, filename)
+		assert.Empty(t, issues, filename)
+	}
+}
+
+func TestSceneCheck(t *testing.T) {
+	catalogue, err := ParseSceneCatalogue([]byte(`{"bounds": {"width": 100, "height": 50},
+		"scenes": [{"name": "honeydukesbeans", "objects": ["Pumpkin Pasty"]}]}`))
+	assert.Nil(t, err)
+	prog, err := ParseProgram([]byte(`<xml><block type="events_onAppStart" id="a">
+		<statement name="CALLBACK"><block type="position_set" id="b">
+		<value name="TARGET"><shadow type="objects_get" id="c"><field name="ID">Pumpkin Pastry</field></shadow></value>
+		<value name="POSITION"><shadow type="position_create" id="d">
+		<value name="X"><shadow type="math_number" id="e"><field name="NUM">200</field></shadow></value>
+		<value name="Y"><shadow type="math_number" id="f"><field name="NUM">20</field></shadow></value>
+		</shadow></value></block></statement></block></xml>`))
+	assert.Nil(t, err)
+
+	issues := catalogue.Check("honeydukesbeans", prog)
+	assert.Equal(t, 2, len(issues))
+	assert.Equal(t, "unknown-object", issues[0].Kind)
+	assert.Equal(t, "c", issues[0].BlockId)
+	assert.Equal(t, []string{"Pumpkin Pasty"}, issues[0].Suggestions)
+	assert.Equal(t, "position-out-of-bounds", issues[1].Kind)
+	assert.Equal(t, "d", issues[1].BlockId)
+
+	issues = catalogue.Check("honeydukesbean", prog)
+	assert.Equal(t, 1, len(issues))
+	assert.Equal(t, "unknown-scene", issues[0].Kind)
+	assert.Equal(t, []string{"honeydukesbeans"}, issues[0].Suggestions)
+
+	// Disabled blocks never run so they are not checked
+	prog.Blocks[0].Input("CALLBACK").Block.Disabled = true
+	assert.Empty(t, catalogue.Check("honeydukesbeans", prog))
+}
+
+func TestSuggest(t *testing.T) {
+	candidates := []string{"accio", "reparo", "reducio", "engorgio"}
+	assert.Equal(t, []string{"reducio"}, Suggest("reduccio", candidates))
+	assert.Equal(t, []string{"accio"}, Suggest("Acio", candidates))
+	assert.Empty(t, Suggest("wingardiumLeviosa", candidates))
+}
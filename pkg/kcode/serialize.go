@@ -0,0 +1,77 @@
+package kcode
+
+// serialize.go
+// ------------
+// Description:
+// Writes a Program back out as kcode XML and as a .kcode file, so tools that rewrite the
+// block tree such as Simplify can save their results.  MarshalProgram gives the compact
+// XML held in the "source" of a .kcode file.  ReplaceProgram swaps the source of an
+// existing .kcode for a program, keeping its scene, parts and every other key.  The keys
+// are written in sorted order and, as in the files the app saves, < and > are not escaped.
+//
+// API:
+// MarshalProgram(prog *Program) ([]byte, error)
+// MarshalProgramIndent(prog *Program) ([]byte, error)
+// ReplaceProgram(jsdata []byte, prog *Program) ([]byte, error)
+//
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+)
+
+// blocklyNamespace is the namespace Blockly puts on the <xml> element
+const blocklyNamespace = "http://www.w3.org/1999/xhtml"
+
+// MarshalProgram serializes a program as kcode XML
+func MarshalProgram(prog *Program) ([]byte, error) {
+	return xml.Marshal(newProgramXML(prog))
+}
+
+// MarshalProgramIndent serializes a program as kcode XML with one element per line, for reading and diffing
+func MarshalProgramIndent(prog *Program) ([]byte, error) {
+	return xml.MarshalIndent(newProgramXML(prog), "", "  ")
+}
+
+// ReplaceProgram returns a copy of .kcode JSON with its source replaced by the program
+func ReplaceProgram(jsdata []byte, prog *Program) ([]byte, error) {
+	var kc map[string]json.RawMessage
+	if err := json.Unmarshal(jsdata, &kc); err != nil {
+		return nil, errInvalidJSON
+	}
+	source, err := MarshalProgram(prog)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(string(source)); err != nil {
+		return nil, err
+	}
+	kc["source"] = json.RawMessage(bytes.TrimSpace(buf.Bytes()))
+	buf.Reset()
+	if err := enc.Encode(kc); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSpace(buf.Bytes()), nil
+}
+
+// programXML is how a Program is written out.  The name in the tag on Program.XMLName
+// wins over its value when marshalling so the namespace has to be written as an attribute.
+type programXML struct {
+	XMLName   xml.Name   `xml:"xml"`
+	Xmlns     string     `xml:"xmlns,attr"`
+	Variables []Variable `xml:"variables>variable"`
+	Blocks    []*Block   `xml:"block"`
+}
+
+// newProgramXML keeps the namespace of a parsed program and gives programs built in code the Blockly one
+func newProgramXML(prog *Program) *programXML {
+	ns := prog.XMLName.Space
+	if len(ns) == 0 {
+		ns = blocklyNamespace
+	}
+	return &programXML{Xmlns: ns, Variables: prog.Variables, Blocks: prog.Blocks}
+}
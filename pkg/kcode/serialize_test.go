@@ -0,0 +1,67 @@
+package kcode
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMarshalProgram(t *testing.T) {
+	source := `<xml xmlns="http://www.w3.org/1999/xhtml"><variables><variable type="" id="v1">size</variable></variables>` +
+		`<block type="events_onGesture" id="a" x="10" y="20"><field name="TYPE">reducio</field>` +
+		`<statement name="CALLBACK"><block type="controls_if" id="b" disabled="true"><mutation else="1"></mutation>` +
+		`<value name="IF0"><shadow type="logic_boolean" id="c"><field name="BOOL">TRUE</field></shadow></value>` +
+		`<next><block type="variables_set" id="d"><field name="VAR" id="v1">size</field>` +
+		`<comment pinned="true" h="80" w="160">grow</comment></block></next></block></statement></block></xml>`
+	prog, err := ParseProgram([]byte(source))
+	assert.Nil(t, err)
+	data, err := MarshalProgram(prog)
+	assert.Nil(t, err)
+	assert.Equal(t, source, string(data))
+	// Programs built in code get the Blockly namespace
+	data, err = MarshalProgram(&Program{Blocks: []*Block{{Type: "events_onAppStart", Id: "x"}}})
+	assert.Nil(t, err)
+	assert.Equal(t, `<xml xmlns="http://www.w3.org/1999/xhtml"><variables></variables><block type="events_onAppStart" id="x"></block></xml>`, string(data))
+	data, err = MarshalProgramIndent(prog)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(string(data), "<xml xmlns=\"http://www.w3.org/1999/xhtml\">\n  <variables>\n"))
+}
+
+func TestReplaceProgram(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	_, err := ReplaceProgram([]byte(`not json`), &Program{})
+	assert.NotNil(t, err)
+	// Every challenge survives being written back out unchanged
+	for _, f := range ListFilesInDirectory("challenges") {
+		data := ReadFile("challenges/" + f.Name())
+		prog, err := ExtractProgram(data)
+		assert.Nil(t, err, f.Name())
+		rewritten, err := ReplaceProgram(data, prog)
+		assert.Nil(t, err, f.Name())
+		var before, after map[string]interface{}
+		assert.Nil(t, json.Unmarshal(data, &before), f.Name())
+		assert.Nil(t, json.Unmarshal(rewritten, &after), f.Name())
+		source := after["source"]
+		delete(before, "source")
+		delete(after, "source")
+		assert.Equal(t, before, after, f.Name())
+		assert.False(t, strings.Contains(string(rewritten), `\u003c`), f.Name())
+		again, err := ExtractProgram(rewritten)
+		assert.Nil(t, err, f.Name())
+		assert.Equal(t, Fingerprint(prog), Fingerprint(again), f.Name())
+		xmldata, err := MarshalProgram(prog)
+		assert.Nil(t, err, f.Name())
+		assert.Equal(t, string(xmldata), source, f.Name())
+		// The legacy parser reads it the same way too
+		report := ValidateString(rewritten, false)
+		assert.Empty(t, report.Discrepancies, f.Name())
+		spells, blocks, _, _ := ProcessKcodeFileString(data, KCodeFlags{Spells: true, Blocks: true}, false)
+		spells2, blocks2, _, _ := ProcessKcodeFileString(rewritten, KCodeFlags{Spells: true, Blocks: true}, false)
+		assert.Equal(t, spells, spells2, f.Name())
+		assert.Equal(t, blocks, blocks2, f.Name())
+	}
+}
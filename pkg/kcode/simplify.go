@@ -0,0 +1,354 @@
+package kcode
+
+// simplify.go
+// -----------
+// Description:
+// Optimiser that rewrites a creation into a simpler one that does the same thing, for
+// cleaning up tutorial starter files.  Simplify makes three kinds of change:
+// 1. Constant value expressions are folded into literals using Fold, e.g. 3 - 1 becomes 2.
+//    A constant that fits the shadow of its input is put in the shadow, as if typed in.
+// 2. controls_if branches whose condition is always false are removed, as are the
+//    branches after one whose condition is always true.  An if left with only one branch
+//    that always runs is replaced by the body of that branch.
+// 3. Event handlers that do nothing are removed.
+// Disabled blocks are left as they are.  The program passed in is not changed.
+//
+// API:
+// Simplify(prog *Program) (*Program, []Simplification)
+// SimplifyString(jsdata []byte) ([]byte, []Simplification, error)
+// (s Simplification) String() string
+//
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Kinds of Simplification
+const (
+	SimplifyFold          = "fold-constant"
+	SimplifyRemoveBranch  = "remove-branch"
+	SimplifyInlineBranch  = "inline-branch"
+	SimplifyRemoveHandler = "remove-handler"
+)
+
+// Simplification is a change made by Simplify.  Path is where the block was in the original program.
+type Simplification struct {
+	Kind      string `json:"kind"`
+	BlockId   string `json:"blockId"`
+	BlockType string `json:"blockType"`
+	Path      string `json:"path"`
+	Message   string `json:"message"`
+}
+
+// simplifier collects the changes made while simplifying
+type simplifier struct {
+	changes []Simplification
+}
+
+// Simplify returns a simplified copy of a program along with the changes made
+func Simplify(prog *Program) (*Program, []Simplification) {
+	s := &simplifier{changes: make([]Simplification, 0)}
+	simple := &Program{XMLName: prog.XMLName, Variables: prog.Variables, Blocks: make([]*Block, 0, len(prog.Blocks))}
+	for i, block := range prog.Blocks {
+		path := fmt.Sprintf("/block[%d]", i+1)
+		b := s.stack(cloneBlock(block), path)
+		if b == nil {
+			continue
+		}
+		if b.Id != block.Id {
+			// The stack starts with the body of an if that was replaced so move it to where the if was
+			b.X, b.Y = block.X, block.Y
+		}
+		if strings.HasPrefix(b.Type, "events_") && !b.Disabled && isEmptyHandler(b) {
+			trigger, _ := b.Field("TYPE")
+			s.add(SimplifyRemoveHandler, b, path, "handler %s does nothing", handlerName(b.Type, strings.TrimSpace(trigger)))
+			continue
+		}
+		simple.Blocks = append(simple.Blocks, b)
+	}
+	return simple, s.changes
+}
+
+// SimplifyString simplifies .kcode data returning the new .kcode along with the changes made
+func SimplifyString(jsdata []byte) ([]byte, []Simplification, error) {
+	prog, err := ExtractProgram(jsdata)
+	if err != nil {
+		return nil, nil, err
+	}
+	simple, changes := Simplify(prog)
+	data, err := ReplaceProgram(jsdata, simple)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, changes, nil
+}
+
+// String renders the change e.g. "[fold-constant] math_arithmetic(MINUS, 3, 1) folds to 2 (block math_arithmetic id=b) at /block[1]/..."
+func (s Simplification) String() string {
+	return fmt.Sprintf("[%s] %s (block %s id=%s) at %s", s.Kind, s.Message, s.BlockType, s.BlockId, s.Path)
+}
+
+func (s *simplifier) add(kind string, b *Block, path string, format string, args ...interface{}) {
+	s.changes = append(s.changes, Simplification{Kind: kind, BlockId: b.Id, BlockType: b.Type, Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// stack simplifies a stack of blocks returning its new first block, which is nil if nothing is left of it
+func (s *simplifier) stack(head *Block, path string) *Block {
+	blocks := make([]*Block, 0)
+	for b := head; b != nil; path += "/next/block" {
+		var next *Block
+		if b.Next != nil {
+			next = b.Next.Block
+		}
+		b.Next = nil
+		if b.Disabled {
+			blocks = append(blocks, b)
+		} else {
+			s.inputs(b, path)
+			blocks = append(blocks, s.branches(b, path)...)
+		}
+		b = next
+	}
+	return linkStack(blocks)
+}
+
+// inputs folds the value inputs of a block and simplifies the stacks in its statement
+// inputs, dropping statement inputs left empty
+func (s *simplifier) inputs(b *Block, path string) {
+	for i := range b.Values {
+		in := &b.Values[i]
+		if in.Block != nil && !in.Block.Disabled {
+			s.fold(in, fmt.Sprintf("%s/value[%s]/block", path, in.Name))
+		}
+	}
+	statements := make([]Input, 0, len(b.Statements))
+	for _, in := range b.Statements {
+		if in.Block != nil {
+			in.Block = s.stack(in.Block, fmt.Sprintf("%s/statement[%s]/block", path, in.Name))
+		}
+		if in.Block != nil {
+			statements = append(statements, in)
+		}
+	}
+	b.Statements = statements
+}
+
+// fold folds the block in a value input
+func (s *simplifier) fold(in *Input, path string) {
+	before := in.Block
+	folded := Fold(before, nil)
+	if canonicalXML(folded) == canonicalXML(before) {
+		return
+	}
+	s.add(SimplifyFold, before, path, "%s folds to %s", describeValue(before), describeValue(folded))
+	if in.Shadow != nil && in.Shadow.Type == folded.Type && isLiteral(folded) && len(in.Shadow.Fields) == 1 {
+		in.Shadow.Fields[0].Value = folded.Fields[0].Value
+		in.Block = nil
+		return
+	}
+	in.Block = folded
+}
+
+// ifBranch is a condition of an if along with the stack it runs
+type ifBranch struct {
+	cond *Input
+	body *Input
+}
+
+// branches removes the branches of a controls_if that never run.  It returns the blocks the if is replaced by.
+func (s *simplifier) branches(b *Block, path string) []*Block {
+	if b.Type != "controls_if" && b.Type != "controls_if_else_custom" {
+		return []*Block{b}
+	}
+	count := 1
+	if n, err := strconv.Atoi(attrOrEmpty(b.Mutation, "elseif")); err == nil {
+		count += n
+	}
+	elseBody := b.Input("ELSE")
+	hasElse := attrOrEmpty(b.Mutation, "else") == "1" || elseBody != nil
+	kept := make([]ifBranch, 0, count)
+	changed := false
+	for i := 0; i < count; i++ {
+		br := ifBranch{cond: b.Input(fmt.Sprintf("IF%d", i)), body: b.Input(fmt.Sprintf("DO%d", i))}
+		always, constant := constantCondition(br.cond)
+		switch {
+		case !constant:
+			kept = append(kept, br)
+			continue
+		case !always:
+			s.add(SimplifyRemoveBranch, b, path, "condition IF%d is always false so DO%d never runs", i, i)
+			changed = true
+			continue
+		}
+		if i < count-1 || hasElse {
+			s.add(SimplifyRemoveBranch, b, path, "condition IF%d is always true so the branches after DO%d never run", i, i)
+			changed = true
+		}
+		if len(kept) == 0 {
+			s.add(SimplifyInlineBranch, b, path, "condition IF%d is always true so the if is replaced by DO%d", i, i)
+			return stackBlocks(br.body)
+		}
+		kept = append(kept, br)
+		hasElse, elseBody = false, nil
+		break
+	}
+	if !changed {
+		return []*Block{b}
+	}
+	if len(kept) == 0 {
+		if elseBody != nil && elseBody.Block != nil {
+			s.add(SimplifyInlineBranch, b, path, "every condition is always false so the if is replaced by ELSE")
+		} else {
+			s.add(SimplifyInlineBranch, b, path, "every condition is always false so the if is removed")
+		}
+		return stackBlocks(elseBody)
+	}
+	// Renumber the branches that are left
+	values := make([]Input, 0, len(b.Values))
+	statements := make([]Input, 0, len(b.Statements))
+	for _, in := range b.Values {
+		if !strings.HasPrefix(in.Name, "IF") {
+			values = append(values, in)
+		}
+	}
+	for i, br := range kept {
+		if br.cond != nil {
+			cond := *br.cond
+			cond.Name = fmt.Sprintf("IF%d", i)
+			values = append(values, cond)
+		}
+		if br.body != nil {
+			body := *br.body
+			body.Name = fmt.Sprintf("DO%d", i)
+			statements = append(statements, body)
+		}
+	}
+	if hasElse && elseBody != nil {
+		statements = append(statements, *elseBody)
+	}
+	b.Values, b.Statements = values, statements
+	setMutationAttr(b, "elseif", len(kept)-1)
+	if !hasElse {
+		setMutationAttr(b, "else", 0)
+	}
+	return []*Block{b}
+}
+
+// constantCondition evaluates the condition of a branch.  constant is false if it is not a constant boolean.
+func constantCondition(cond *Input) (always bool, constant bool) {
+	c, err := Evaluate(cond.Target(), nil)
+	if err != nil {
+		return false, false
+	}
+	v, err := c.Bool()
+	if err != nil {
+		return false, false
+	}
+	return v, true
+}
+
+// isEmptyHandler reports whether an event handler has nothing in its statement inputs
+func isEmptyHandler(b *Block) bool {
+	for _, in := range b.Statements {
+		if in.Block != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// stackBlocks returns the blocks of the stack in a statement input, unlinked from each other
+func stackBlocks(in *Input) []*Block {
+	blocks := make([]*Block, 0)
+	if in == nil {
+		return blocks
+	}
+	for b := in.Block; b != nil; {
+		var next *Block
+		if b.Next != nil {
+			next = b.Next.Block
+		}
+		b.Next = nil
+		blocks = append(blocks, b)
+		b = next
+	}
+	return blocks
+}
+
+// linkStack links blocks into a stack returning its first block
+func linkStack(blocks []*Block) *Block {
+	if len(blocks) == 0 {
+		return nil
+	}
+	for i := 0; i+1 < len(blocks); i++ {
+		blocks[i].Next = &Input{Block: blocks[i+1]}
+	}
+	return blocks[0]
+}
+
+func attrOrEmpty(m *Mutation, name string) string {
+	value, _ := m.Attr(name)
+	return value
+}
+
+// setMutationAttr sets a count on the mutation of a block, removing it when it is 0 as Blockly does
+func setMutationAttr(b *Block, name string, n int) {
+	if b.Mutation == nil {
+		if n == 0 {
+			return
+		}
+		b.Mutation = &Mutation{}
+	}
+	attrs := make([]xml.Attr, 0, len(b.Mutation.Attrs)+1)
+	for _, a := range b.Mutation.Attrs {
+		if a.Name.Local != name {
+			attrs = append(attrs, a)
+		}
+	}
+	if n > 0 {
+		attrs = append(attrs, xml.Attr{Name: xml.Name{Local: name}, Value: strconv.Itoa(n)})
+	}
+	b.Mutation.Attrs = attrs
+	if len(attrs) == 0 && len(b.Mutation.Args) == 0 {
+		b.Mutation = nil
+	}
+}
+
+// cloneBlock makes a deep copy of a block along with everything in its inputs
+func cloneBlock(b *Block) *Block {
+	if b == nil {
+		return nil
+	}
+	c := *b
+	c.Fields = append([]Field(nil), b.Fields...)
+	if b.Deletable != nil {
+		deletable := *b.Deletable
+		c.Deletable = &deletable
+	}
+	if b.Mutation != nil {
+		c.Mutation = &Mutation{Attrs: append([]xml.Attr(nil), b.Mutation.Attrs...), Args: append([]MutationArg(nil), b.Mutation.Args...)}
+	}
+	if b.Comment != nil {
+		comment := *b.Comment
+		c.Comment = &comment
+	}
+	cloneInputs := func(inputs []Input) []Input {
+		if inputs == nil {
+			return nil
+		}
+		cloned := make([]Input, len(inputs))
+		for i, in := range inputs {
+			cloned[i] = Input{Name: in.Name, Block: cloneBlock(in.Block), Shadow: cloneBlock(in.Shadow)}
+		}
+		return cloned
+	}
+	c.Values = cloneInputs(b.Values)
+	c.Statements = cloneInputs(b.Statements)
+	if b.Next != nil {
+		c.Next = &Input{Name: b.Next.Name, Block: cloneBlock(b.Next.Block), Shadow: cloneBlock(b.Next.Shadow)}
+	}
+	return &c
+}
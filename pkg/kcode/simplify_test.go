@@ -0,0 +1,143 @@
+package kcode
+
+import (
+	"io/ioutil"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func simplificationKinds(changes []Simplification) []string {
+	kinds := make([]string, 0, len(changes))
+	for _, c := range changes {
+		kinds = append(kinds, c.Kind)
+	}
+	return kinds
+}
+
+func TestSimplifyFold(t *testing.T) {
+	prog, err := ParseProgram([]byte(`<xml><block type="events_onGesture" id="a"><field name="TYPE">reducio</field>
+		<statement name="CALLBACK"><block type="objects_scale" id="b"><field name="PROPORTION">shrink</field>
+		<value name="VALUE"><shadow type="math_number" id="d"><field name="NUM">50</field></shadow>` +
+		arithmetic("MINUS", number("30"), number("15")) + `</value>
+		<next><block type="position_set" id="e"><value name="POSITION"><block type="position_create" id="f">
+		<value name="X">` + arithmetic("ADD", `<block type="wand_x"></block>`, arithmetic("MULTIPLY", number("2"), number("5"))) + `</value>
+		<value name="Y"><shadow type="math_number" id="g"><field name="NUM">0</field></shadow></value>
+		</block></value></block></next></block></statement></block></xml>`))
+	assert.Nil(t, err)
+	before := canonicalXML(prog)
+	simple, changes := Simplify(prog)
+	assert.Equal(t, before, canonicalXML(prog), "the program passed in is not changed")
+	assert.Equal(t, []string{SimplifyFold, SimplifyFold}, simplificationKinds(changes))
+	assert.Equal(t, "[fold-constant] math_arithmetic(MINUS, 30, 15) folds to 15 (block math_arithmetic id=MINUS) at /block[1]/statement[CALLBACK]/block/value[VALUE]/block",
+		changes[0].String())
+	// A constant that fits the shadow replaces the block in the input
+	scale := simple.Blocks[0].Input("CALLBACK").Block
+	assert.Nil(t, scale.Input("VALUE").Block)
+	assert.Equal(t, "15", scale.Input("VALUE").Shadow.Fields[0].Value)
+	assert.Equal(t, "/block[1]/statement[CALLBACK]/block/next/block/value[POSITION]/block", changes[1].Path)
+	assert.Equal(t, "position_create(math_arithmetic(ADD, wand_x, 10), 0)", describeValue(scale.Next.Block.Input("POSITION").Block))
+}
+
+func TestSimplifyBranches(t *testing.T) {
+	boolean := func(v string) string {
+		return `<block type="logic_boolean"><field name="BOOL">` + v + `</field></block>`
+	}
+	action := func(id string) string {
+		return `<block type="wand_vibrate" id="` + id + `"><field name="PATTERN">short</field></block>`
+	}
+	prog, err := ParseProgram([]byte(`<xml>
+		<block type="events_onGesture" id="a"><field name="TYPE">accio</field><statement name="CALLBACK">
+		<block type="controls_if" id="if1"><mutation elseif="2" else="1"></mutation>
+		<value name="IF0">` + boolean("FALSE") + `</value><statement name="DO0">` + action("x0") + `</statement>
+		<value name="IF1"><block type="logic_compare"><field name="OP">GT</field><value name="A"><block type="wand_x"></block></value>
+		<value name="B">` + number("1") + `</value></block></value><statement name="DO1">` + action("x1") + `</statement>
+		<value name="IF2">` + boolean("TRUE") + `</value><statement name="DO2">` + action("x2") + `</statement>
+		<statement name="ELSE">` + action("x3") + `</statement>
+		<next><block type="controls_if" id="if2"><value name="IF0"><block type="logic_compare"><field name="OP">LT</field>
+		<value name="A">` + number("1") + `</value><value name="B">` + number("2") + `</value></block></value>
+		<statement name="DO0"><block type="wand_vibrate" id="y0"><field name="PATTERN">short</field>
+		<next><block type="restart_code" id="y1"></block></next></block></statement>
+		<next>` + action("z") + `</next></block></next></block></statement></block>
+		<block type="events_onGesture" id="b"><field name="TYPE">reducio</field><statement name="CALLBACK">
+		<block type="controls_if" id="if3"><value name="IF0">` + boolean("FALSE") + `</value>
+		<statement name="DO0">` + action("w") + `</statement></block></statement></block>
+		<block type="events_onFlick" id="c"><field name="TYPE">up</field></block>
+		<block type="events_onAppStart" id="d" disabled="true"></block>
+		</xml>`))
+	assert.Nil(t, err)
+	simple, changes := Simplify(prog)
+	assert.Equal(t, []string{SimplifyRemoveBranch, SimplifyRemoveBranch, SimplifyFold, SimplifyInlineBranch,
+		SimplifyRemoveBranch, SimplifyInlineBranch, SimplifyRemoveHandler, SimplifyRemoveHandler}, simplificationKinds(changes))
+	assert.Equal(t, "condition IF0 is always false so DO0 never runs", changes[0].Message)
+	assert.Equal(t, "condition IF2 is always true so the branches after DO2 never run", changes[1].Message)
+	assert.Equal(t, "condition IF0 is always true so the if is replaced by DO0", changes[3].Message)
+	assert.Equal(t, "handler reducio does nothing", changes[6].Message)
+	assert.Equal(t, "handler events_onFlick(up) does nothing", changes[7].Message)
+	// The first if keeps the two branches that can run and the always true if is replaced by its body
+	assert.Equal(t, 2, len(simple.Blocks))
+	handlers := Handlers(simple)
+	assert.Equal(t, 1, len(handlers))
+	assert.Equal(t, "accio → controls_if(logic_compare(GT, wand_x, 1), TRUE), wand_vibrate(short), wand_vibrate(short), wand_vibrate(short), restart_code(), wand_vibrate(short)",
+		"accio → "+joinActions(handlers[0].Actions))
+	if1 := simple.Blocks[0].Input("CALLBACK").Block
+	assert.Equal(t, []string{"IF0", "IF1"}, inputNames(if1.Values))
+	assert.Equal(t, []string{"DO0", "DO1"}, inputNames(if1.Statements))
+	elseif, _ := if1.Mutation.Attr("elseif")
+	assert.Equal(t, "1", elseif)
+	_, ok := if1.Mutation.Attr("else")
+	assert.False(t, ok)
+	assert.Equal(t, "x2", if1.Input("DO1").Block.Id)
+	ids := make([]string, 0)
+	for _, a := range handlers[0].Actions[3:] {
+		ids = append(ids, a.BlockId)
+	}
+	assert.Equal(t, []string{"y0", "y1", "z"}, ids)
+	// Disabled handlers are left alone
+	assert.Equal(t, "d", simple.Blocks[1].Id)
+	// Simplifying again changes nothing
+	_, again := Simplify(simple)
+	assert.Empty(t, again)
+}
+
+func inputNames(inputs []Input) []string {
+	names := make([]string, 0, len(inputs))
+	for _, in := range inputs {
+		names = append(names, in.Name)
+	}
+	return names
+}
+
+func joinActions(actions []Action) string {
+	s := ""
+	for i, a := range actions {
+		if i > 0 {
+			s += ", "
+		}
+		s += a.String()
+	}
+	return s
+}
+
+func TestSimplifyString(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	_, _, err := SimplifyString([]byte(`not json`))
+	assert.NotNil(t, err)
+	// The challenges have nothing to simplify apart from a few constant sums and empty handlers
+	for _, f := range ListFilesInDirectory("challenges") {
+		data := ReadFile("challenges/" + f.Name())
+		simplified, changes, err := SimplifyString(data)
+		assert.Nil(t, err, f.Name())
+		prog, _ := ExtractProgram(simplified)
+		_, again := Simplify(prog)
+		assert.Empty(t, again, f.Name())
+		for _, c := range changes {
+			assert.Contains(t, []string{SimplifyFold, SimplifyRemoveHandler}, c.Kind, f.Name())
+		}
+		if len(changes) == 0 {
+			original, _ := ExtractProgram(data)
+			assert.Equal(t, Fingerprint(original), Fingerprint(prog), f.Name())
+		}
+	}
+}
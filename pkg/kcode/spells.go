@@ -0,0 +1,166 @@
+package kcode
+
+// spells.go
+// ---------
+// Description:
+// Catalogue of the wand spells the platform recognises, with the name shown to the user
+// and metadata about the gesture that casts each one.  The default catalogue is embedded
+// from spells.json and can be swapped for one loaded from disk.  Spell names are case
+// sensitive, as they are in creations, e.g. wingardiumLeviosa.
+//
+// API:
+// ParseSpellCatalogue(data []byte) (*SpellCatalogue, error)
+// LoadSpellCatalogue(filename string) (*SpellCatalogue, error)
+// DefaultSpellCatalogue() *SpellCatalogue
+// SetSpellCatalogue(catalogue *SpellCatalogue)
+// (c *SpellCatalogue) Lookup(name string) (Spell, bool)
+// (c *SpellCatalogue) Names() []string
+// (c *SpellCatalogue) CheckNames(spells []string) []Issue
+// (c *SpellCatalogue) Check(prog *Program) []Issue
+// CheckSpells(spells []string) []Issue
+// ValidateSpells(jsdata []byte) ([]Issue, error)
+//
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+//go:embed spells.json
+var defaultSpellData []byte
+
+var (
+	errInvalidSpellCatalogue = errors.New("invalid spell catalogue")
+	// spellCatalogue is the catalogue used by CheckSpells and ValidateSpells
+	spellCatalogue = DefaultSpellCatalogue()
+)
+
+// Spell describes a single spell e.g.
+// {"name": "reducio", "displayName": "Reducio", "gesture": "draw a circle inwards", "effect": "makes things smaller"}
+type Spell struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+	Gesture     string `json:"gesture"`
+	Effect      string `json:"effect"`
+}
+
+// SpellCatalogue is the set of known spells keyed by name
+type SpellCatalogue struct {
+	Spells []Spell `json:"spells"`
+	byName map[string]Spell
+}
+
+// ParseSpellCatalogue parses a spell catalogue from JSON
+func ParseSpellCatalogue(data []byte) (*SpellCatalogue, error) {
+	var c SpellCatalogue
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, errInvalidSpellCatalogue
+	}
+	c.byName = make(map[string]Spell)
+	for _, spell := range c.Spells {
+		if len(spell.Name) == 0 {
+			return nil, errInvalidSpellCatalogue
+		}
+		if len(spell.DisplayName) == 0 {
+			spell.DisplayName = spell.Name
+		}
+		c.byName[spell.Name] = spell
+	}
+	return &c, nil
+}
+
+// LoadSpellCatalogue reads a spell catalogue from a JSON file on disk
+func LoadSpellCatalogue(filename string) (*SpellCatalogue, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParseSpellCatalogue(data)
+}
+
+// DefaultSpellCatalogue returns the embedded spell catalogue
+func DefaultSpellCatalogue() *SpellCatalogue {
+	c, err := ParseSpellCatalogue(defaultSpellData)
+	check("defaultSpellCatalogue", err)
+	return c
+}
+
+// SetSpellCatalogue replaces the catalogue used by CheckSpells and ValidateSpells.  Passing nil restores the default.
+func SetSpellCatalogue(catalogue *SpellCatalogue) {
+	if catalogue == nil {
+		catalogue = DefaultSpellCatalogue()
+	}
+	spellCatalogue = catalogue
+	resetConfigHash()
+}
+
+// Lookup finds the named spell
+func (c *SpellCatalogue) Lookup(name string) (Spell, bool) {
+	spell, ok := c.byName[name]
+	return spell, ok
+}
+
+// Names returns the names of all spells in the catalogue in sorted order
+func (c *SpellCatalogue) Names() []string {
+	names := make([]string, 0, len(c.byName))
+	for name := range c.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CheckNames checks a list of spells such as ExtractSpells returns against the catalogue
+func (c *SpellCatalogue) CheckNames(spells []string) []Issue {
+	issues := make([]Issue, 0)
+	for _, spell := range spells {
+		if _, ok := c.Lookup(strings.TrimSpace(spell)); !ok {
+			issues = append(issues, c.unknownSpell(spell))
+		}
+	}
+	return issues
+}
+
+// Check checks the spell of every enabled events_onGesture block against the catalogue
+func (c *SpellCatalogue) Check(prog *Program) []Issue {
+	issues := make([]Issue, 0)
+	eachEnabledBlockPath(prog, func(b *Block, path string) {
+		if b.Type != "events_onGesture" {
+			return
+		}
+		spell, ok := b.Field("TYPE")
+		if !ok {
+			return
+		}
+		if _, ok := c.Lookup(strings.TrimSpace(spell)); !ok {
+			issue := c.unknownSpell(spell)
+			issue.BlockId, issue.BlockType, issue.Path = b.Id, b.Type, path
+			issues = append(issues, issue)
+		}
+	})
+	return issues
+}
+
+func (c *SpellCatalogue) unknownSpell(spell string) Issue {
+	spell = strings.TrimSpace(spell)
+	return Issue{Kind: "unknown-spell", Message: fmt.Sprintf("unknown spell '%s'", spell), Suggestions: Suggest(spell, c.Names())}
+}
+
+// CheckSpells checks a list of spells such as ExtractSpells returns against the current spell catalogue
+func CheckSpells(spells []string) []Issue {
+	return spellCatalogue.CheckNames(spells)
+}
+
+// ValidateSpells checks the spells of a .kcode file against the current spell catalogue
+func ValidateSpells(jsdata []byte) ([]Issue, error) {
+	prog, err := ExtractProgram(jsdata)
+	if err != nil {
+		return nil, err
+	}
+	return spellCatalogue.Check(prog), nil
+}
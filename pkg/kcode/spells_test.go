@@ -0,0 +1,78 @@
+package kcode
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpellCatalogue(t *testing.T) {
+	catalogue := DefaultSpellCatalogue()
+	spell, ok := catalogue.Lookup("wingardiumLeviosa")
+	assert.True(t, ok)
+	assert.Equal(t, "Wingardium Leviosa", spell.DisplayName)
+	assert.NotEmpty(t, spell.Gesture)
+	for _, name := range []string{"accio", "reparo", "engorgio", "reducio", "lumos", "incendio"} {
+		_, ok = catalogue.Lookup(name)
+		assert.True(t, ok, name)
+	}
+	_, ok = catalogue.Lookup("avadaKedavra")
+	assert.False(t, ok)
+
+	_, err := ParseSpellCatalogue([]byte(`{"spells": [{"displayName": "No name"}]}`))
+	assert.Equal(t, errInvalidSpellCatalogue, err)
+	_, err = ParseSpellCatalogue([]byte(`not json`))
+	assert.Equal(t, errInvalidSpellCatalogue, err)
+}
+
+func TestValidateSpellsAllChallenges(t *testing.T) {
+	for _, f := range ListFilesInDirectory("challenges") {
+		filename := "challenges/" + f.Name()
+		issues, err := ValidateSpells(ReadFile(filename))
+		assert.Nil(t, err, filename)
+		assert.Empty(t, issues, filename)
+	}
+}
+
+func TestSpellCheck(t *testing.T) {
+	prog, err := ParseProgram([]byte(`<xml><block type="events_onGesture" id="a"><field name="TYPE">reduccio</field></block>
+		<block type="events_onGesture" id="b"><field name="TYPE">reparo</field></block>
+		<block type="events_onGesture" id="c" disabled="true"><field name="TYPE">nonsense</field></block></xml>`))
+	assert.Nil(t, err)
+	issues := DefaultSpellCatalogue().Check(prog)
+	assert.Equal(t, 1, len(issues))
+	assert.Equal(t, "unknown-spell", issues[0].Kind)
+	assert.Equal(t, "a", issues[0].BlockId)
+	assert.Equal(t, "/block[1]", issues[0].Path)
+	assert.Equal(t, []string{"reducio"}, issues[0].Suggestions)
+
+	issues = DefaultSpellCatalogue().CheckNames([]string{"accio", "Wingardiumleviosa"})
+	assert.Equal(t, 1, len(issues))
+	assert.Equal(t, []string{"wingardiumLeviosa"}, issues[0].Suggestions)
+}
+
+func TestLoadSpellCatalogue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spells")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "spells.json")
+	assert.Nil(t, ioutil.WriteFile(filename, []byte(`{"spells": [{"name": "reduccio"}]}`), 0644))
+	catalogue, err := LoadSpellCatalogue(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"reduccio"}, catalogue.Names())
+	spell, _ := catalogue.Lookup("reduccio")
+	assert.Equal(t, "reduccio", spell.DisplayName)
+	_, err = LoadSpellCatalogue(filepath.Join(dir, "missing.json"))
+	assert.NotNil(t, err)
+
+	SetSpellCatalogue(catalogue)
+	defer SetSpellCatalogue(nil)
+	issues, err := ValidateSpells(ReadFile("challenges/022_pumpkins.kcode"))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(issues))
+	assert.Equal(t, []string{"reduccio"}, issues[1].Suggestions)
+	assert.Empty(t, CheckSpells([]string{"reduccio"}))
+}
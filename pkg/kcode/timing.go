@@ -0,0 +1,298 @@
+package kcode
+
+// timing.go
+// ---------
+// Description:
+// Estimates how long each event handler of a creation takes, from when it is triggered
+// until the last of its effects is over, e.g. how long the fireworks of a spell last.
+// Most blocks start an effect and carry straight on, so the effect of each block lasts
+// for its cost from a cost table while the stack moves on to the next block.  wait blocks
+// hold the stack up for their delay.  in_x_time runs its body after its delay without
+// holding up the stack.  repeat_x_times runs its body N times and controls_if takes as
+// long as its slowest branch.  Calling a procedure takes as long as the procedure.
+// Handlers that start an every_x_seconds timer or a loop that may never end are
+// unbounded, as are recursive procedures.  Values only known when the creation runs,
+// such as a wait of wand_x seconds, use the value in the shadow of the input instead and
+// make the estimate approximate.
+// The cost table is embedded from costs.json and can be swapped for one loaded from disk.
+// Costs are in seconds keyed by block type, or by "<type>:<field value>" for blocks whose
+// fields change how long they take, e.g. "wand_vibrate:short".  Blocks that are not in
+// the table cost nothing.  The table also gives the frames per second used to convert
+// durations in frames and the limit over which CheckTimings reports a handler.
+//
+// API:
+// ParseCostTable(data []byte) (*CostTable, error)
+// LoadCostTable(filename string) (*CostTable, error)
+// DefaultCostTable() *CostTable
+// SetCostTable(table *CostTable)
+// (t *CostTable) Cost(b *Block) float64
+// EstimateTimings(prog *Program) []HandlerTiming
+// CheckTimings(prog *Program) []Issue
+// (h HandlerTiming) Name() string
+// (h HandlerTiming) String() string
+//
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+)
+
+//go:embed costs.json
+var defaultCostData []byte
+
+var (
+	errInvalidCostTable = errors.New("invalid cost table")
+	// costTable is the table used by EstimateTimings and CheckTimings
+	costTable = DefaultCostTable()
+)
+
+// CostTable holds how long the effect of each kind of block lasts.  A MaxHandlerSeconds
+// of 0 turns off the check for slow handlers.
+type CostTable struct {
+	FramesPerSecond   float64            `json:"framesPerSecond"`
+	MaxHandlerSeconds float64            `json:"maxHandlerSeconds"`
+	Costs             map[string]float64 `json:"costs"`
+}
+
+// HandlerTiming is the estimated duration of an event handler in seconds.  When Unbounded
+// is set the handler can go on for ever and Seconds covers the part of it that ends.
+// Slow is set when a handler that ends takes longer than the limit in the cost table.
+type HandlerTiming struct {
+	Event       string  `json:"event"`
+	Trigger     string  `json:"trigger,omitempty"`
+	BlockId     string  `json:"blockId"`
+	Path        string  `json:"path"`
+	Seconds     float64 `json:"seconds"`
+	Unbounded   bool    `json:"unbounded"`
+	Approximate bool    `json:"approximate"`
+	Slow        bool    `json:"slow"`
+}
+
+// ParseCostTable parses a cost table from JSON
+func ParseCostTable(data []byte) (*CostTable, error) {
+	var t CostTable
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, errInvalidCostTable
+	}
+	if t.FramesPerSecond <= 0 || t.MaxHandlerSeconds < 0 {
+		return nil, errInvalidCostTable
+	}
+	if t.Costs == nil {
+		t.Costs = make(map[string]float64)
+	}
+	for _, cost := range t.Costs {
+		if cost < 0 {
+			return nil, errInvalidCostTable
+		}
+	}
+	return &t, nil
+}
+
+// LoadCostTable reads a cost table from a JSON file on disk
+func LoadCostTable(filename string) (*CostTable, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParseCostTable(data)
+}
+
+// DefaultCostTable returns the embedded cost table
+func DefaultCostTable() *CostTable {
+	t, err := ParseCostTable(defaultCostData)
+	check("defaultCostTable", err)
+	return t
+}
+
+// SetCostTable replaces the table used by EstimateTimings and CheckTimings.  Passing nil restores the default.
+func SetCostTable(table *CostTable) {
+	if table == nil {
+		table = DefaultCostTable()
+	}
+	costTable = table
+	resetConfigHash()
+}
+
+// Cost looks up how long the effect of a block lasts, trying each of its fields before its type
+func (t *CostTable) Cost(b *Block) float64 {
+	blockType := b.Type
+	if i := strings.Index(blockType, "#"); i >= 0 {
+		blockType = blockType[i+1:]
+	}
+	for _, f := range b.Fields {
+		if cost, ok := t.Costs[blockType+":"+strings.TrimSpace(f.Value)]; ok {
+			return cost
+		}
+	}
+	return t.Costs[blockType]
+}
+
+// EstimateTimings estimates the duration of each enabled event handler of a program in document order
+func EstimateTimings(prog *Program) []HandlerTiming {
+	procedures := make(map[string]*Block)
+	for _, p := range Procedures(prog) {
+		procedures[p.Name] = p.Block
+	}
+	timings := make([]HandlerTiming, 0)
+	eachHandlerBlock(prog, func(b *Block, trigger string, path string) {
+		t := &timer{table: costTable, procedures: procedures, calling: make(map[string]bool)}
+		end := 0.0
+		for _, in := range b.Statements {
+			_, e := t.stack(in.Block)
+			end = math.Max(end, e)
+		}
+		slow := !t.unbounded && costTable.MaxHandlerSeconds > 0 && end > costTable.MaxHandlerSeconds
+		timings = append(timings, HandlerTiming{Event: b.Type, Trigger: trigger, BlockId: b.Id, Path: path,
+			Seconds: end, Unbounded: t.unbounded, Approximate: t.approximate, Slow: slow})
+	})
+	return timings
+}
+
+// CheckTimings reports handlers that take longer than the limit in the cost table
+func CheckTimings(prog *Program) []Issue {
+	issues := make([]Issue, 0)
+	for _, h := range EstimateTimings(prog) {
+		if h.Slow {
+			issues = append(issues, Issue{Kind: "slow-handler", BlockId: h.BlockId, BlockType: h.Event, Path: h.Path,
+				Message: fmt.Sprintf("%s lasts about %ss, more than the %ss limit", h.Name(), formatSeconds(h.Seconds), formatSeconds(costTable.MaxHandlerSeconds))})
+		}
+	}
+	return issues
+}
+
+// Name is the spell for a spell handler, otherwise the event along with its trigger if it has one
+func (h HandlerTiming) Name() string {
+	return handlerName(h.Event, h.Trigger)
+}
+
+// String renders the timing e.g. "reducio: 1.5s", "about 2s" if approximate, "1.5s and then for ever" if unbounded
+func (h HandlerTiming) String() string {
+	s := formatSeconds(h.Seconds) + "s"
+	if h.Approximate {
+		s = "about " + s
+	}
+	if h.Unbounded {
+		s += " and then for ever"
+	}
+	return fmt.Sprintf("%s: %s", h.Name(), s)
+}
+
+// formatSeconds rounds to the nearest hundredth of a second
+func formatSeconds(seconds float64) string {
+	return strconv.FormatFloat(math.Round(seconds*100)/100, 'f', -1, 64)
+}
+
+// timer estimates the timing of one handler
+type timer struct {
+	table       *CostTable
+	procedures  map[string]*Block
+	calling     map[string]bool
+	unbounded   bool
+	approximate bool
+}
+
+// stack returns how long a stack holds up whatever runs it and when its last effect is over,
+// both in seconds from when it starts
+func (t *timer) stack(b *Block) (run float64, end float64) {
+	for ; b != nil; b = nextBlock(b) {
+		if b.Disabled {
+			continue
+		}
+		r, e := t.block(b)
+		end = math.Max(end, run+e)
+		run += r
+	}
+	return run, end
+}
+
+// block returns how long a block holds up its stack and when its last effect is over
+func (t *timer) block(b *Block) (run float64, end float64) {
+	switch {
+	case b.Type == "wait":
+		d := t.delay(b, "DELAY")
+		return d, d
+	case b.Type == "in_x_time":
+		_, e := t.stack(b.Input("DO").Target())
+		return 0, t.delay(b, "DELAY") + e
+	case b.Type == "every_x_seconds" || b.Type == "loops_forever":
+		t.unbounded = true
+		return 0, 0
+	case b.Type == "controls_whileUntil":
+		if !neverLoops(b) {
+			t.unbounded = true
+		}
+		return 0, 0
+	case b.Type == "repeat_x_times":
+		n := math.Floor(t.number(b, "N"))
+		if n <= 0 {
+			return 0, 0
+		}
+		r, e := t.stack(b.Input("DO").Target())
+		return n * r, (n-1)*r + e
+	case b.Type == "controls_if" || b.Type == "controls_if_else_custom":
+		// The slowest branch
+		for _, in := range b.Statements {
+			r, e := t.stack(in.Block)
+			run, end = math.Max(run, r), math.Max(end, e)
+		}
+		return run, end
+	case isProcedureCall(b):
+		name := calledProcedure(b)
+		def, ok := t.procedures[name]
+		if !ok {
+			return 0, 0
+		}
+		if t.calling[name] {
+			t.unbounded = true
+			return 0, 0
+		}
+		t.calling[name] = true
+		defer delete(t.calling, name)
+		return t.stack(def.Input("STACK").Target())
+	}
+	return 0, t.table.Cost(b)
+}
+
+// delay is the named duration input of a block in seconds, in the units of its UNIT field
+func (t *timer) delay(b *Block, name string) float64 {
+	unit, _ := b.Field("UNIT")
+	return toSeconds(t.number(b, name), unit, t.table.FramesPerSecond)
+}
+
+// toSeconds converts a duration in the units of a UNIT field to seconds
+func toSeconds(n float64, unit string, framesPerSecond float64) float64 {
+	switch strings.TrimSpace(unit) {
+	case "milliseconds":
+		return n / 1000
+	case "frames":
+		return n / framesPerSecond
+	case "minutes":
+		return n * 60
+	}
+	return n
+}
+
+// number evaluates a number input, falling back to its shadow when it is not constant
+func (t *timer) number(b *Block, name string) float64 {
+	in := b.Input(name)
+	if c, err := Evaluate(in.Target(), nil); err == nil {
+		if n, err := c.Number(); err == nil {
+			return n
+		}
+	}
+	t.approximate = true
+	if in != nil && in.Shadow != nil {
+		if c, err := Evaluate(in.Shadow, nil); err == nil {
+			if n, err := c.Number(); err == nil {
+				return n
+			}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,106 @@
+package kcode
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func wait(unit string, delay string) string {
+	return fmt.Sprintf(`<block type="wait"><field name="UNIT">%s</field><value name="DELAY">%s</value>`, unit, delay)
+}
+
+func TestCostTable(t *testing.T) {
+	for _, data := range []string{`not json`, `{"framesPerSecond": 0}`, `{"framesPerSecond": 60, "maxHandlerSeconds": -1}`,
+		`{"framesPerSecond": 60, "costs": {"wand_vibrate": -1}}`} {
+		_, err := ParseCostTable([]byte(data))
+		assert.Equal(t, errInvalidCostTable, err, data)
+	}
+	table, err := ParseCostTable([]byte(`{"framesPerSecond": 30}`))
+	assert.Nil(t, err)
+	assert.NotNil(t, table.Costs)
+	_, err = LoadCostTable("missing.json")
+	assert.NotNil(t, err)
+	table = DefaultCostTable()
+	vibrate := valueBlock(t, `<block type="wand_vibrate"><field name="PATTERN">long</field></block>`)
+	assert.Equal(t, 1.0, table.Cost(vibrate))
+	vibrate.Fields[0].Value = "unknown"
+	assert.Equal(t, 0.5, table.Cost(vibrate))
+	assert.Equal(t, 1.0, table.Cost(valueBlock(t, `<block type="speaker#speaker_play"></block>`)))
+	assert.Equal(t, 0.0, table.Cost(valueBlock(t, `<block type="objects_set"></block>`)))
+}
+
+func TestEstimateTimings(t *testing.T) {
+	prog, err := ParseProgram([]byte(`<xml>
+		<block type="events_onGesture" id="a"><field name="TYPE">reducio</field><statement name="CALLBACK">
+		<block type="wand_vibrate"><field name="PATTERN">short</field>
+		<next>` + wait("milliseconds", number("500")) + `
+		<next><block type="particle_bang">
+		<next><block type="in_x_time"><field name="UNIT">seconds</field><value name="DELAY">` + number("3") + `</value>
+		<statement name="DO"><block type="speaker#speaker_play"></block></statement>
+		<next><block type="repeat_x_times"><value name="N">` + number("3") + `</value>
+		<statement name="DO">` + wait("frames", number("10")) + `<next><block type="objects_add"></block></next></block></statement>
+		</block></next></block></next></block></next></block></next></block></statement></block>
+		<block type="events_onFlick" id="b"><field name="TYPE">up</field><statement name="CALLBACK">
+		<block type="every_x_seconds"><statement name="DO"><block type="particle_fizz"></block></statement>
+		<next><block type="particle_bang"></block></next></block></statement></block>
+		<block type="events_onGesture" id="c"><field name="TYPE">accio</field><statement name="CALLBACK">
+		<block type="controls_if"><value name="IF0"><block type="wand_pressed"></block></value>
+		<statement name="DO0">` + wait("seconds", `<shadow type="math_number"><field name="NUM">2</field></shadow><block type="wand_x"></block>`) + `</block></statement>
+		<statement name="ELSE"><block type="particle_fizz"></block></statement>
+		<next><block type="wand_vibrate" disabled="true"><field name="PATTERN">long</field></block></next></block>
+		</statement></block>
+		<block type="events_onGesture" id="d"><field name="TYPE">lumos</field><statement name="CALLBACK">
+		<block type="procedures_callnoreturn"><mutation name="echo"></mutation></block></statement></block>
+		<block type="procedures_defnoreturn"><field name="NAME">echo</field><statement name="STACK">
+		<block type="wand_vibrate"><field name="PATTERN">medium</field>
+		<next><block type="procedures_callnoreturn"><mutation name="echo"></mutation></block></next></block></statement></block>
+		<block type="events_onAppStart" id="e"><statement name="CALLBACK">
+		<block type="controls_whileUntil"><field name="MODE">WHILE</field><value name="BOOL"><block type="logic_boolean"><field name="BOOL">FALSE</field></block></value>
+		<next><block type="procedures_callnoreturn"><mutation name="missing"></mutation></block></next></block></statement></block>
+		</xml>`))
+	assert.Nil(t, err)
+	timings := EstimateTimings(prog)
+	assert.Equal(t, 5, len(timings))
+	names := make([]string, 0)
+	for _, h := range timings {
+		names = append(names, h.String())
+	}
+	// reducio waits 0.5s then the in_x_time plays a sound 3s later.  The repeat ends at 0.5 + 3 * 10 frames.
+	assert.Equal(t, []string{"reducio: 4.5s", "events_onFlick(up): 1.5s and then for ever", "accio: about 2s",
+		"lumos: 0.5s and then for ever", "events_onAppStart: 0s"}, names)
+	assert.Equal(t, "/block[1]", timings[0].Path)
+	assert.False(t, timings[0].Approximate)
+	assert.False(t, timings[0].Slow)
+}
+
+func TestCheckTimings(t *testing.T) {
+	defer SetCostTable(nil)
+	prog, err := ParseProgram([]byte(`<xml>
+		<block type="events_onGesture" id="a"><field name="TYPE">reducio</field><statement name="CALLBACK">` +
+		wait("seconds", number("12")) + `</block></statement></block>
+		<block type="events_onAppStart" id="b"><statement name="CALLBACK">` + wait("minutes", number("1")) +
+		`<next><block type="loops_forever"></block></next></block></statement></block>
+		</xml>`))
+	assert.Nil(t, err)
+	issues := CheckTimings(prog)
+	assert.Equal(t, []string{"slow-handler"}, issueKinds(issues))
+	assert.Equal(t, "reducio lasts about 12s, more than the 10s limit", issues[0].Message)
+	assert.Equal(t, "a", issues[0].BlockId)
+	table := DefaultCostTable()
+	table.MaxHandlerSeconds = 0
+	SetCostTable(table)
+	assert.Empty(t, CheckTimings(prog))
+}
+
+func TestFireworksTimings(t *testing.T) {
+	prog, err := ExtractProgram(ReadFile("challenges/005_fireworks.kcode"))
+	assert.Nil(t, err)
+	// Each flick bangs a firework, lights the wand and gives it a medium buzz
+	timings := EstimateTimings(prog)
+	assert.Equal(t, 2, len(timings))
+	for i, trigger := range []string{"left", "right"} {
+		assert.Equal(t, fmt.Sprintf("events_onFlick(%s): 1.5s", trigger), timings[i].String())
+	}
+}
@@ -0,0 +1,164 @@
+package kcode
+
+// trace.go
+// --------
+// Description:
+// Execution ordered listing of each event handler of a creation.  Extract lists blocks in
+// the order processBlock meets them, which interleaves spells and value shadows, and
+// Handlers lists the statements of a handler with their values folded into their args.
+// Neither matches the order in which things run.  ExecutionOrder steps through each
+// handler the way the runtime does: the value inputs of a block are evaluated before the
+// block, innermost first, then the block runs, then the stacks in its statement inputs,
+// then the next block in its stack.  Loop bodies are listed once rather than unrolled.
+// An if block is listed before its conditions since it runs them one at a time: each
+// IFn condition is listed just before its DOn branch, as IF1 is only tested once IF0 is
+// false, and the ELSE branch comes last.  Every branch is listed since which one runs is
+// only known when the creation runs.
+// Disabled blocks are left out since they never run.
+//
+// API:
+// ExecutionOrder(prog *Program) []Trace
+// ExtractExecutionOrder(jsdata []byte) ([]Trace, error)
+// (t Trace) Name() string
+// (s Step) String() string
+//
+// For example the reducio handler of challenges/022_pumpkins.kcode is traced as:
+//   1. objects_get(Pumpkin3)
+//   2. math_number(15)
+//   3. objects_scale(shrink, Pumpkin3, 15)
+//
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Trace is the steps an event handler takes in the order they happen
+type Trace struct {
+	Event   string `json:"event"`
+	Trigger string `json:"trigger,omitempty"`
+	BlockId string `json:"blockId"`
+	Path    string `json:"path"`
+	Steps   []Step `json:"steps"`
+}
+
+// Step is a block evaluated or run by a handler.  Seq counts the steps of the handler
+// from 1.  Value is true for a value block whose result feeds its parent.  Depth counts
+// the statement inputs the step is nested in below the handler as it does for Action.
+type Step struct {
+	Seq     int      `json:"seq"`
+	BlockId string   `json:"blockId"`
+	Type    string   `json:"type"`
+	Args    []string `json:"args"`
+	Value   bool     `json:"value"`
+	Depth   int      `json:"depth"`
+	Path    string   `json:"path"`
+}
+
+// ExecutionOrder returns the steps of each enabled event handler of a program in document order
+func ExecutionOrder(prog *Program) []Trace {
+	traces := make([]Trace, 0)
+	eachHandlerBlock(prog, func(b *Block, trigger string, path string) {
+		t := Trace{Event: b.Type, Trigger: trigger, BlockId: b.Id, Path: path, Steps: make([]Step, 0)}
+		for _, in := range b.Statements {
+			if in.Block != nil {
+				t.Steps = appendStackSteps(t.Steps, in.Block, 0, fmt.Sprintf("%s/statement[%s]/block", path, in.Name))
+			}
+		}
+		traces = append(traces, t)
+	})
+	return traces
+}
+
+// ExtractExecutionOrder extracts the execution ordered steps of each event handler from .kcode JSON
+func ExtractExecutionOrder(jsdata []byte) ([]Trace, error) {
+	prog, err := ExtractProgram(jsdata)
+	if err != nil {
+		return nil, err
+	}
+	return ExecutionOrder(prog), nil
+}
+
+// Name is the spell for a spell handler, otherwise the event along with its trigger if it has one
+func (t Trace) Name() string {
+	return handlerName(t.Event, t.Trigger)
+}
+
+// String renders the step as a call e.g. "objects_scale(shrink, Pumpkin3, 15)"
+func (s Step) String() string {
+	return fmt.Sprintf("%s(%s)", s.Type, strings.Join(s.Args, ", "))
+}
+
+// appendStackSteps appends the steps of the enabled blocks of a stack following next links
+func appendStackSteps(steps []Step, b *Block, depth int, path string) []Step {
+	for b != nil {
+		if !b.Disabled && isConditional(b) {
+			steps = appendConditionalSteps(steps, b, depth, path)
+		} else if !b.Disabled {
+			steps = appendValueSteps(steps, b, depth, path)
+			steps = appendStep(steps, b, false, depth, path)
+			for _, in := range b.Statements {
+				if in.Block != nil {
+					steps = appendStackSteps(steps, in.Block, depth+1, fmt.Sprintf("%s/statement[%s]/block", path, in.Name))
+				}
+			}
+		}
+		if b.Next == nil {
+			break
+		}
+		b = b.Next.Block
+		path += "/next/block"
+	}
+	return steps
+}
+
+// appendConditionalSteps appends the steps of an if block: the block, then each condition
+// followed by its branch, then the ELSE branch
+func appendConditionalSteps(steps []Step, b *Block, depth int, path string) []Step {
+	steps = appendStep(steps, b, false, depth, path)
+	for i := 0; b.Input(fmt.Sprintf("IF%d", i)) != nil || b.Input(fmt.Sprintf("DO%d", i)) != nil; i++ {
+		if in := b.Input(fmt.Sprintf("IF%d", i)); in != nil {
+			steps = appendInputSteps(steps, in, depth, path)
+		}
+		if in := b.Input(fmt.Sprintf("DO%d", i)); in != nil && in.Block != nil {
+			steps = appendStackSteps(steps, in.Block, depth+1, fmt.Sprintf("%s/statement[%s]/block", path, in.Name))
+		}
+	}
+	if in := b.Input("ELSE"); in != nil && in.Block != nil {
+		steps = appendStackSteps(steps, in.Block, depth+1, fmt.Sprintf("%s/statement[%s]/block", path, in.Name))
+	}
+	return steps
+}
+
+// appendValueSteps appends the steps evaluating the value inputs of a block in input order,
+// each one after the values it depends on
+func appendValueSteps(steps []Step, b *Block, depth int, path string) []Step {
+	for i := range b.Values {
+		steps = appendInputSteps(steps, &b.Values[i], depth, path)
+	}
+	return steps
+}
+
+// appendInputSteps appends the steps evaluating a value input of the block at path.  A block
+// in the input hides its shadow.
+func appendInputSteps(steps []Step, in *Input, depth int, path string) []Step {
+	v, kind := in.Block, "block"
+	if v == nil {
+		v, kind = in.Shadow, "shadow"
+	}
+	if v == nil {
+		return steps
+	}
+	vpath := fmt.Sprintf("%s/value[%s]/%s", path, in.Name, kind)
+	steps = appendValueSteps(steps, v, depth, vpath)
+	return appendStep(steps, v, true, depth, vpath)
+}
+
+func isConditional(b *Block) bool {
+	return b.Type == "controls_if" || b.Type == "controls_if_else_custom"
+}
+
+func appendStep(steps []Step, b *Block, value bool, depth int, path string) []Step {
+	return append(steps, Step{Seq: len(steps) + 1, BlockId: b.Id, Type: b.Type, Args: blockArgs(b),
+		Value: value, Depth: depth, Path: path})
+}
@@ -0,0 +1,97 @@
+package kcode
+
+import (
+	"io/ioutil"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExecutionOrder(t *testing.T) {
+	prog, err := ParseProgram([]byte(`<xml><block type="events_onGesture" id="a"><field name="TYPE">reducio</field>
+		<statement name="CALLBACK"><block type="objects_scale" id="b"><field name="PROPORTION">shrink</field>
+		<value name="TARGET"><shadow type="objects_get" id="c"><field name="ID">all</field></shadow></value>
+		<value name="VALUE"><shadow type="math_number" id="d"><field name="NUM">50</field></shadow>
+		<block type="math_arithmetic" id="e"><field name="OP">MULTIPLY</field>
+		<value name="A"><shadow type="math_number" id="f"><field name="NUM">2</field></shadow></value>
+		<value name="B"><block type="wand_speed" id="g"></block></value></block></value>
+		<next><block type="repeat_x_times" id="h"><value name="N"><shadow type="math_number" id="i"><field name="NUM">3</field></shadow></value>
+		<statement name="DO"><block type="wand_vibrate" id="j"><field name="PATTERN">short</field>
+		<next><block type="objects_remove" id="k" disabled="true"></block></next></block></statement>
+		<next><block type="restart_code" id="l"></block></next>
+		</block></next></block></statement></block>
+		<block type="events_onFlick" id="n"><field name="TYPE">up</field></block>
+		<block type="events_onAppStart" id="o" disabled="true"></block></xml>`))
+	assert.Nil(t, err)
+	traces := ExecutionOrder(prog)
+	assert.Equal(t, 2, len(traces))
+	tr := traces[0]
+	assert.Equal(t, "reducio", tr.Name())
+	assert.Equal(t, "a", tr.BlockId)
+	ids := make([]string, 0)
+	for i, s := range tr.Steps {
+		assert.Equal(t, i+1, s.Seq)
+		ids = append(ids, s.BlockId)
+	}
+	// Values before their parent, the parent before its body and the body before the next block
+	assert.Equal(t, []string{"c", "f", "g", "e", "b", "i", "h", "j", "l"}, ids)
+	assert.Equal(t, Step{Seq: 4, BlockId: "e", Type: "math_arithmetic", Args: []string{"MULTIPLY", "2", "wand_speed"}, Value: true, Depth: 0,
+		Path: "/block[1]/statement[CALLBACK]/block/value[VALUE]/block"}, tr.Steps[3])
+	assert.Equal(t, "/block[1]/statement[CALLBACK]/block/value[VALUE]/block/value[A]/shadow", tr.Steps[1].Path)
+	assert.False(t, tr.Steps[4].Value)
+	assert.Equal(t, "objects_scale(shrink, all, math_arithmetic(MULTIPLY, 2, wand_speed))", tr.Steps[4].String())
+	assert.Equal(t, 1, tr.Steps[7].Depth)
+	assert.Equal(t, "events_onFlick(up)", traces[1].Name())
+	assert.Empty(t, traces[1].Steps)
+}
+
+func TestExecutionOrderConditional(t *testing.T) {
+	prog, err := ParseProgram([]byte(`<xml><block type="events_onFlick" id="a"><field name="TYPE">up</field>
+		<statement name="CALLBACK"><block type="controls_if" id="b"><mutation elseif="1" else="1"></mutation>
+		<value name="IF0"><block type="logic_boolean" id="c"><field name="BOOL">FALSE</field></block></value>
+		<statement name="DO0"><block type="wand_vibrate" id="d"></block></statement>
+		<value name="IF1"><block type="logic_negate" id="e"><value name="BOOL"><block type="logic_boolean" id="f"><field name="BOOL">TRUE</field></block></value></block></value>
+		<statement name="DO1"><block type="restart_code" id="g"></block></statement>
+		<statement name="ELSE"><block type="wand_vibrate" id="h"></block></statement>
+		</block></statement></block></xml>`))
+	assert.Nil(t, err)
+	ids := make([]string, 0)
+	for _, s := range ExecutionOrder(prog)[0].Steps {
+		ids = append(ids, s.BlockId)
+	}
+	// Each condition is tested just before its branch
+	assert.Equal(t, []string{"b", "c", "d", "f", "e", "g", "h"}, ids)
+	assert.Equal(t, 1, ExecutionOrder(prog)[0].Steps[2].Depth)
+}
+
+func TestExtractExecutionOrder(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	traces, err := ExtractExecutionOrder(ReadFile("challenges/022_pumpkins.kcode"))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(traces))
+	steps := make([]string, 0)
+	for _, s := range traces[1].Steps {
+		steps = append(steps, s.String())
+	}
+	assert.Equal(t, []string{"objects_get(Pumpkin3)", "math_number(15)", "objects_scale(shrink, Pumpkin3, 15)"}, steps)
+	_, err = ExtractExecutionOrder([]byte(`not json`))
+	assert.NotNil(t, err)
+	// Every action of every handler in the challenges is a step of its trace, in the same order
+	for _, f := range ListFilesInDirectory("challenges") {
+		prog, err := ExtractProgram(ReadFile("challenges/" + f.Name()))
+		assert.Nil(t, err, f.Name())
+		handlers := Handlers(prog)
+		traces := ExecutionOrder(prog)
+		assert.Equal(t, len(handlers), len(traces), f.Name())
+		for i, h := range handlers {
+			actions := make([]Action, 0)
+			for _, s := range traces[i].Steps {
+				if !s.Value {
+					actions = append(actions, Action{BlockId: s.BlockId, Type: s.Type, Args: s.Args, Depth: s.Depth, Path: s.Path})
+				}
+			}
+			assert.Equal(t, h.Actions, actions, f.Name())
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package kcode
+
+// validate.go
+// -----------
+// Description:
+// Structural validation of .kcode files.  The kcode XML is parsed into a Program which is
+// taken as the truth about what the file contains.  The blocks and spells found by the
+// xml2json based Extract are then compared with it block id by block id so that each
+// discrepancy can be reported with the id and path of the block concerned.
+// A file that cannot be read as JSON or XML is reported as malformed, which is kept
+// apart from the parser missing or inventing blocks in a well formed file.
+//
+// API:
+// ValidateFile(filename string, verbose bool) *ValidationReport
+// ValidateString(filedata []byte, verbose bool) *ValidationReport
+// ValidateReader(r io.Reader, verbose bool) *ValidationReport
+// (r *ValidationReport) String() string
+//
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	xml2json "github.com/basgys/goxml2json"
+	log "github.com/sirupsen/logrus"
+)
+
+// Kinds of discrepancy found by validation
+const (
+	// KindMalformed means the file is not valid .kcode JSON or its kcode XML is broken
+	KindMalformed = "malformed"
+	// KindParserError means the file is well formed but Extract failed on it
+	KindParserError = "parser-error"
+	// KindMissedBlock means a block in the XML was not found by Extract
+	KindMissedBlock = "missed-block"
+	// KindUnexpectedBlock means Extract found a block that is not in the XML
+	KindUnexpectedBlock = "unexpected-block"
+	// KindMissedSpell means an events_onGesture spell in the XML was not found by Extract
+	KindMissedSpell = "missed-spell"
+	// KindUnexpectedSpell means Extract found a spell that is not in the XML
+	KindUnexpectedSpell = "unexpected-spell"
+	// KindMissedPart means a part in the file was not found by ExtractParts
+	KindMissedPart = "missed-part"
+)
+
+// Counts holds the number of blocks, spells and parts in a creation along with its scene
+type Counts struct {
+	Blocks int    `json:"blocks"`
+	Spells int    `json:"spells"`
+	Parts  int    `json:"parts"`
+	Scene  string `json:"scene"`
+}
+
+// ValidationReport is the result of validating a .kcode file.
+// Expected counts come from the XML tree and Found counts from Extract.
+// Discrepancies make the file invalid.  Warnings are lint issues, see LintString,
+// which are reported but do not.  Kits are the ids of the kits the creation is for, see DetectKits.
+type ValidationReport struct {
+	File          string   `json:"file,omitempty"`
+	Valid         bool     `json:"valid"`
+	Malformed     bool     `json:"malformed"`
+	Expected      Counts   `json:"expected"`
+	Found         Counts   `json:"found"`
+	Kits          []string `json:"kits"`
+	Discrepancies []Issue  `json:"discrepancies"`
+	Warnings      []Issue  `json:"warnings"`
+}
+
+// blockRef is a block found in the XML tree
+type blockRef struct {
+	block *Block
+	path  string
+}
+
+// ValidateFile validates a .kcode file, see ValidateString
+func ValidateFile(filename string, verbose bool) *ValidationReport {
+	log.Info(fmt.Sprintf("------- Reading file '%s' ------\n", filename))
+	report := ValidateString(ReadFile(filename), verbose)
+	report.File = filename
+	return report
+}
+
+// ValidateReader validates .kcode read from r, see ValidateString.  A read that fails gives a malformed report.
+func ValidateReader(r io.Reader, verbose bool) *ValidationReport {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return &ValidationReport{Malformed: true, Kits: make([]string, 0), Warnings: make([]Issue, 0),
+			Discrepancies: []Issue{{Kind: KindMalformed, Message: fmt.Sprintf("could not read: %s", err)}}}
+	}
+	return ValidateString(data, verbose)
+}
+
+// ValidateString validates that every block, spell and part in .kcode data is found by the parser
+func ValidateString(filedata []byte, verbose bool) *ValidationReport {
+	report := &ValidationReport{Kits: make([]string, 0), Discrepancies: make([]Issue, 0), Warnings: make([]Issue, 0)}
+	malformed := func(msg string) *ValidationReport {
+		report.Malformed = true
+		report.Discrepancies = append(report.Discrepancies, Issue{Kind: KindMalformed, Message: msg})
+		return report
+	}
+	discrepancy := func(kind string, id string, t string, path string, msg string) {
+		report.Discrepancies = append(report.Discrepancies, Issue{Kind: kind, BlockId: id, BlockType: t, Path: path, Message: msg})
+	}
+
+	var raw struct {
+		Source string            `json:"source"`
+		Parts  []json.RawMessage `json:"parts"`
+		Scene  string            `json:"scene"`
+	}
+	if err := json.Unmarshal(filedata, &raw); err != nil {
+		return malformed(fmt.Sprintf("%s: %s", errInvalidJSON, err))
+	}
+	if len(raw.Source) == 0 {
+		return malformed("no kcode source")
+	}
+	prog, err := ParseProgram([]byte(raw.Source))
+	if err != nil {
+		return malformed(err.Error())
+	}
+	parts, err := ExtractParts(filedata)
+	if err != nil {
+		return malformed(fmt.Sprintf("invalid parts: %s", err))
+	}
+	kits, err := detectFileKits(filedata, prog)
+	if err != nil {
+		return malformed(fmt.Sprintf("invalid kits: %s", err))
+	}
+	report.Kits = kits.Kits
+
+	// What the XML tree says is there
+	blocks := make([]blockRef, 0)
+	spells := make([]blockRef, 0)
+	eachBlockPath(prog, func(b *Block, path string) {
+		if b.Shadow {
+			return
+		}
+		blocks = append(blocks, blockRef{b, path})
+		if b.Type == "events_onGesture" {
+			spells = append(spells, blockRef{b, path})
+		}
+	})
+	report.Expected = Counts{Blocks: len(blocks), Spells: len(spells), Parts: len(raw.Parts), Scene: raw.Scene}
+
+	// What the parser finds
+	foundBlocks, blockIds, foundSpells, spellIds, err := extractWithIds([]byte(raw.Source), verbose)
+	if err != nil {
+		discrepancy(KindParserError, "", "", "", fmt.Sprintf("parser failed on well formed file: %s", err))
+		return report
+	}
+	report.Found = Counts{Blocks: len(foundBlocks), Spells: len(foundSpells), Parts: len(parts), Scene: raw.Scene}
+
+	compare := func(expected []blockRef, names []string, ids []string, missed string, unexpected string, what string) {
+		found := make(map[string]int)
+		for _, id := range ids {
+			found[id]++
+		}
+		for _, ref := range expected {
+			if found[ref.block.Id] > 0 {
+				found[ref.block.Id]--
+			} else {
+				discrepancy(missed, ref.block.Id, ref.block.Type, ref.path, fmt.Sprintf("parser missed %s", what))
+			}
+		}
+		for i, id := range ids {
+			if found[id] > 0 {
+				found[id]--
+				discrepancy(unexpected, id, "", "", fmt.Sprintf("parser found %s '%s' which is not in the XML", what, names[i]))
+			}
+		}
+	}
+	compare(blocks, foundBlocks, blockIds, KindMissedBlock, KindUnexpectedBlock, "block")
+	compare(spells, foundSpells, spellIds, KindMissedSpell, KindUnexpectedSpell, "spell")
+	for i := len(parts); i < len(raw.Parts); i++ {
+		discrepancy(KindMissedPart, "", "", fmt.Sprintf("/parts[%d]", i+1), "parser missed part")
+	}
+
+	report.Warnings = append(report.Warnings, LintProgram(prog, raw.Scene)...)
+	report.Warnings = append(report.Warnings, kits.Issues...)
+	report.Valid = len(report.Discrepancies) == 0
+	return report
+}
+
+// extractWithIds runs the same xml2json extraction as ProcessKcodeFileString and also returns
+// the id of each block and spell found.  Panics from the parser are returned as errors.
+func extractWithIds(kcode []byte, verbose bool) (blocks []string, blockIds []string, spells []string, spellIds []string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if entry, ok := r.(*log.Entry); ok {
+				err = fmt.Errorf("%s", entry.Message)
+			} else {
+				err = fmt.Errorf("%v", r)
+			}
+		}
+	}()
+	jsn, err := xml2json.Convert(bytes.NewReader(kcode))
+	if err != nil {
+		return
+	}
+	blocks, blockIds = make([]string, 0), make([]string, 0)
+	extract(&blocks, &blockIds, jsn.Bytes(), KCodeFlags{Blocks: true}, verbose)
+	spells, spellIds = make([]string, 0), make([]string, 0)
+	extract(&spells, &spellIds, jsn.Bytes(), KCodeFlags{Spells: true}, verbose)
+	return
+}
+
+// String renders the report as readable text
+func (r *ValidationReport) String() string {
+	var sb strings.Builder
+	switch {
+	case r.Valid:
+		fmt.Fprintf(&sb, "SUCCEEDED in validating '%s'.\n", r.File)
+	case r.Malformed:
+		fmt.Fprintf(&sb, "FAILED to validate '%s'. File is malformed.\n", r.File)
+	default:
+		fmt.Fprintf(&sb, "FAILED to validate '%s'.\n", r.File)
+	}
+	if !r.Malformed {
+		fmt.Fprintf(&sb, "Expected %d spells and found %d\n", r.Expected.Spells, r.Found.Spells)
+		fmt.Fprintf(&sb, "Expected %d blocks and found %d\n", r.Expected.Blocks, r.Found.Blocks)
+		fmt.Fprintf(&sb, "Expected %d parts and found %d\n", r.Expected.Parts, r.Found.Parts)
+		fmt.Fprintf(&sb, "Scene '%s'\n", r.Expected.Scene)
+		fmt.Fprintf(&sb, "Kit '%s'\n", KitNames(r.Kits))
+	}
+	for _, issue := range r.Discrepancies {
+		fmt.Fprintf(&sb, "discrepancy: %s\n", issue)
+	}
+	for _, issue := range r.Warnings {
+		fmt.Fprintf(&sb, "warning: %s\n", issue)
+	}
+	return sb.String()
+}
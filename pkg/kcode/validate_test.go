@@ -0,0 +1,67 @@
+package kcode
+
+import (
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateFileAllChallenges(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	files := ListFilesInDirectory("challenges")
+	for _, f := range files {
+		filename := "challenges/" + f.Name()
+		report := ValidateFile(filename, false)
+		assert.True(t, report.Valid, report.String())
+		assert.Empty(t, report.Discrepancies, filename)
+		if kinds, ok := knownIssues[filename]; ok {
+			assert.Equal(t, kinds, issueKinds(report.Warnings), filename)
+		} else {
+			assert.Empty(t, report.Warnings, filename)
+		}
+		assert.Equal(t, report.Expected, report.Found, filename)
+		assert.Equal(t, BlockCount(GetXML(filename)), report.Expected.Blocks, filename)
+	}
+}
+
+func TestValidateString(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	report := ValidateFile("challenges/1022_pumpkins.kcode", false)
+	assert.True(t, report.Valid)
+	assert.Equal(t, Counts{Blocks: 5, Spells: 2, Parts: 0, Scene: "puzzle022"}, report.Expected)
+	assert.Contains(t, report.String(), "SUCCEEDED in validating 'challenges/1022_pumpkins.kcode'.")
+
+	report = ValidateReader(strings.NewReader(string(ReadFile("challenges/1022_pumpkins.kcode"))), false)
+	assert.True(t, report.Valid)
+	assert.Equal(t, Counts{Blocks: 5, Spells: 2, Parts: 0, Scene: "puzzle022"}, report.Found)
+	report = ValidateReader(iotest.ErrReader(errors.New("reset")), false)
+	assert.True(t, report.Malformed)
+	assert.Equal(t, "could not read: reset", report.Discrepancies[0].Message)
+}
+
+func TestValidateMalformed(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	report := ValidateString([]byte(`{"source": "<xml><block type=", "parts": [], "scene": "owlery"}`), false)
+	assert.False(t, report.Valid)
+	assert.True(t, report.Malformed)
+	assert.Equal(t, KindMalformed, report.Discrepancies[0].Kind)
+
+	report = ValidateString([]byte(`not json`), false)
+	assert.True(t, report.Malformed)
+	assert.Contains(t, report.String(), "File is malformed")
+}
+
+func TestValidateParserError(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	// Well formed XML but Extract insists on every block having an id
+	report := ValidateString([]byte(`{"source": "<xml><block type=\"events_onAppStart\"></block></xml>", "parts": [], "scene": "owlery"}`), false)
+	assert.False(t, report.Valid)
+	assert.False(t, report.Malformed)
+	assert.Equal(t, KindParserError, report.Discrepancies[0].Kind)
+	assert.Equal(t, 1, report.Expected.Blocks)
+}
@@ -0,0 +1,149 @@
+package kcode
+
+// variables.go
+// ------------
+// Description:
+// Variables declared in the <variables> element of a creation and the blocks that use them.
+// Blocks refer to a variable through a field_variable field, e.g. the VAR field of
+// variables_get and variables_set or the LEFT_HAND field of unary.  The field carries the
+// id of the variable as well as its name so references are linked by id, falling back to
+// the name for fields that have no id.  variables_set and unary write the variable and
+// every other block reads it.  Disabled blocks are left out since they never run.
+// CheckVariables reports variables that are never used, used without being declared or
+// written but never read.  Blockly declares a variable called "item" in every workspace
+// where a variable block has been opened so an unused "item" is not reported.
+//
+// API:
+// AnalyzeVariables(prog *Program) []VariableUsage
+// CheckVariables(prog *Program) []Issue
+//
+
+import (
+	"fmt"
+	"sort"
+)
+
+// defaultVariable is the variable Blockly declares for the variable blocks in its toolbox
+const defaultVariable = "item"
+
+// variableWriters are the block types that assign to the variable they name
+var variableWriters = map[string]bool{
+	"variables_set": true,
+	"unary":         true,
+}
+
+// VariableUsage is a variable along with the ids of the blocks reading and writing it.
+// Declared is false for variables that blocks refer to but <variables> does not declare.
+type VariableUsage struct {
+	Variable Variable `json:"variable"`
+	Declared bool     `json:"declared"`
+	Reads    []string `json:"reads"`
+	Writes   []string `json:"writes"`
+}
+
+// variableRef is a block field referring to a variable
+type variableRef struct {
+	block *Block
+	field Field
+	path  string
+}
+
+// AnalyzeVariables links the declared variables to the blocks using them.  Declared
+// variables come first in declaration order followed by undeclared ones in the order
+// they are first used.
+func AnalyzeVariables(prog *Program) []VariableUsage {
+	usages, _ := analyzeVariables(prog)
+	return usages
+}
+
+// CheckVariables reports unused, undeclared and write-only variables
+func CheckVariables(prog *Program) []Issue {
+	issues := make([]Issue, 0)
+	usages, first := analyzeVariables(prog)
+	for i, u := range usages {
+		name := u.Variable.Name
+		switch {
+		case !u.Declared:
+			ref := first[i]
+			issues = append(issues, Issue{Kind: "undeclared-variable", BlockId: ref.block.Id, BlockType: ref.block.Type, Path: ref.path,
+				Message: fmt.Sprintf("variable '%s' is not declared", name), Suggestions: Suggest(name, declaredNames(prog))})
+		case len(u.Reads) == 0 && len(u.Writes) == 0 && name != defaultVariable:
+			issues = append(issues, Issue{Kind: "unused-variable", Message: fmt.Sprintf("variable '%s' is never used", name)})
+		case len(u.Reads) == 0 && len(u.Writes) > 0:
+			ref := first[i]
+			issues = append(issues, Issue{Kind: "write-only-variable", BlockId: ref.block.Id, BlockType: ref.block.Type, Path: ref.path,
+				Message: fmt.Sprintf("variable '%s' is set but never read", name)})
+		}
+	}
+	return issues
+}
+
+// analyzeVariables returns the usages along with the first reference to each variable
+func analyzeVariables(prog *Program) ([]VariableUsage, []*variableRef) {
+	usages := make([]VariableUsage, 0, len(prog.Variables))
+	first := make([]*variableRef, 0, len(prog.Variables))
+	byId := make(map[string]int)
+	byName := make(map[string]int)
+	for _, v := range prog.Variables {
+		byName[v.Name] = len(usages)
+		if len(v.Id) > 0 {
+			byId[v.Id] = len(usages)
+		}
+		usages = append(usages, VariableUsage{Variable: v, Declared: true, Reads: []string{}, Writes: []string{}})
+		first = append(first, nil)
+	}
+	eachVariableRef(prog, func(ref *variableRef) {
+		i, ok := byId[ref.field.Id]
+		if !ok || len(ref.field.Id) == 0 {
+			i, ok = byName[ref.field.Value]
+		}
+		if !ok {
+			i = len(usages)
+			v := Variable{Id: ref.field.Id, Type: ref.field.VariableType, Name: ref.field.Value}
+			usages = append(usages, VariableUsage{Variable: v, Reads: []string{}, Writes: []string{}})
+			first = append(first, nil)
+			byName[v.Name] = i
+			if len(v.Id) > 0 {
+				byId[v.Id] = i
+			}
+		}
+		if first[i] == nil {
+			first[i] = ref
+		}
+		if variableWriters[ref.block.Type] {
+			usages[i].Writes = append(usages[i].Writes, ref.block.Id)
+		} else {
+			usages[i].Reads = append(usages[i].Reads, ref.block.Id)
+		}
+	})
+	return usages, first
+}
+
+// eachVariableRef calls fn for every field_variable field of the enabled blocks in document order
+func eachVariableRef(prog *Program, fn func(ref *variableRef)) {
+	eachEnabledBlockPath(prog, func(b *Block, path string) {
+		schema, ok := blockRegistry.Lookup(b.Type)
+		if !ok {
+			return
+		}
+		for _, fs := range schema.Fields {
+			if fs.Kind != "field_variable" {
+				continue
+			}
+			for _, f := range b.Fields {
+				if f.Name == fs.Name {
+					fn(&variableRef{block: b, field: f, path: path})
+				}
+			}
+		}
+	})
+}
+
+func declaredNames(prog *Program) []string {
+	names := make([]string, 0, len(prog.Variables))
+	for _, v := range prog.Variables {
+		names = append(names, v.Name)
+	}
+	sort.Strings(names)
+	return names
+}
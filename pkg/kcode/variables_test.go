@@ -0,0 +1,104 @@
+package kcode
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	xml2json "github.com/basgys/goxml2json"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+const variablesXML = `<xml><variables>
+	<variable type="" id="v1">count</variable>
+	<variable type="" id="v2">total</variable>
+	<variable type="" id="v3">spare</variable>
+	<variable type="" id="v4">item</variable>
+	</variables>
+	<block type="events_onAppStart" id="a">
+	<statement name="CALLBACK">
+	<block type="variables_set" id="b"><field name="VAR" id="v1" variabletype="">count</field>
+	<value name="VALUE"><shadow type="math_number" id="c"><field name="NUM">0</field></shadow></value>
+	<next><block type="unary" id="d"><field name="LEFT_HAND" id="v2" variabletype="">total</field><field name="OPERATOR">+=</field>
+	<value name="RIGHT_HAND"><block type="variables_get" id="e"><field name="VAR" id="v1" variabletype="">renamed</field></block></value>
+	<next><block type="variables_set" id="f"><field name="VAR" variabletype="">totl</field></block></next>
+	</block></next>
+	</block>
+	</statement>
+	</block></xml>`
+
+func TestAnalyzeVariables(t *testing.T) {
+	prog, err := ParseProgram([]byte(variablesXML))
+	assert.Nil(t, err)
+	assert.Equal(t, Variable{Id: "v1", Name: "count"}, prog.Variables[0])
+	usages := AnalyzeVariables(prog)
+	assert.Equal(t, 5, len(usages))
+	// Linked by id even though the field has a stale name
+	assert.Equal(t, "count", usages[0].Variable.Name)
+	assert.Equal(t, []string{"e"}, usages[0].Reads)
+	assert.Equal(t, []string{"b"}, usages[0].Writes)
+	assert.Equal(t, []string{"d"}, usages[1].Writes)
+	assert.Empty(t, usages[2].Reads)
+	assert.Empty(t, usages[2].Writes)
+	assert.True(t, usages[3].Declared)
+	assert.False(t, usages[4].Declared)
+	assert.Equal(t, "totl", usages[4].Variable.Name)
+	assert.Equal(t, []string{"f"}, usages[4].Writes)
+}
+
+func TestCheckVariables(t *testing.T) {
+	prog, err := ParseProgram([]byte(variablesXML))
+	assert.Nil(t, err)
+	issues := CheckVariables(prog)
+	assert.Equal(t, []string{"write-only-variable", "unused-variable", "undeclared-variable"}, issueKinds(issues))
+	assert.Equal(t, "d", issues[0].BlockId)
+	assert.Contains(t, issues[1].Message, "'spare'")
+	assert.Equal(t, "f", issues[2].BlockId)
+	assert.Equal(t, []string{"total"}, issues[2].Suggestions)
+	assert.Equal(t, "/block[1]/statement[CALLBACK]/block/next/block/next/block", issues[2].Path)
+}
+
+func TestExtractVariables(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	for filename, expected := range map[string][]string{
+		"challenges/059_flowers.kcode":   {"hue", "wandColour", "item"},
+		"challenges/001_colovaria.kcode": {},
+		"challenges/048_smoke.kcode":     {"xPosition", "yPosition"},
+	} {
+		jsn, err := xml2json.Convert(bytes.NewReader(GetXML(filename)))
+		assert.Nil(t, err)
+		assert.Equal(t, expected, ExtractVariables(jsn.Bytes(), false), filename)
+	}
+	// A variable with no name is well formed Blockly and does not get mixed up with the blocks
+	jsn, err := xml2json.Convert(bytes.NewReader([]byte(`<xml><variables><variable type="" id="a"></variable>
+		<variable type="" id="b">count</variable></variables><block type="events_onAppStart" id="c"></block></xml>`)))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"", "count"}, ExtractVariables(jsn.Bytes(), false))
+	assert.Equal(t, []string{"events_onAppStart"}, ExtractBlocks(jsn.Bytes(), false))
+	prog, err := GetProgram("challenges/059_flowers.kcode")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(prog.Variables))
+	assert.Empty(t, CheckVariables(prog))
+}
+
+func TestProcessKcodeContentsVariables(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	data := ReadFile("challenges/048_smoke.kcode")
+	contents := ProcessKcodeContents(data, KCodeFlags{Blocks: true, Variables: true}, false)
+	prog, err := ExtractProgram(data)
+	assert.Nil(t, err)
+	assert.Equal(t, prog.Variables, contents.Variables)
+	assert.Equal(t, "yPosition", contents.Variables[1].Name)
+	assert.Equal(t, "cKx;Nl_).2|!FN9t-f2M", contents.Variables[1].Id)
+	assert.Equal(t, ExtractBlocks(jsonSource(t, data), false), contents.Blocks)
+	assert.Nil(t, ProcessKcodeContents(data, KCodeFlags{Blocks: true}, false).Variables)
+}
+
+func jsonSource(t *testing.T, data []byte) []byte {
+	xml, err := ExtractXML(data)
+	assert.Nil(t, err)
+	jsn, err := xml2json.Convert(bytes.NewReader(xml))
+	assert.Nil(t, err)
+	return jsn.Bytes()
+}
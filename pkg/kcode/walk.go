@@ -0,0 +1,143 @@
+package kcode
+
+// walk.go
+// -------
+// Description:
+// Traversal of a Program for custom analyses.  Walk visits every block and shadow in
+// document order, following value, statement and next links, and tells the Visitor
+// where each one was found: how it is linked in, the input it sits in, the chain of
+// blocks enclosing it and its depth.  A visitor returns false to skip the inputs of a
+// block, i.e. everything nested inside it.  The blocks that follow it through its next
+// link are still visited since they are siblings rather than children.
+// Analyses of what a creation does wrap their visitor in SkipDisabled since disabled
+// blocks, and everything in their inputs, never run.
+//
+// API:
+// Walk(prog *Program, v Visitor)
+// WalkBlock(b *Block, v Visitor)
+// SkipDisabled(v Visitor) Visitor
+// (f VisitorFunc) Visit(v Visit) bool
+//
+
+import (
+	"fmt"
+)
+
+// Ways a block can be linked to the block before it in the tree
+const (
+	// LinkTop is a top level block in the program
+	LinkTop = "top"
+	// LinkValue is a block plugged into a value input
+	LinkValue = "value"
+	// LinkShadow is the shadow of a value or statement input
+	LinkShadow = "shadow"
+	// LinkStatement is the first block of a statement input
+	LinkStatement = "statement"
+	// LinkNext is a block following another one in a stack
+	LinkNext = "next"
+)
+
+// Visit describes a block found by Walk.
+// Parents is the chain of enclosing blocks from the outermost in, so blocks in the same
+// stack share the same parents and Depth is len(Parents).  Input is the name of the value
+// or statement input holding the block or its stack.  Previous is set for LinkNext.
+type Visit struct {
+	Block    *Block
+	Link     string
+	Input    string
+	Parents  []*Block
+	Previous *Block
+	Depth    int
+	Path     string
+}
+
+// Parent returns the innermost enclosing block or nil for a block at the top of a stack
+func (v Visit) Parent() *Block {
+	if len(v.Parents) == 0 {
+		return nil
+	}
+	return v.Parents[len(v.Parents)-1]
+}
+
+// Visitor is called by Walk for each block.  Returning false skips the inputs of the block.
+type Visitor interface {
+	Visit(v Visit) bool
+}
+
+// VisitorFunc lets an ordinary function be used as a Visitor
+type VisitorFunc func(v Visit) bool
+
+// Visit calls f(v)
+func (f VisitorFunc) Visit(v Visit) bool {
+	return f(v)
+}
+
+// Walk visits every block and shadow in the program in document order.
+// The inputs of a block are visited values first then statements, each with its shadow
+// before its block, followed by the next link.
+func Walk(prog *Program, v Visitor) {
+	for i, block := range prog.Blocks {
+		walk(Visit{Block: block, Link: LinkTop, Parents: []*Block{}, Path: fmt.Sprintf("/block[%d]", i+1)}, v)
+	}
+}
+
+// WalkBlock visits a block and everything attached to it as though it was at the top of a program
+func WalkBlock(b *Block, v Visitor) {
+	if b != nil {
+		walk(Visit{Block: b, Link: LinkTop, Parents: []*Block{}, Path: "/block"}, v)
+	}
+}
+
+// SkipDisabled returns a visitor that passes every block on to v except disabled
+// blocks and the blocks in their inputs
+func SkipDisabled(v Visitor) Visitor {
+	return VisitorFunc(func(visit Visit) bool {
+		if visit.Block.Disabled {
+			return false
+		}
+		return v.Visit(visit)
+	})
+}
+
+func walk(visit Visit, v Visitor) {
+	// Each stack is walked along its next links in a loop so that long
+	// stacks do not recurse once per block
+	for {
+		b := visit.Block
+		if v.Visit(visit) {
+			parents := make([]*Block, len(visit.Parents)+1)
+			copy(parents, visit.Parents)
+			parents[len(parents)-1] = b
+			walkInputs(b.Values, LinkValue, "value", parents, visit.Path, v)
+			walkInputs(b.Statements, LinkStatement, "statement", parents, visit.Path, v)
+		}
+		if b.Next == nil {
+			break
+		}
+		next := b.Next
+		path := visit.Path + "/next"
+		if next.Shadow != nil {
+			walk(Visit{Block: next.Shadow, Link: LinkShadow, Input: visit.Input, Parents: visit.Parents,
+				Depth: visit.Depth, Path: path + "/shadow"}, v)
+		}
+		if next.Block == nil {
+			break
+		}
+		visit = Visit{Block: next.Block, Link: LinkNext, Input: visit.Input, Parents: visit.Parents,
+			Previous: b, Depth: visit.Depth, Path: path + "/block"}
+	}
+}
+
+func walkInputs(inputs []Input, link string, element string, parents []*Block, path string, v Visitor) {
+	for _, in := range inputs {
+		inpath := fmt.Sprintf("%s/%s[%s]", path, element, in.Name)
+		if in.Shadow != nil {
+			walk(Visit{Block: in.Shadow, Link: LinkShadow, Input: in.Name, Parents: parents, Depth: len(parents),
+				Path: inpath + "/shadow"}, v)
+		}
+		if in.Block != nil {
+			walk(Visit{Block: in.Block, Link: link, Input: in.Name, Parents: parents, Depth: len(parents),
+				Path: inpath + "/block"}, v)
+		}
+	}
+}
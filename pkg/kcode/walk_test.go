@@ -0,0 +1,76 @@
+package kcode
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const walkXML = `<xml><block type="events_onGesture" id="a">
+	<field name="TYPE">reducio</field>
+	<statement name="CALLBACK">
+	<block type="objects_scale" id="b">
+	<value name="TARGET"><shadow type="objects_get" id="c"><field name="ID">all</field></shadow></value>
+	<value name="FACTOR"><shadow type="math_number" id="d"><field name="NUM">1</field></shadow>
+	<block type="math_arithmetic" id="e"><field name="OP">MULTIPLY</field>
+	<value name="A"><shadow type="math_number" id="f"><field name="NUM">2</field></shadow></value>
+	</block></value>
+	<next><block type="wand_vibrate" id="g"></block></next>
+	</block></statement></block>
+	<block type="events_onAppStart" id="h"></block></xml>`
+
+func TestWalk(t *testing.T) {
+	prog, err := ParseProgram([]byte(walkXML))
+	assert.Nil(t, err)
+	visits := make([]Visit, 0)
+	Walk(prog, VisitorFunc(func(v Visit) bool {
+		visits = append(visits, v)
+		return true
+	}))
+	ids := make([]string, 0)
+	for _, v := range visits {
+		ids = append(ids, v.Block.Id)
+	}
+	assert.Equal(t, []string{"a", "b", "c", "d", "e", "f", "g", "h"}, ids)
+
+	assert.Equal(t, LinkTop, visits[0].Link)
+	assert.Nil(t, visits[0].Parent())
+	assert.Equal(t, LinkStatement, visits[1].Link)
+	assert.Equal(t, "CALLBACK", visits[1].Input)
+	assert.Equal(t, 1, visits[1].Depth)
+	assert.Equal(t, LinkShadow, visits[2].Link)
+	assert.Equal(t, "TARGET", visits[2].Input)
+	assert.Equal(t, LinkValue, visits[4].Link)
+	assert.Equal(t, "/block[1]/statement[CALLBACK]/block/value[FACTOR]/block", visits[4].Path)
+	// f is inside e inside b inside a
+	assert.Equal(t, 3, visits[5].Depth)
+	assert.Equal(t, []*Block{visits[0].Block, visits[1].Block, visits[4].Block}, visits[5].Parents)
+	// g follows b in the same stack so shares its parents
+	assert.Equal(t, LinkNext, visits[6].Link)
+	assert.Equal(t, "CALLBACK", visits[6].Input)
+	assert.Equal(t, visits[1].Block, visits[6].Previous)
+	assert.Equal(t, visits[1].Parents, visits[6].Parents)
+	assert.Equal(t, "/block[1]/statement[CALLBACK]/block/next/block", visits[6].Path)
+	assert.Equal(t, "/block[2]", visits[7].Path)
+}
+
+func TestWalkSkip(t *testing.T) {
+	prog, err := ParseProgram([]byte(walkXML))
+	assert.Nil(t, err)
+	ids := make([]string, 0)
+	Walk(prog, VisitorFunc(func(v Visit) bool {
+		ids = append(ids, v.Block.Id)
+		return v.Block.Type != "objects_scale"
+	}))
+	// The inputs of b are skipped but the block after it is not
+	assert.Equal(t, []string{"a", "b", "g", "h"}, ids)
+
+	ids = ids[:0]
+	WalkBlock(prog.Blocks[0].Input("CALLBACK").Block, VisitorFunc(func(v Visit) bool {
+		if v.Depth == 0 {
+			ids = append(ids, v.Block.Id)
+		}
+		return true
+	}))
+	assert.Equal(t, []string{"b", "g"}, ids)
+}